@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,6 +20,16 @@ func NewAPI(videoService VideoService) *API {
 	}
 }
 
+// bearerToken returns the credential of an "Authorization: Bearer" header.
+func bearerToken(c *gin.Context) string {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	return token
+}
+
 func (api *API) HandleUpload(c *gin.Context) {
 	file, err := c.FormFile("video")
 	if err != nil {
@@ -31,9 +43,14 @@ func (api *API) HandleUpload(c *gin.Context) {
 		return
 	}
 
-	video, err := api.VideoService.CreateVideo(c, inputFilePath)
+	video, err := api.VideoService.CreateVideo(c, inputFilePath, c.PostForm("overlay"))
 
 	if err != nil {
+		if err.Error() == string(ErrOverlayNotFound) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Overlay not found: %v", err))
+			return
+		}
+
 		c.String(http.StatusInternalServerError, fmt.Sprintf("Erro ao criar vídeo: %v", err))
 		return
 	}
@@ -49,6 +66,11 @@ func (api *API) GetVideo(c *gin.Context) {
 	video, err := api.VideoService.GetVideo(c, videoID)
 
 	if err != nil {
+		if err.Error() == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
 		c.String(http.StatusInternalServerError, fmt.Sprintf("Erro ao buscar vídeo: %v", err))
 		return
 	}
@@ -60,11 +82,16 @@ func (api *API) GetVideoURL(c *gin.Context) {
 	videoID := c.Param("id")
 	resolution := c.Query("resolution")
 
-	url, err := api.VideoService.GetVideoURL(c, videoID, resolution)
+	url, err := api.VideoService.GetVideoURL(c, videoID, resolution, bearerToken(c))
 
 	if err != nil {
 		message := err.Error()
 
+		if message == string(ErrUnauthorized) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
 		if message == string(ErrVideoNotFound) {
 			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
 			return
@@ -93,3 +120,441 @@ func (api *API) GetVideoURL(c *gin.Context) {
 		"url": url,
 	})
 }
+
+func (api *API) GetDashURL(c *gin.Context) {
+	videoID := c.Param("id")
+
+	url, err := api.VideoService.GetDashURL(c, videoID, bearerToken(c))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrUnauthorized) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		if message == string(ErrDashNotAvailable) {
+			c.String(http.StatusNotFound, fmt.Sprintf("DASH not available: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error searching video: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url": url,
+	})
+}
+
+// GetDashManifest serves the DASH manifest signed for the requesting viewer,
+// so it must not be cached by intermediaries.
+func (api *API) GetDashManifest(c *gin.Context) {
+	manifest, err := api.VideoService.GetDashManifest(c, c.Param("id"), c.Query("token"))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrTokenInvalid) || message == string(ErrTokenExpired) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) || message == string(ErrDashNotAvailable) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Manifest not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error generating manifest: %v", err))
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/dash+xml", []byte(manifest))
+}
+
+func (api *API) UploadSubtitles(c *gin.Context) {
+	videoID := c.Param("id")
+
+	file, err := c.FormFile("subtitles")
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error receiving file: %v", err))
+		return
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading file: %v", err))
+		return
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading file: %v", err))
+		return
+	}
+
+	track, err := api.VideoService.AddSubtitles(c, videoID, content, c.PostForm("language"), c.PostForm("title"))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		if message == string(ErrSubtitlesInvalid) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Subtitles invalid: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error storing subtitles: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, track)
+}
+
+func (api *API) GetSpritesURL(c *gin.Context) {
+	videoID := c.Param("id")
+
+	url, err := api.VideoService.GetSpritesURL(c, videoID, bearerToken(c))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrUnauthorized) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		if message == string(ErrSpritesNotAvailable) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Sprites not available: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error searching video: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url": url,
+	})
+}
+
+// GetSpriteVTT serves the sprite thumbnail track signed for the requesting
+// viewer, so it must not be cached by intermediaries.
+func (api *API) GetSpriteVTT(c *gin.Context) {
+	vtt, err := api.VideoService.GetSpriteVTT(c, c.Param("id"), c.Query("token"))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrTokenInvalid) || message == string(ErrTokenExpired) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) || message == string(ErrSpritesNotAvailable) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Sprites not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error generating sprites: %v", err))
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "text/vtt", []byte(vtt))
+}
+
+// GetKey serves an AES-128 content key. Players get the token from the key URI
+// in the signed playlist; keys are never cached.
+func (api *API) GetKey(c *gin.Context) {
+	key, err := api.VideoService.GetKey(c, c.Param("id"), c.Param("keyId"), c.Query("token"))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrTokenInvalid) || message == string(ErrTokenExpired) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) || message == string(ErrKeyNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Key not found: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error searching key: %v", err))
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/octet-stream", key)
+}
+
+func (api *API) CreatePlaybackToken(c *gin.Context) {
+	videoID := c.Param("id")
+
+	token, err := api.VideoService.CreatePlaybackToken(c, videoID, bearerToken(c))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrUnauthorized) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Playback not available: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating token: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
+
+// GetPlaylist serves playlists signed for the requesting viewer, so they must
+// not be cached by intermediaries.
+func (api *API) GetPlaylist(c *gin.Context) {
+	name, found := strings.CutSuffix(c.Param("playlist"), ".m3u8")
+	if !found {
+		c.String(http.StatusNotFound, "Playlist not found")
+		return
+	}
+
+	playlist, err := api.VideoService.GetPlaylist(c, c.Param("id"), name, c.Query("token"))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrTokenInvalid) || message == string(ErrTokenExpired) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) || message == string(ErrResolutionNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Playlist not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error generating playlist: %v", err))
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+}
+
+func (api *API) GetDownloadURL(c *gin.Context) {
+	videoID := c.Param("id")
+	resolution := c.Query("resolution")
+
+	url, err := api.VideoService.GetDownloadURL(c, videoID, resolution, bearerToken(c))
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrUnauthorized) {
+			c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrDownloadNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Download not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoNotReady) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video not ready: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error searching video: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url": url,
+	})
+}
+
+type reprocessRequest struct {
+	ProfileSet string `json:"profile_set"`
+}
+
+func (api *API) ReprocessVideo(c *gin.Context) {
+	videoID := c.Param("id")
+
+	var request reprocessRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	}
+
+	video, err := api.VideoService.ReprocessVideo(c, videoID, request.ProfileSet)
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrProfileSetNotFound) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Profile set not found: %v", err))
+			return
+		}
+
+		if message == string(ErrVideoProcessing) {
+			c.String(http.StatusConflict, fmt.Sprintf("Video processing: %v", err))
+			return
+		}
+
+		if message == string(ErrSourceNotArchived) {
+			c.String(http.StatusConflict, fmt.Sprintf("Source not archived: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error reprocessing video: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, video)
+}
+
+type clipRequest struct {
+	Start *float64 `json:"start"`
+	End   *float64 `json:"end"`
+}
+
+func (api *API) CreateClip(c *gin.Context) {
+	videoID := c.Param("id")
+
+	var request clipRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Start == nil || request.End == nil {
+		c.String(http.StatusBadRequest, "Invalid request: start and end are required")
+		return
+	}
+
+	video, err := api.VideoService.CreateClip(c, videoID, ClipRange{Start: *request.Start, End: *request.End})
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrClipInvalid) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Clip invalid: %v", err))
+			return
+		}
+
+		if message == string(ErrSourceNotArchived) {
+			c.String(http.StatusConflict, fmt.Sprintf("Source not archived: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating clip: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, video)
+}
+
+func (api *API) CreateConcat(c *gin.Context) {
+	var request ConcatRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	video, err := api.VideoService.CreateConcat(c, request)
+
+	if err != nil {
+		message := err.Error()
+
+		if message == string(ErrVideoNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("Video not found: %v", err))
+			return
+		}
+
+		if message == string(ErrConcatInvalid) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Concat invalid: %v", err))
+			return
+		}
+
+		if message == string(ErrSourceNotArchived) {
+			c.String(http.StatusConflict, fmt.Sprintf("Source not archived: %v", err))
+			return
+		}
+
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Error concatenating videos: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, video)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRouter(service *VideoService) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	api := NewAPI(*service)
+
+	router := gin.New()
+	router.POST("upload", api.HandleUpload)
+	router.GET("video/:id", api.GetVideo)
+	router.GET("video/:id/manifest", api.GetVideoURL)
+	router.GET("video/:id/dash", api.GetDashURL)
+	router.GET("video/:id/dash/manifest.mpd", api.GetDashManifest)
+	router.POST("video/:id/subtitles", api.UploadSubtitles)
+	router.GET("video/:id/sprites", api.GetSpritesURL)
+	router.GET("video/:id/sprites/sprites.vtt", api.GetSpriteVTT)
+	router.GET("video/:id/key/:keyId", api.GetKey)
+	router.GET("video/:id/playback", api.CreatePlaybackToken)
+	router.GET("video/:id/hls/:playlist", api.GetPlaylist)
+	router.GET("video/:id/download", api.GetDownloadURL)
+	router.POST("video/:id/reprocess", api.ReprocessVideo)
+	router.POST("video/:id/clips", api.CreateClip)
+	router.POST("video/concat", api.CreateConcat)
+
+	return router
+}
+
+func serve(router *gin.Engine, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHandleUploadMissingFile(t *testing.T) {
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase()))
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("name", "no video here")
+	writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	response := serve(router, request)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestGetVideoHandler(t *testing.T) {
+	video := readyVideo("video-1")
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase(video)))
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.Code, response.Body.String())
+	}
+
+	var got Video
+	if err := json.Unmarshal(response.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if got.ID != video.ID || got.Status != VideoStatusComplete || len(got.Resolutions) != 1 {
+		t.Fatalf("unexpected video: %+v", got)
+	}
+}
+
+func TestGetVideoHandlerNotFound(t *testing.T) {
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase()))
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/video/missing", nil))
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", response.Code)
+	}
+}
+
+func TestGetVideoHandlerDatabaseError(t *testing.T) {
+	db := NewMemoryDatabase(readyVideo("video-1"))
+	db.FailNth("GetVideo", 1, errors.New("database unavailable"))
+
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), db))
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", response.Code)
+	}
+}
+
+func TestGetVideoURLHandler(t *testing.T) {
+	pending := readyVideo("pending")
+	pending.Status = VideoStatusPending
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		path     string
+		expected int
+	}{
+		{"ready", testAPIKey, "/video/video-1/manifest?resolution=360p", http.StatusOK},
+		{"invalid resolution", testAPIKey, "/video/video-1/manifest?resolution=42p", http.StatusBadRequest},
+		{"missing resolution", testAPIKey, "/video/video-1/manifest?resolution=720p", http.StatusBadRequest},
+		{"master playlist", testAPIKey, "/video/video-1/manifest", http.StatusOK},
+		{"video not found", testAPIKey, "/video/missing/manifest?resolution=360p", http.StatusNotFound},
+		{"video not ready", testAPIKey, "/video/pending/manifest?resolution=360p", http.StatusConflict},
+		{"unauthorized", "wrong", "/video/video-1/manifest?resolution=360p", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDatabase(readyVideo("video-1"), pending)
+			router := newTestRouter(newTestService(NewMemoryFileStorage(), db))
+
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			request.Header.Set("Authorization", "Bearer "+test.apiKey)
+
+			response := serve(router, request)
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+
+			if test.expected != http.StatusOK {
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+
+			if body["url"] == "" {
+				t.Fatal("expected url in response")
+			}
+		})
+	}
+}
+
+func TestGetDashURLHandler(t *testing.T) {
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1"))))
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/dash", nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without an API key, got %d", response.Code)
+	}
+
+	for _, path := range []string{"/video/video-1/dash", "/video/missing/dash"} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+		if response := serve(router, request); response.Code != http.StatusNotFound {
+			t.Fatalf("expected 404 for %s, got %d", path, response.Code)
+		}
+	}
+
+	response = serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/dash/manifest.mpd?token=1.invalid", nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an invalid token, got %d", response.Code)
+	}
+}
+
+func TestUploadSubtitlesHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		expected int
+	}{
+		{"srt", "/video/video-1/subtitles", "1\n00:00:01,000 --> 00:00:02,000\nHi\n", http.StatusOK},
+		{"invalid", "/video/video-1/subtitles", "not subtitles", http.StatusBadRequest},
+		{"video not found", "/video/missing/subtitles", "WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1"))))
+
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			writer.WriteField("language", "pt")
+			part, _ := writer.CreateFormFile("subtitles", "captions.srt")
+			part.Write([]byte(test.content))
+			writer.Close()
+
+			request := httptest.NewRequest(http.MethodPost, test.path, &body)
+			request.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := serve(router, request)
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const defaultArchivePrefix = "originals"
+
+// ArchiveSettings selects where untouched uploads are kept for reprocessing:
+// one of the configured storages ("s3" or "google"), optionally in another
+// bucket, under prefix.
+type ArchiveSettings struct {
+	Enabled bool   `yaml:"enabled"`
+	Storage string `yaml:"storage"`
+	Bucket  string `yaml:"bucket"`
+	Prefix  string `yaml:"prefix"`
+}
+
+// newArchiveStorage returns the storage originals are archived to. Archived
+// objects are never signed, so the storage's URL signer is not applied.
+func newArchiveStorage(config Config, clients *Clients) (FileStorage, error) {
+	switch config.Archive.Storage {
+	case "s3":
+		if clients.AWS == nil {
+			return nil, fmt.Errorf("archive: s3 storage is not configured")
+		}
+
+		bucket := config.Archive.Bucket
+		if bucket == "" {
+			bucket = config.Storage.S3.Bucket
+		}
+
+		return NewS3FileStorage(clients.AWS, bucket, URLTTL(config.Storage.S3.URLTTL)), nil
+	case "google":
+		if clients.GCP == nil {
+			return nil, fmt.Errorf("archive: google storage is not configured")
+		}
+
+		bucket := config.Archive.Bucket
+		if bucket == "" {
+			bucket = config.Storage.Google.Bucket
+		}
+
+		return NewGCSFileStorage(clients.GCP, bucket, URLTTL(config.Storage.Google.URLTTL)), nil
+	default:
+		return nil, fmt.Errorf("archive: invalid storage %q", config.Archive.Storage)
+	}
+}
+
+// ArchivedSource is the original upload as stored in the archive.
+type ArchivedSource struct {
+	Path     string
+	Size     int64
+	Checksum string
+}
+
+func ArchiveName(prefix string, videoUUID string, inputFilePath string) string {
+	if prefix == "" {
+		prefix = defaultArchivePrefix
+	}
+
+	return path.Join(strings.Trim(prefix, "/"), videoUUID, "original"+strings.ToLower(filepath.Ext(inputFilePath)))
+}
+
+// archiveSource uploads the input file as received, before processing removes
+// it.
+func archiveSource(storage FileStorage, prefix string, videoID string, inputFilePath string) (*ArchivedSource, error) {
+	content, err := os.ReadFile(inputFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("archive reading error %s: %v", inputFilePath, err)
+	}
+
+	source := &ArchivedSource{
+		Path:     ArchiveName(prefix, videoID, inputFilePath),
+		Size:     int64(len(content)),
+		Checksum: Checksum(content),
+	}
+
+	if err := storage.Store(source.Path, content); err != nil {
+		return nil, fmt.Errorf("archive store error %s: %v", source.Path, err)
+	}
+
+	return source, nil
+}
+
+// restoreSource downloads an archived original into dir and checks it against
+// the checksum recorded when it was archived.
+func restoreSource(storage FileStorage, source ArchivedSource, dir string) (string, error) {
+	content, err := storage.Retrieve(source.Path)
+	if err != nil {
+		return "", fmt.Errorf("archive retrieve error %s: %v", source.Path, err)
+	}
+
+	if checksum := Checksum(content); checksum != source.Checksum {
+		return "", fmt.Errorf("archive checksum error %s: expected %s, got %s", source.Path, source.Checksum, checksum)
+	}
+
+	inputFilePath := filepath.Join(dir, path.Base(source.Path))
+	if err := os.WriteFile(inputFilePath, content, 0600); err != nil {
+		return "", fmt.Errorf("archive writing error %s: %v", inputFilePath, err)
+	}
+
+	return inputFilePath, nil
+}
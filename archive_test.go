@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newArchivingService(t *testing.T) (*VideoService, *MemoryFileStorage, *MemoryDatabase, Video) {
+	t.Helper()
+
+	db := NewMemoryDatabase()
+	archive := NewMemoryFileStorage()
+
+	service := newTestService(NewMemoryFileStorage(), db)
+	service.Archive = archive
+	service.ProfileSets = map[string][]EncodingProfile{
+		"mobile": {{Name: "240p", Resolution: "240p", Packaging: PackagingTS, Codec: CodecH264}},
+	}
+
+	video, err := service.CreateVideo(context.Background(), writeInput(t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return service, archive, db, waitForStatus(t, db, video.ID)
+}
+
+func TestCreateVideoArchivesSource(t *testing.T) {
+	_, archive, _, video := newArchivingService(t)
+
+	if video.Source == nil || video.Source.Path != "originals/"+video.ID+"/original.mp4" {
+		t.Fatalf("expected archived source, got %+v", video.Source)
+	}
+
+	content, ok := archive.Object(video.Source.Path)
+	if !ok || string(content) != "source" || video.Source.Checksum != Checksum(content) || video.Source.Size != 6 {
+		t.Fatalf("expected untouched original in the archive, got %q", content)
+	}
+}
+
+func TestReprocessVideo(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+	router := newTestRouter(service)
+
+	if _, err := service.AddSubtitles(context.Background(), video.ID, []byte("WEBVTT\n\n00:00.000 --> 00:01.000\nHello\n"), "en", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/video/"+video.ID+"/reprocess", strings.NewReader(`{"profile_set":"mobile"}`))
+	request.Header.Set("Content-Type", "application/json")
+
+	response := serve(router, request)
+	if response.Code != http.StatusAccepted || !strings.Contains(response.Body.String(), `"Status":"reprocessing"`) {
+		t.Fatalf("expected 202, got %d: %s", response.Code, response.Body.String())
+	}
+
+	reprocessed := waitForStatus(t, db, video.ID)
+	if reprocessed.Status != VideoStatusComplete || len(reprocessed.Resolutions) != 1 || reprocessed.Resolutions[0].Resolution != "240p" {
+		t.Fatalf("unexpected reprocessed video: %+v", reprocessed)
+	}
+
+	if len(reprocessed.Subtitles) != 1 || reprocessed.Subtitles[0].Source != SubtitleSourceUpload {
+		t.Fatalf("expected uploaded subtitles to be kept, got %+v", reprocessed.Subtitles)
+	}
+
+	if playlist := proxyPlaylist(t, service, video.ID, "240p"); !strings.Contains(playlist, "#EXTINF") {
+		t.Fatalf("expected the reprocessed resolution to be served, got:\n%s", playlist)
+	}
+}
+
+func TestReprocessVideoWritesNewGeneration(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+	storage := service.Storages[0].(*MemoryFileStorage)
+
+	served := video.Resolutions[0]
+	before, _ := storage.Object(served.Playlist)
+
+	if _, err := service.ReprocessVideo(context.Background(), video.ID, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reprocessed := waitForStatus(t, db, video.ID)
+	rendition := reprocessed.GetResolution(served.Resolution)
+	if rendition == nil || !strings.HasPrefix(rendition.Playlist, video.ID+"/") || path.Dir(rendition.Playlist) == path.Dir(served.Playlist) {
+		t.Fatalf("expected the rendition under a new generation prefix, got %+v", rendition)
+	}
+
+	for objectPath := range served.Checksums {
+		after, ok := storage.Object(objectPath)
+		if !ok || (objectPath == served.Playlist && string(after) != string(before)) {
+			t.Fatalf("expected %s of the served generation to be left untouched", objectPath)
+		}
+	}
+
+	playlist := proxyPlaylist(t, service, video.ID, served.Resolution)
+	if !strings.Contains(playlist, "https://memory.test/"+path.Dir(rendition.Playlist)+"/") {
+		t.Fatalf("expected segments signed under the new generation, got:\n%s", playlist)
+	}
+}
+
+func TestReprocessVideoChecksumMismatch(t *testing.T) {
+	service, archive, db, video := newArchivingService(t)
+
+	if err := archive.Store(video.Source.Path, []byte("corrupted")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := service.ReprocessVideo(context.Background(), video.ID, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reprocessed := waitForStatus(t, db, video.ID)
+	if reprocessed.Status != VideoStatusComplete || len(reprocessed.Resolutions) != len(video.Resolutions) {
+		t.Fatalf("expected previous renditions to be kept, got %+v", reprocessed)
+	}
+}
+
+func TestReprocessVideoHandlerErrors(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+
+	notArchived := readyVideo("video-2")
+	busy := readyVideo("video-3")
+	busy.Status = VideoStatusReprocessing
+	busy.Source = video.Source
+
+	for _, v := range []Video{notArchived, busy} {
+		if err := db.SaveVideo(context.Background(), v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	router := newTestRouter(service)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		expected int
+	}{
+		{"video not found", "/video/missing/reprocess", "", http.StatusNotFound},
+		{"unknown profile set", "/video/" + video.ID + "/reprocess", `{"profile_set":"4k"}`, http.StatusBadRequest},
+		{"invalid body", "/video/" + video.ID + "/reprocess", `{`, http.StatusBadRequest},
+		{"source not archived", "/video/video-2/reprocess", "", http.StatusConflict},
+		{"already reprocessing", "/video/video-3/reprocess", "", http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body)))
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestBackfillVideo(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+	service.ProfileSets["extended"] = []EncodingProfile{
+		{Name: "360p", Resolution: "360p", Packaging: PackagingTS, Codec: CodecH264},
+		{Name: "1440p", Resolution: "1440p", Packaging: PackagingTS, Codec: CodecH264},
+	}
+
+	transcoder := service.Transcoder.(*ScriptedTranscoder)
+	jobs := len(transcoder.Jobs)
+
+	added, err := service.BackfillVideo(context.Background(), video.ID, "extended")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(added) != 1 || added[0].Resolution != "1440p" || len(transcoder.Jobs) != jobs+1 || transcoder.Jobs[jobs].Resolution != "1440p" {
+		t.Fatalf("expected only 1440p to be transcoded, got %+v", added)
+	}
+
+	backfilled, _ := db.GetVideo(context.Background(), video.ID)
+	if len(backfilled.Resolutions) != len(video.Resolutions)+1 || backfilled.Images == nil {
+		t.Fatalf("expected 1440p appended, got %+v", backfilled)
+	}
+
+	added, err = service.BackfillVideo(context.Background(), video.ID, "extended")
+	if err != nil || len(added) != 0 || len(transcoder.Jobs) != jobs+1 {
+		t.Fatalf("expected nothing left to backfill, got %+v, %v", added, err)
+	}
+}
+
+func TestBackfillVideoConcurrentReprocess(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+	service.ProfileSets["extended"] = []EncodingProfile{{Name: "1440p", Resolution: "1440p", Packaging: PackagingTS, Codec: CodecH264}}
+
+	transcoder := service.Transcoder.(*ScriptedTranscoder)
+	transcoder.SetLatency(50 * time.Millisecond)
+
+	type result struct {
+		added []Resolution
+		err   error
+	}
+
+	backfill := func() chan result {
+		done := make(chan result, 1)
+		go func() {
+			added, err := service.BackfillVideo(context.Background(), video.ID, "extended")
+			done <- result{added, err}
+		}()
+
+		for {
+			current, _ := db.GetVideo(context.Background(), video.ID)
+			if current.Status == VideoStatusReprocessing {
+				return done
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	done := backfill()
+
+	if _, err := service.ReprocessVideo(context.Background(), video.ID, ""); err == nil || err.Error() != string(ErrVideoProcessing) {
+		t.Fatalf("expected reprocessing to wait for the backfill, got %v", err)
+	}
+
+	if _, err := service.BackfillVideo(context.Background(), video.ID, "extended"); err == nil || err.Error() != string(ErrVideoProcessing) {
+		t.Fatalf("expected a second backfill to be refused, got %v", err)
+	}
+
+	backfilled := <-done
+	if backfilled.err != nil || len(backfilled.added) != 1 {
+		t.Fatalf("expected 1440p backfilled, got %+v, %v", backfilled.added, backfilled.err)
+	}
+
+	current, _ := db.GetVideo(context.Background(), video.ID)
+	if current.Status != VideoStatusComplete || current.GetResolution("1440p") == nil {
+		t.Fatalf("expected the status restored with 1440p appended, got %+v", current)
+	}
+
+	if _, err := service.ReprocessVideo(context.Background(), video.ID, "mobile"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := service.BackfillVideo(context.Background(), video.ID, "extended"); err == nil || err.Error() != string(ErrVideoProcessing) {
+		t.Fatalf("expected the backfill to wait for reprocessing, got %v", err)
+	}
+
+	reprocessed := waitForStatus(t, db, video.ID)
+	if reprocessed.Status != VideoStatusComplete || len(reprocessed.Resolutions) != 1 || reprocessed.Resolutions[0].Resolution != "240p" {
+		t.Fatalf("expected only the reprocessed ladder, got %+v", reprocessed.Resolutions)
+	}
+
+	// A ladder switched to another generation behind the claim is left alone.
+	done = backfill()
+
+	if _, err := db.UpdateVideo(context.Background(), video.ID, func(current *Video) error {
+		switched := current.Resolutions[0]
+		switched.Playlist = path.Join(video.ID, "other", "playlist_240p.m3u8")
+		current.Resolutions = []Resolution{switched}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if superseded := <-done; superseded.err == nil || superseded.err.Error() != string(ErrVideoProcessing) {
+		t.Fatalf("expected %s, got %+v", ErrVideoProcessing, superseded)
+	}
+
+	current, _ = db.GetVideo(context.Background(), video.ID)
+	if current.Status != VideoStatusComplete || len(current.Resolutions) != 1 {
+		t.Fatalf("expected the status restored and nothing appended, got %+v", current)
+	}
+}
+
+func TestBackfillVideoErrors(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+
+	if err := db.SaveVideo(context.Background(), readyVideo("video-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.ProfileSets["cmaf"] = []EncodingProfile{{Name: "1440p", Resolution: "1440p", Packaging: PackagingCMAF, Codec: CodecH264}}
+
+	tests := []struct {
+		name       string
+		videoID    string
+		profileSet string
+		expected   VideoError
+	}{
+		{"unknown profile set", video.ID, "4k", ErrProfileSetNotFound},
+		{"source not archived", "video-2", "mobile", ErrSourceNotArchived},
+		{"video not found", "missing", "", ErrVideoNotFound},
+		{"packaging mismatch", video.ID, "cmaf", ErrPackagingMismatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := service.BackfillVideo(context.Background(), test.videoID, test.profileSet); err == nil || err.Error() != string(test.expected) {
+				t.Fatalf("expected %s, got %v", test.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/text/language"
+)
+
+const audioGroupID = "audio"
+
+// AudioTrack describes a source audio stream. Index counts audio streams only,
+// as used by ffmpeg's "0:a:<index>" stream specifier.
+type AudioTrack struct {
+	Index      int
+	Codec      string
+	Channels   int
+	SampleRate int
+	Language   string
+	Title      string
+	Default    bool
+	Loudness   *Loudness
+}
+
+// AudioRendition is a standalone AAC rendition of one source audio track,
+// shared by every video rendition through an HLS audio group. It is packaged
+// like the ladder; renditions stored without Packaging are CMAF.
+type AudioRendition struct {
+	Name             string
+	Language         string
+	Title            string
+	Default          bool
+	Channels         int
+	Packaging        Packaging
+	Playlist         string
+	InitSegment      string
+	Codecs           string
+	TotalSegments    int
+	Bandwidth        int
+	AverageBandwidth int
+	Checksums        map[string]string
+	KeyIDs           []string
+	KeyRotation      int
+}
+
+func AudioRenditionName(track AudioTrack) string {
+	return fmt.Sprintf("audio_%d", track.Index)
+}
+
+// mediaLanguage converts ffprobe language tags (ISO 639-2, e.g. "eng") to the
+// BCP 47 form expected by HLS and DASH ("en"). Undetermined tags are dropped.
+func mediaLanguage(tag string) string {
+	if tag == "" || tag == "und" {
+		return ""
+	}
+
+	lang, err := language.Parse(tag)
+	if err != nil {
+		return ""
+	}
+
+	return lang.String()
+}
+
+// audioBitrate gives AAC 64 kbps per channel, never less than stereo.
+func audioBitrate(channels int) int {
+	return max(channels, 2) * 64000
+}
+
+func audioTranscodeJob(request ProcessRequest, outputDir string, track AudioTrack, packaging Packaging) TranscodeJob {
+	name := AudioRenditionName(track)
+
+	job := TranscodeJob{
+		InputFilePath:    request.InputFilePath,
+		Resolution:       name,
+		Packaging:        packaging,
+		AudioOnly:        true,
+		AudioStream:      track.Index,
+		AudioEncoder:     "aac",
+		AudioBitrate:     audioBitrate(track.Channels),
+		Loudness:         loudnessCorrection(request.Loudness, track),
+		SegmentTime:      10,
+		SegmentPattern:   filepath.Join(outputDir, fmt.Sprintf("%s_%%03d.ts", name)),
+		PlaylistFilePath: filepath.Join(outputDir, filepath.Base(PlaylistName(request.VideoID, name))),
+	}
+
+	if packaging == PackagingCMAF {
+		job.SegmentPattern = filepath.Join(outputDir, fmt.Sprintf("%s_%%03d.m4s", name))
+		job.InitFileName = InitSegmentName(name)
+	}
+
+	return job
+}
+
+// rendition exposes the stored playlist as a Resolution so audio shares the
+// signing code of the video renditions.
+func (a AudioRendition) rendition() Resolution {
+	packaging := a.Packaging
+	if packaging == "" {
+		packaging = PackagingCMAF
+	}
+
+	return Resolution{
+		Resolution:       a.Name,
+		Playlist:         a.Playlist,
+		Packaging:        packaging,
+		InitSegment:      a.InitSegment,
+		Codecs:           a.Codecs,
+		TotalSegments:    a.TotalSegments,
+		Bandwidth:        a.Bandwidth,
+		AverageBandwidth: a.AverageBandwidth,
+		KeyIDs:           a.KeyIDs,
+		KeyRotation:      a.KeyRotation,
+	}
+}
+
+func (a AudioRendition) displayName(used map[string]bool) string {
+	return uniqueMediaName(a.Title, a.Language, "Audio", used)
+}
+
+// uniqueMediaName is the NAME players show in their language menus: the
+// title, else the language, else fallback. It must be unique within the
+// group, so renditions sharing a title or language are numbered.
+func uniqueMediaName(title string, language string, fallback string, used map[string]bool) string {
+	name := title
+	if name == "" {
+		name = language
+	}
+
+	if name == "" {
+		name = fallback
+	}
+
+	unique := name
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s %d", name, i)
+	}
+
+	used[unique] = true
+
+	return unique
+}
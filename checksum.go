@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+type ObjectVerification struct {
+	Storage  string
+	Path     string
+	Expected string
+	Actual   string
+	Error    string
+}
+
+func (o ObjectVerification) Valid() bool {
+	return o.Error == "" && o.Expected == o.Actual
+}
+
+type VerificationReport struct {
+	VideoID string
+	Objects []ObjectVerification
+}
+
+func (r *VerificationReport) Valid() bool {
+	for _, object := range r.Objects {
+		if !object.Valid() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *VerificationReport) Failures() []ObjectVerification {
+	failures := make([]ObjectVerification, 0)
+
+	for _, object := range r.Objects {
+		if !object.Valid() {
+			failures = append(failures, object)
+		}
+	}
+
+	return failures
+}
+
+func Checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func VerifyObjects(storage FileStorage, checksums map[string]string) []ObjectVerification {
+	paths := make([]string, 0, len(checksums))
+	for path := range checksums {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	objects := make([]ObjectVerification, 0, len(paths))
+	for _, path := range paths {
+		object := ObjectVerification{
+			Storage:  fmt.Sprintf("%T", storage),
+			Path:     path,
+			Expected: checksums[path],
+		}
+
+		content, err := storage.Retrieve(path)
+		if err != nil {
+			object.Error = fmt.Sprintf("retrieve error: %v", err)
+		} else {
+			object.Actual = Checksum(content)
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ClipRange is the part of the parent video a clip was cut from, in seconds.
+type ClipRange struct {
+	Start float64
+	End   float64
+}
+
+func (r ClipRange) Duration() float64 {
+	return r.End - r.Start
+}
+
+// TrimJob re-encodes the [Start, Start+Duration) range of the input with
+// every audio track into an intermediate Matroska file. Re-encoding makes the
+// cuts frame accurate; a stream copy could only cut on keyframes.
+type TrimJob struct {
+	InputFilePath  string
+	Start          float64
+	Duration       float64
+	VideoEncoder   string
+	AudioEncoder   string
+	OutputFilePath string
+}
+
+// ValidateClipRange checks that a clip is a non-empty range within the parent
+// video. Durations unknown to the prober are not enforced.
+func ValidateClipRange(clip ClipRange, duration float64) error {
+	if clip.Start < 0 || clip.End <= clip.Start {
+		return errors.New(string(ErrClipInvalid))
+	}
+
+	if duration > 0 && clip.End > duration {
+		return errors.New(string(ErrClipInvalid))
+	}
+
+	return nil
+}
+
+func ClipSourceName(outputDir string) string {
+	return filepath.Join(outputDir, "clip.mkv")
+}
+
+// trimSource cuts the clip out of the parent's original into outputDir.
+func trimSource(ctx context.Context, transcoder Transcoder, inputFilePath string, clip ClipRange, outputDir string) (string, error) {
+	registry, err := DetectEncoders(ctx, transcoder)
+	if err != nil {
+		return "", err
+	}
+
+	encoder, ok := registry.Encoder(CodecH264)
+	if !ok {
+		return "", errors.New("clip encoding error: no H.264 encoder available")
+	}
+
+	job := TrimJob{
+		InputFilePath:  inputFilePath,
+		Start:          clip.Start,
+		Duration:       clip.Duration(),
+		VideoEncoder:   encoder,
+		AudioEncoder:   "aac",
+		OutputFilePath: ClipSourceName(outputDir),
+	}
+
+	if err := transcoder.Trim(ctx, job); err != nil {
+		return "", fmt.Errorf("clip trimming error: %v", err)
+	}
+
+	return job.OutputFilePath, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postClip(t *testing.T, service *VideoService, videoID string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/video/"+videoID+"/clips", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	return serve(newTestRouter(service), request)
+}
+
+func TestCreateClip(t *testing.T) {
+	service, archive, db, parent := newArchivingService(t)
+
+	response := postClip(t, service, parent.ID, `{"start": 2.5, "end": 12.5}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", response.Code, response.Body.String())
+	}
+
+	var clip Video
+	if err := json.Unmarshal(response.Body.Bytes(), &clip); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if clip.ID == parent.ID || clip.ParentID != parent.ID || clip.Status != VideoStatusPending || clip.VideoMetadata.Duration != 10 {
+		t.Fatalf("unexpected clip: %+v", clip)
+	}
+
+	processed := waitForStatus(t, db, clip.ID)
+	if processed.Status != VideoStatusComplete || len(processed.Resolutions) != 4 || processed.VideoMetadata.Name != parent.VideoMetadata.Name {
+		t.Fatalf("unexpected processed clip: %+v", processed)
+	}
+
+	trims := service.Transcoder.(*ScriptedTranscoder).Trims
+	if len(trims) != 1 || trims[0].Start != 2.5 || trims[0].Duration != 10 || trims[0].VideoEncoder != "libx264" {
+		t.Fatalf("unexpected trim jobs %+v", trims)
+	}
+
+	if processed.Source == nil || !strings.HasSuffix(processed.Source.Path, processed.ID+"/original.mkv") {
+		t.Fatalf("expected the trimmed source to be archived, got %+v", processed.Source)
+	}
+
+	if _, ok := archive.Object(parent.Source.Path); !ok {
+		t.Fatal("expected the parent's original to be kept")
+	}
+}
+
+func TestCreateClipTrimFailure(t *testing.T) {
+	service, _, db, parent := newArchivingService(t)
+	service.Transcoder.(*ScriptedTranscoder).FailNth("Trim", 1, errors.New("decoder crashed"))
+
+	clip, err := service.CreateClip(context.Background(), parent.ID, ClipRange{Start: 0, End: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if processed := waitForStatus(t, db, clip.ID); processed.Status != VideoStatusError {
+		t.Fatalf("expected error status, got %s", processed.Status)
+	}
+}
+
+func TestCreateClipHandlerErrors(t *testing.T) {
+	service, _, db, parent := newArchivingService(t)
+
+	if err := db.SaveVideo(context.Background(), readyVideo("video-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		videoID  string
+		body     string
+		expected int
+	}{
+		{"missing end", parent.ID, `{"start": 1}`, http.StatusBadRequest},
+		{"end before start", parent.ID, `{"start": 5, "end": 5}`, http.StatusBadRequest},
+		{"negative start", parent.ID, `{"start": -1, "end": 5}`, http.StatusBadRequest},
+		{"past the end", parent.ID, `{"start": 15, "end": 25}`, http.StatusBadRequest},
+		{"source not archived", "video-2", `{"start": 0, "end": 5}`, http.StatusConflict},
+		{"video not found", "missing", `{"start": 0, "end": 5}`, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := postClip(t, service, test.videoID, test.body)
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestTrimJobArgs(t *testing.T) {
+	job := TrimJob{
+		InputFilePath:  "original.mp4",
+		Start:          2.5,
+		Duration:       30,
+		VideoEncoder:   "libx264",
+		AudioEncoder:   "aac",
+		OutputFilePath: "clip.mkv",
+	}
+
+	expected := []string{
+		"-y", "-v", "error",
+		"-ss", "2.500",
+		"-i", "original.mp4",
+		"-t", "30.000",
+		"-map", "0:v:0",
+		"-map", "0:a?",
+		"-c:v", "libx264",
+		"-crf", "16",
+		"-preset", "fast",
+		"-c:a", "aac",
+		"-b:a", "192k",
+		"-sn", "-dn",
+		"-f", "matroska",
+		"clip.mkv",
+	}
+
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxConcatParts     = 20
+	defaultConcatFPS   = 30
+	maxConcatFPS       = 60
+	concatSampleRate   = 48000
+	concatChannelSetup = "stereo"
+)
+
+// ConcatRequest lists the videos to join in order, with an optional
+// crossfade in seconds between consecutive parts.
+type ConcatRequest struct {
+	VideoIDs  []string `json:"videos"`
+	Crossfade float64  `json:"crossfade"`
+}
+
+// ConcatPart is one input of a ConcatJob. Parts without audio get silence so
+// every part has the same streams.
+type ConcatPart struct {
+	InputFilePath string
+	Duration      float64
+	HasAudio      bool
+}
+
+// ConcatJob joins the parts into an intermediate Matroska file after scaling
+// them to Width x Height (letterboxed to keep their aspect ratio), FrameRate
+// and 48 kHz stereo audio. Only the first video and audio stream of each part
+// is used.
+type ConcatJob struct {
+	Parts          []ConcatPart
+	Width          int
+	Height         int
+	FrameRate      float64
+	Crossfade      float64
+	VideoEncoder   string
+	AudioEncoder   string
+	OutputFilePath string
+}
+
+// ValidateConcatRequest checks the number of parts and that a crossfade is
+// shorter than every part it overlaps.
+func ValidateConcatRequest(request ConcatRequest, parts []Video) error {
+	if len(request.VideoIDs) < 2 || len(request.VideoIDs) > maxConcatParts || request.Crossfade < 0 {
+		return errors.New(string(ErrConcatInvalid))
+	}
+
+	if request.Crossfade == 0 {
+		return nil
+	}
+
+	for _, part := range parts {
+		if part.VideoMetadata.Duration <= request.Crossfade {
+			return errors.New(string(ErrConcatInvalid))
+		}
+	}
+
+	return nil
+}
+
+// concatOutput returns the size of the tallest part and the highest frame
+// rate of the parts, capped to 60 fps.
+func concatOutput(parts []Video) (int, int, float64) {
+	var width, height, frameRate float64
+
+	for _, part := range parts {
+		displayWidth, displayHeight := displaySize(part.VideoMetadata)
+		if displayHeight > height {
+			width, height = displayWidth, displayHeight
+		}
+
+		frameRate = math.Max(frameRate, part.VideoMetadata.FrameRate)
+	}
+
+	if frameRate <= 0 {
+		frameRate = defaultConcatFPS
+	}
+
+	return evenDimension(width), evenDimension(height), math.Min(frameRate, maxConcatFPS)
+}
+
+// ConcatDuration is the length of the joined video: crossfades overlap the
+// end of a part with the start of the next.
+func ConcatDuration(parts []Video, crossfade float64) float64 {
+	duration := 0.0
+	for _, part := range parts {
+		duration += part.VideoMetadata.Duration
+	}
+
+	return duration - crossfade*float64(len(parts)-1)
+}
+
+func ConcatSourceName(outputDir string) string {
+	return filepath.Join(outputDir, "concat.mkv")
+}
+
+// concatSources joins the restored originals of parts into outputDir.
+func concatSources(ctx context.Context, transcoder Transcoder, parts []Video, inputFilePaths []string, crossfade float64, outputDir string) (string, error) {
+	registry, err := DetectEncoders(ctx, transcoder)
+	if err != nil {
+		return "", err
+	}
+
+	encoder, ok := registry.Encoder(CodecH264)
+	if !ok {
+		return "", errors.New("concat encoding error: no H.264 encoder available")
+	}
+
+	width, height, frameRate := concatOutput(parts)
+
+	job := ConcatJob{
+		Width:          width,
+		Height:         height,
+		FrameRate:      frameRate,
+		Crossfade:      crossfade,
+		VideoEncoder:   encoder,
+		AudioEncoder:   "aac",
+		OutputFilePath: ConcatSourceName(outputDir),
+	}
+
+	for i, part := range parts {
+		job.Parts = append(job.Parts, ConcatPart{
+			InputFilePath: inputFilePaths[i],
+			Duration:      part.VideoMetadata.Duration,
+			HasAudio:      len(part.VideoMetadata.AudioTracks) > 0 || part.VideoMetadata.AudioCodec != "",
+		})
+	}
+
+	if err := transcoder.Concat(ctx, job); err != nil {
+		return "", fmt.Errorf("concat error: %v", err)
+	}
+
+	return job.OutputFilePath, nil
+}
+
+// filterGraph normalizes every part and joins them with the concat filter,
+// or with chained xfade/acrossfade filters when crossfading. Each xfade starts
+// Crossfade seconds before the end of the video joined so far.
+func (job ConcatJob) filterGraph() string {
+	filters := make([]string, 0, len(job.Parts)*2+2)
+
+	for i, part := range job.Parts {
+		filters = append(filters, fmt.Sprintf(
+			"[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p,settb=AVTB,setpts=PTS-STARTPTS[v%d]",
+			i, job.Width, job.Height, job.Width, job.Height, formatSeconds(job.FrameRate), i,
+		))
+
+		audioFormat := fmt.Sprintf("aresample=%d,aformat=sample_fmts=fltp:channel_layouts=%s", concatSampleRate, concatChannelSetup)
+		if part.HasAudio {
+			filters = append(filters, fmt.Sprintf("[%d:a:0]%s,asetpts=PTS-STARTPTS[a%d]", i, audioFormat, i))
+		} else {
+			filters = append(filters, fmt.Sprintf("anullsrc=r=%d:cl=%s,atrim=duration=%s,%s[a%d]", concatSampleRate, concatChannelSetup, formatSeconds(part.Duration), audioFormat, i))
+		}
+	}
+
+	if job.Crossfade <= 0 {
+		var inputs strings.Builder
+		for i := range job.Parts {
+			inputs.WriteString(fmt.Sprintf("[v%d][a%d]", i, i))
+		}
+
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=1[v][a]", inputs.String(), len(job.Parts)))
+
+		return strings.Join(filters, ";")
+	}
+
+	video, audio := "v0", "a0"
+	offset := 0.0
+
+	for i := 1; i < len(job.Parts); i++ {
+		offset += job.Parts[i-1].Duration - job.Crossfade
+
+		nextVideo, nextAudio := fmt.Sprintf("xv%d", i), fmt.Sprintf("xa%d", i)
+		if i == len(job.Parts)-1 {
+			nextVideo, nextAudio = "v", "a"
+		}
+
+		filters = append(filters,
+			fmt.Sprintf("[%s][v%d]xfade=transition=fade:duration=%s:offset=%s[%s]", video, i, formatSeconds(job.Crossfade), formatSeconds(offset), nextVideo),
+			fmt.Sprintf("[%s][a%d]acrossfade=d=%s[%s]", audio, i, formatSeconds(job.Crossfade), nextAudio),
+		)
+
+		video, audio = nextVideo, nextAudio
+	}
+
+	return strings.Join(filters, ";")
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
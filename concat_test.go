@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postConcat(t *testing.T, service *VideoService, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/video/concat", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	return serve(newTestRouter(service), request)
+}
+
+func TestCreateConcat(t *testing.T) {
+	service, _, db, intro := newArchivingService(t)
+
+	content, err := service.CreateVideo(context.Background(), writeInput(t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitForStatus(t, db, content.ID)
+
+	parts := []string{intro.ID, content.ID, intro.ID}
+	body, _ := json.Marshal(ConcatRequest{VideoIDs: parts, Crossfade: 1})
+
+	response := postConcat(t, service, string(body))
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", response.Code, response.Body.String())
+	}
+
+	var video Video
+	if err := json.Unmarshal(response.Body.Bytes(), &video); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if !reflect.DeepEqual(video.Parts, parts) || video.Crossfade != 1 || video.VideoMetadata.Duration != 58 {
+		t.Fatalf("unexpected concatenated video: %+v", video)
+	}
+
+	processed := waitForStatus(t, db, video.ID)
+	if processed.Status != VideoStatusComplete || len(processed.Resolutions) != 4 || processed.Source == nil {
+		t.Fatalf("unexpected processed video: %+v", processed)
+	}
+
+	jobs := service.Transcoder.(*ScriptedTranscoder).Concats
+	if len(jobs) != 1 || len(jobs[0].Parts) != 3 || jobs[0].Width != 1920 || jobs[0].Height != 1080 || jobs[0].FrameRate != 30 || jobs[0].Crossfade != 1 {
+		t.Fatalf("unexpected concat jobs %+v", jobs)
+	}
+
+	if jobs[0].Parts[0].InputFilePath == jobs[0].Parts[2].InputFilePath {
+		t.Fatal("expected every part to be restored to its own file")
+	}
+}
+
+func TestCreateConcatHandlerErrors(t *testing.T) {
+	service, _, db, video := newArchivingService(t)
+
+	if err := db.SaveVideo(context.Background(), readyVideo("video-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"invalid body", `{`, http.StatusBadRequest},
+		{"single part", `{"videos": ["` + video.ID + `"]}`, http.StatusBadRequest},
+		{"negative crossfade", `{"videos": ["` + video.ID + `", "` + video.ID + `"], "crossfade": -1}`, http.StatusBadRequest},
+		{"crossfade longer than a part", `{"videos": ["` + video.ID + `", "` + video.ID + `"], "crossfade": 20}`, http.StatusBadRequest},
+		{"source not archived", `{"videos": ["` + video.ID + `", "video-2"]}`, http.StatusConflict},
+		{"video not found", `{"videos": ["` + video.ID + `", "missing"]}`, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := postConcat(t, service, test.body)
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestConcatFilterGraph(t *testing.T) {
+	job := ConcatJob{
+		Parts: []ConcatPart{
+			{InputFilePath: "intro.mp4", Duration: 10, HasAudio: true},
+			{InputFilePath: "content.mp4", Duration: 5},
+		},
+		Width:     1280,
+		Height:    720,
+		FrameRate: 30,
+	}
+
+	expected := strings.Join([]string{
+		"[0:v:0]scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=30.000,format=yuv420p,settb=AVTB,setpts=PTS-STARTPTS[v0]",
+		"[0:a:0]aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo,asetpts=PTS-STARTPTS[a0]",
+		"[1:v:0]scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=30.000,format=yuv420p,settb=AVTB,setpts=PTS-STARTPTS[v1]",
+		"anullsrc=r=48000:cl=stereo,atrim=duration=5.000,aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo[a1]",
+		"[v0][a0][v1][a1]concat=n=2:v=1:a=1[v][a]",
+	}, ";")
+
+	if graph := job.filterGraph(); graph != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, graph)
+	}
+
+	job.Parts = append(job.Parts, ConcatPart{InputFilePath: "outro.mp4", Duration: 8, HasAudio: true})
+	job.Crossfade = 1
+	job.OutputFilePath = "concat.mkv"
+
+	graph := job.filterGraph()
+	for _, filter := range []string{
+		"[v0][v1]xfade=transition=fade:duration=1.000:offset=9.000[xv1]",
+		"[a0][a1]acrossfade=d=1.000[xa1]",
+		"[xv1][v2]xfade=transition=fade:duration=1.000:offset=13.000[v]",
+		"[xa1][a2]acrossfade=d=1.000[a]",
+	} {
+		if !strings.Contains(graph, filter) {
+			t.Fatalf("expected %s in:\n%s", filter, graph)
+		}
+	}
+
+	args := job.ffmpegArgs()
+	if !reflect.DeepEqual(args[:9], []string{"-y", "-v", "error", "-i", "intro.mp4", "-i", "content.mp4", "-i", "outro.mp4"}) || args[len(args)-1] != "concat.mkv" {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
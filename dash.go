@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const dashTimescale = 1000
+
+type mpd struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Namespace                 string      `xml:"xmlns,attr"`
+	Profiles                  string      `xml:"profiles,attr"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string      `xml:"minBufferTime,attr"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	Lang             string              `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	Roles            []mpdDescriptor     `xml:"Role"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	ID          string         `xml:"id,attr"`
+	Codecs      string         `xml:"codecs,attr,omitempty"`
+	Bandwidth   int            `xml:"bandwidth,attr"`
+	Width       int            `xml:"width,attr,omitempty"`
+	Height      int            `xml:"height,attr,omitempty"`
+	SegmentList mpdSegmentList `xml:"SegmentList"`
+}
+
+type mpdSegmentList struct {
+	Timescale       int                `xml:"timescale,attr"`
+	Initialization  mpdURL             `xml:"Initialization"`
+	SegmentTimeline mpdSegmentTimeline `xml:"SegmentTimeline"`
+	SegmentURLs     []mpdSegmentURL    `xml:"SegmentURL"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr,omitempty"`
+}
+
+type mpdSegmentTimeline struct {
+	Segments []mpdTimelineSegment `xml:"S"`
+}
+
+type mpdTimelineSegment struct {
+	Start    *int64 `xml:"t,attr,omitempty"`
+	Duration int64  `xml:"d,attr"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+}
+
+// dashByteRange formats a byte range as the inclusive "first-last" used by
+// DASH, or "" without one.
+func dashByteRange(byteRange *ByteRange) string {
+	if byteRange == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%d-%d", byteRange.Offset, byteRange.Offset+byteRange.Length-1)
+}
+
+// DashResolutions returns the renditions that can be referenced from an MPD.
+// Only clear CMAF renditions qualify: DASH players cannot play MPEG-TS
+// segments, nor HLS AES-128 encrypted ones.
+func DashResolutions(video Video) []Resolution {
+	resolutions := make([]Resolution, 0)
+
+	for _, resolution := range video.Resolutions {
+		if resolution.Packaging == PackagingCMAF && resolution.InitSegment != "" && len(resolution.KeyIDs) == 0 {
+			resolutions = append(resolutions, resolution)
+		}
+	}
+
+	return resolutions
+}
+
+// signedDashManifest builds a static MPD whose SegmentList entries point at
+// the same CMAF segments used by the HLS playlists, signed individually. Video
+// renditions are grouped in one adaptation set per codec family, and each
+// separate audio track gets its own adaptation set tagged with its language.
+func signedDashManifest(video Video, storage FileStorage) (string, error) {
+	resolutions := DashResolutions(video)
+	if len(resolutions) == 0 {
+		return "", errors.New(string(ErrDashNotAvailable))
+	}
+
+	// Players switch between the representations of an adaptation set, so
+	// each codec family gets its own and the player picks the one it decodes.
+	adaptationSets := make([]mpdAdaptationSet, 0)
+	byCodec := make(map[CodecFamily]int)
+
+	duration := video.VideoMetadata.Duration
+
+	for _, resolution := range resolutions {
+		representation, total, err := dashRepresentation(video.ID, resolution, storage)
+		if err != nil {
+			return "", err
+		}
+
+		representation.Width = resolution.Width
+		representation.Height = resolution.Height
+
+		if duration == 0 {
+			duration = float64(total) / dashTimescale
+		}
+
+		codec := resolution.Codec
+		if codec == "" {
+			codec = CodecH264
+		}
+
+		index, ok := byCodec[codec]
+		if !ok {
+			index = len(adaptationSets)
+			byCodec[codec] = index
+
+			adaptationSets = append(adaptationSets, mpdAdaptationSet{
+				ID:               index,
+				ContentType:      "video",
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+			})
+		}
+
+		adaptationSets[index].Representations = append(adaptationSets[index].Representations, representation)
+	}
+
+	audioRenditions := make([]AudioRendition, 0, len(video.AudioRenditions))
+	audioFlags := make([]bool, 0, len(video.AudioRenditions))
+
+	for _, audio := range video.AudioRenditions {
+		if audio.rendition().Packaging == PackagingCMAF && len(audio.KeyIDs) == 0 {
+			audioRenditions = append(audioRenditions, audio)
+			audioFlags = append(audioFlags, audio.Default)
+		}
+	}
+
+	audioDefault := defaultIndex(audioFlags)
+
+	for i, audio := range audioRenditions {
+		representation, _, err := dashRepresentation(video.ID, audio.rendition(), storage)
+		if err != nil {
+			return "", err
+		}
+
+		audioSet := mpdAdaptationSet{
+			ID:               len(adaptationSets),
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			Lang:             audio.Language,
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representations:  []mpdRepresentation{representation},
+		}
+
+		if i == audioDefault {
+			audioSet.Roles = []mpdDescriptor{{SchemeIDURI: "urn:mpeg:dash:role:2011", Value: "main"}}
+		}
+
+		adaptationSets = append(adaptationSets, audioSet)
+	}
+
+	document := mpd{
+		Namespace:                 "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-main:2011",
+		Type:                      "static",
+		MediaPresentationDuration: dashDuration(duration),
+		MinBufferTime:             "PT2S",
+		Periods: []mpdPeriod{
+			{
+				ID:             "0",
+				Start:          "PT0S",
+				AdaptationSets: adaptationSets,
+			},
+		},
+	}
+
+	output, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return xml.Header + string(output) + "\n", nil
+}
+
+// dashRepresentation lists the signed segments of a stored CMAF playlist and
+// returns their total duration in timescale units. Single-file renditions are
+// signed once and addressed with byte ranges.
+func dashRepresentation(videoID string, resolution Resolution, storage FileStorage) (mpdRepresentation, int64, error) {
+	playlist, err := loadMediaPlaylist(storage, resolution)
+	if err != nil {
+		return mpdRepresentation{}, 0, err
+	}
+
+	signed := make(map[string]string)
+	sign := func(filePath string) (string, error) {
+		if url, ok := signed[filePath]; ok {
+			return url, nil
+		}
+
+		url, err := storage.SignedURL(filePath, segmentURLTTL(storage))
+		if err != nil {
+			return "", err
+		}
+
+		signed[filePath] = url
+		return url, nil
+	}
+
+	initURL, err := sign(resolution.InitSegment)
+	if err != nil {
+		return mpdRepresentation{}, 0, err
+	}
+
+	representation := mpdRepresentation{
+		ID:        resolution.Resolution,
+		Codecs:    resolution.Codecs,
+		Bandwidth: resolution.Bandwidth,
+		SegmentList: mpdSegmentList{
+			Timescale:      dashTimescale,
+			Initialization: mpdURL{SourceURL: initURL, Range: dashByteRange(playlist.MapByteRange)},
+		},
+	}
+
+	var start, total int64
+	for i, segment := range playlist.Segments {
+		segmentURL, err := sign(fmt.Sprintf("%s/%s", segmentPrefix(videoID, resolution), segment.URI))
+		if err != nil {
+			return mpdRepresentation{}, 0, err
+		}
+
+		timelineSegment := mpdTimelineSegment{
+			Duration: int64(math.Round(segment.Duration * dashTimescale)),
+		}
+
+		if i == 0 {
+			timelineSegment.Start = &start
+		}
+
+		total += timelineSegment.Duration
+
+		representation.SegmentList.SegmentTimeline.Segments = append(representation.SegmentList.SegmentTimeline.Segments, timelineSegment)
+		representation.SegmentList.SegmentURLs = append(representation.SegmentList.SegmentURLs, mpdSegmentURL{
+			Media:      segmentURL,
+			MediaRange: dashByteRange(segment.ByteRange),
+		})
+	}
+
+	return representation, total, nil
+}
+
+func dashDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
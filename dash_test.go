@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func cmafVideo(t *testing.T, storage *MemoryFileStorage) Video {
+	t.Helper()
+
+	playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:10\n#EXT-X-MAP:URI=\"init_720p.mp4\"\n#EXTINF:10.010000,\nvideo_720p_000.m4s\n#EXTINF:5.000000,\nvideo_720p_001.m4s\n#EXT-X-ENDLIST\n"
+	if err := storage.Store("video-1/playlist_720p.m3u8", []byte(playlist)); err != nil {
+		t.Fatal(err)
+	}
+
+	video := readyVideo("video-1")
+	video.VideoMetadata.Duration = 15.01
+	video.Resolutions = append(video.Resolutions, Resolution{
+		Resolution:    "720p",
+		Width:         1280,
+		Height:        720,
+		TotalSegments: 2,
+		Playlist:      "video-1/playlist_720p.m3u8",
+		Packaging:     PackagingCMAF,
+		InitSegment:   "video-1/init_720p.mp4",
+		Codecs:        "avc1.64001f,mp4a.40.2",
+		Bandwidth:     2500000,
+	})
+
+	return video
+}
+
+func TestSignedDashManifest(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	video := cmafVideo(t, storage)
+
+	manifest, err := signedDashManifest(video, storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var document mpd
+	if err := xml.Unmarshal([]byte(manifest), &document); err != nil {
+		t.Fatalf("invalid MPD: %v\n%s", err, manifest)
+	}
+
+	if document.Type != "static" || document.MediaPresentationDuration != "PT15.010S" {
+		t.Fatalf("unexpected MPD attributes: %+v", document)
+	}
+
+	representations := document.Periods[0].AdaptationSets[0].Representations
+	if len(representations) != 1 {
+		t.Fatalf("expected only the CMAF rendition, got %d", len(representations))
+	}
+
+	representation := representations[0]
+	if representation.ID != "720p" || representation.Codecs != "avc1.64001f,mp4a.40.2" || representation.Bandwidth != 2500000 || representation.Width != 1280 {
+		t.Fatalf("unexpected representation: %+v", representation)
+	}
+
+	segmentList := representation.SegmentList
+	if !strings.HasPrefix(segmentList.Initialization.SourceURL, "https://memory.test/video-1/init_720p.mp4") {
+		t.Fatalf("unexpected initialization: %s", segmentList.Initialization.SourceURL)
+	}
+
+	if len(segmentList.SegmentURLs) != 2 || !strings.HasPrefix(segmentList.SegmentURLs[1].Media, "https://memory.test/video-1/video_720p_001.m4s") {
+		t.Fatalf("unexpected segment URLs: %+v", segmentList.SegmentURLs)
+	}
+
+	timeline := segmentList.SegmentTimeline.Segments
+	if len(timeline) != 2 || timeline[0].Duration != 10010 || timeline[1].Duration != 5000 || *timeline[0].Start != 0 || timeline[1].Start != nil {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+}
+
+func TestSignedDashManifestCodecAdaptationSets(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	video := cmafVideo(t, storage)
+
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MAP:URI=\"init_1080p_hevc.mp4\"\n#EXTINF:10.000000,\nvideo_1080p_hevc_000.m4s\n#EXT-X-ENDLIST\n"
+	if err := storage.Store("video-1/playlist_1080p_hevc.m3u8", []byte(playlist)); err != nil {
+		t.Fatal(err)
+	}
+
+	hevc := video.Resolutions[len(video.Resolutions)-1]
+	hevc.Resolution = "1080p_hevc"
+	hevc.Playlist = "video-1/playlist_1080p_hevc.m3u8"
+	hevc.InitSegment = "video-1/init_1080p_hevc.mp4"
+	hevc.Codec = CodecHEVC
+	hevc.Codecs = "hvc1.1.6.L120.90"
+	video.Resolutions = append(video.Resolutions, hevc)
+
+	manifest, err := signedDashManifest(video, storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var document mpd
+	if err := xml.Unmarshal([]byte(manifest), &document); err != nil {
+		t.Fatalf("invalid MPD: %v\n%s", err, manifest)
+	}
+
+	adaptationSets := document.Periods[0].AdaptationSets
+	if len(adaptationSets) != 2 || adaptationSets[0].ID == adaptationSets[1].ID {
+		t.Fatalf("expected one adaptation set per codec, got %+v", adaptationSets)
+	}
+
+	if adaptationSets[0].Representations[0].ID != "720p" || len(adaptationSets[1].Representations) != 1 || adaptationSets[1].Representations[0].ID != "1080p_hevc" {
+		t.Fatalf("unexpected grouping: %+v", adaptationSets)
+	}
+}
+
+func TestGetDashURL(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	video := cmafVideo(t, storage)
+	stored := len(storage.Paths())
+
+	db := NewMemoryDatabase(video)
+	service := newTestService(storage, db)
+
+	if _, err := service.GetDashURL(context.Background(), video.ID, "wrong"); err == nil || err.Error() != string(ErrUnauthorized) {
+		t.Fatalf("expected %s, got %v", ErrUnauthorized, err)
+	}
+
+	dashURL, err := service.GetDashURL(context.Background(), video.ID, testAPIKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prefix := "https://api.example.com/video/video-1/dash/manifest.mpd?token="
+	if !strings.HasPrefix(dashURL, prefix) {
+		t.Fatalf("expected proxy URL %s..., got %s", prefix, dashURL)
+	}
+
+	token, _ := url.QueryUnescape(strings.TrimPrefix(dashURL, prefix))
+
+	manifest, err := service.GetDashManifest(context.Background(), video.ID, token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(manifest, "https://memory.test/video-1/video_720p_000.m4s?signature=") {
+		t.Fatalf("expected segments signed for the request:\n%s", manifest)
+	}
+
+	if len(storage.Paths()) != stored || db.Calls("SaveVideo") != 0 || db.Calls("UpdateVideo") != 0 {
+		t.Fatalf("expected nothing written, got %v", storage.Paths())
+	}
+
+	if _, err := service.GetDashManifest(context.Background(), video.ID, "1.invalid"); err == nil || err.Error() != string(ErrTokenInvalid) {
+		t.Fatalf("expected %s, got %v", ErrTokenInvalid, err)
+	}
+}
+
+func TestGetDashURLWithoutCMAF(t *testing.T) {
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1")))
+
+	_, err := service.GetDashURL(context.Background(), "video-1", testAPIKey)
+	if err == nil || err.Error() != string(ErrDashNotAvailable) {
+		t.Fatalf("expected %s, got %v", ErrDashNotAvailable, err)
+	}
+}
+
+func TestSignedDashManifestAudioAdaptationSets(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	video := cmafVideo(t, storage)
+
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MAP:URI=\"init_audio_0.mp4\"\n#EXTINF:10.000000,\naudio_0_000.m4s\n#EXT-X-ENDLIST\n"
+	if err := storage.Store("video-1/playlist_audio_0.m3u8", []byte(playlist)); err != nil {
+		t.Fatal(err)
+	}
+
+	video.AudioRenditions = []AudioRendition{{
+		Name:        "audio_0",
+		Language:    "pt",
+		Default:     true,
+		Playlist:    "video-1/playlist_audio_0.m3u8",
+		InitSegment: "video-1/init_audio_0.mp4",
+		Codecs:      "mp4a.40.2",
+		Bandwidth:   130000,
+	}}
+
+	manifest, err := signedDashManifest(video, storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var document mpd
+	if err := xml.Unmarshal([]byte(manifest), &document); err != nil {
+		t.Fatalf("invalid MPD: %v\n%s", err, manifest)
+	}
+
+	adaptationSets := document.Periods[0].AdaptationSets
+	if len(adaptationSets) != 2 {
+		t.Fatalf("expected video and audio adaptation sets, got %d", len(adaptationSets))
+	}
+
+	audio := adaptationSets[1]
+	if audio.ContentType != "audio" || audio.Lang != "pt" || len(audio.Roles) != 1 || audio.Roles[0].Value != "main" {
+		t.Fatalf("unexpected audio adaptation set: %+v", audio)
+	}
+
+	if representation := audio.Representations[0]; representation.Codecs != "mp4a.40.2" || len(representation.SegmentList.SegmentURLs) != 1 {
+		t.Fatalf("unexpected audio representation: %+v", representation)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 
 	"github.com/boltdb/bolt"
@@ -18,7 +19,10 @@ type Page struct {
 type Database interface {
 	SaveVideo(ctx context.Context, video Video) error
 	GetVideo(ctx context.Context, videoID string) (Video, error)
+	UpdateVideo(ctx context.Context, videoID string, update func(video *Video) error) (Video, error)
 	GetVideos(ctx context.Context, page int, size int) (Page, error)
+	SaveKeys(ctx context.Context, videoID string, keys []EncryptionKey) error
+	GetKey(ctx context.Context, videoID string, keyID string) (EncryptionKey, error)
 }
 
 func NewBoltDB(databasePath string) *BoltDB {
@@ -80,16 +84,66 @@ func (b *BoltDB) GetVideo(ctx context.Context, videoID string) (Video, error) {
 		bucket := tx.Bucket([]byte("videos"))
 
 		if bucket == nil {
-			return nil
+			return errors.New(string(ErrVideoNotFound))
 		}
 
 		data := bucket.Get([]byte(videoID))
+		if data == nil {
+			return errors.New(string(ErrVideoNotFound))
+		}
+
 		return json.Unmarshal(data, &video)
 	})
 
 	return video, err
 }
 
+// UpdateVideo applies update to the stored video and saves it in the same
+// transaction, so concurrent writers cannot drop each other's changes. Nothing
+// is saved when update returns an error.
+func (b *BoltDB) UpdateVideo(ctx context.Context, videoID string, update func(video *Video) error) (Video, error) {
+	db, err := bolt.Open(b.DatabasePath, 0600, nil)
+
+	if err != nil {
+		log.Fatal(err)
+		return Video{}, err
+	}
+
+	defer db.Close()
+
+	var video Video
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("videos"))
+
+		if bucket == nil {
+			return errors.New(string(ErrVideoNotFound))
+		}
+
+		data := bucket.Get([]byte(videoID))
+		if data == nil {
+			return errors.New(string(ErrVideoNotFound))
+		}
+
+		if err := json.Unmarshal(data, &video); err != nil {
+			return err
+		}
+
+		if err := update(&video); err != nil {
+			return err
+		}
+
+		json, err := json.Marshal(video)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(videoID), json)
+	})
+
+	return video, err
+}
+
 func (b *BoltDB) GetVideos(ctx context.Context, page int, size int) (Page, error) {
 	db, err := bolt.Open(b.DatabasePath, 0600, nil)
 
@@ -144,3 +198,68 @@ func (b *BoltDB) GetVideos(ctx context.Context, page int, size int) (Page, error
 		Items:       videos[start:end],
 	}, err
 }
+
+func keyPath(videoID string, keyID string) []byte {
+	return []byte(videoID + "/" + keyID)
+}
+
+func (b *BoltDB) SaveKeys(ctx context.Context, videoID string, keys []EncryptionKey) error {
+	db, err := bolt.Open(b.DatabasePath, 0600, nil)
+
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("keys"))
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			json, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+
+			if err := bucket.Put(keyPath(videoID, key.ID), json); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *BoltDB) GetKey(ctx context.Context, videoID string, keyID string) (EncryptionKey, error) {
+	db, err := bolt.Open(b.DatabasePath, 0600, nil)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var key EncryptionKey
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("keys"))
+
+		if bucket == nil {
+			return errors.New(string(ErrKeyNotFound))
+		}
+
+		data := bucket.Get(keyPath(videoID, keyID))
+		if data == nil {
+			return errors.New(string(ErrKeyNotFound))
+		}
+
+		return json.Unmarshal(data, &key)
+	})
+
+	return key, err
+}
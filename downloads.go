@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type DownloadSettings struct {
+	Enabled     bool     `yaml:"enabled"`
+	Resolutions []string `yaml:"resolutions"`
+}
+
+// Download is a single progressive MP4 (H.264/AAC, moov atom first) for
+// clients that cannot play HLS.
+type Download struct {
+	Resolution string
+	Width      int
+	Height     int
+	Encoder    string
+	Size       int64
+	Path       string
+	Checksum   string
+	// Filename is the attachment name stored as the Content-Disposition of
+	// the object, empty for downloads stored without one.
+	Filename string
+}
+
+// DownloadJob encodes the first video stream, branded with Overlay when set,
+// and the default audio track, if the source has one, into one MP4 file.
+type DownloadJob struct {
+	InputFilePath  string
+	Width          int
+	Height         int
+	VideoEncoder   string
+	AudioEncoder   string
+	AudioStream    int
+	Overlay        *OverlayProfile
+	Loudness       *LoudnessCorrection
+	OutputFilePath string
+}
+
+// AttachmentSigner is implemented by signers that can make the bucket serve
+// an object as a download with the given file name.
+type AttachmentSigner interface {
+	SignedAttachmentURL(filePath string, ttl time.Duration, filename string) (string, error)
+}
+
+// AttachmentStorer is implemented by storages that can store an object with
+// the Content-Disposition it is served with, so URLs that cannot override
+// response headers, such as CDN ones, still download it under filename.
+type AttachmentStorer interface {
+	StoreAttachment(filePath string, fileContent []byte, filename string) error
+}
+
+// NormalizeDownloadSettings defaults to a single 720p download and rejects
+// unknown resolutions.
+func NormalizeDownloadSettings(settings DownloadSettings) (DownloadSettings, error) {
+	if len(settings.Resolutions) == 0 {
+		settings.Resolutions = []string{"720p"}
+	}
+
+	for _, resolution := range settings.Resolutions {
+		if ResolutionHeight(resolution) <= 0 {
+			return settings, fmt.Errorf("downloads: invalid resolution %q", resolution)
+		}
+	}
+
+	return settings, nil
+}
+
+func DownloadName(videoUUID string, resolution string) string {
+	return fmt.Sprintf("%s/download_%s.mp4", videoUUID, resolution)
+}
+
+// DownloadFilename is the name offered to the user: the uploaded file name
+// with an .mp4 extension.
+func DownloadFilename(video Video) string {
+	name := strings.TrimSuffix(filepath.Base(video.VideoMetadata.Name), filepath.Ext(video.VideoMetadata.Name))
+	if name == "" || name == "." || name == "/" {
+		name = video.ID
+	}
+
+	return name + ".mp4"
+}
+
+// ContentDisposition formats an attachment header, falling back to the
+// RFC 2231 encoding for names that are not plain ASCII.
+func ContentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+func generateDownloads(ctx context.Context, transcoder Transcoder, registry *EncoderRegistry, request ProcessRequest, storages []FileStorage, outputDir string) ([]Download, error) {
+	encoder, ok := registry.Encoder(CodecH264)
+	if !ok {
+		return nil, errors.New("download encoding error: no H.264 encoder available")
+	}
+
+	audioStream := defaultAudioStream(request.Metadata)
+	downloads := make([]Download, 0, len(request.Downloads.Resolutions))
+
+	for _, resolution := range request.Downloads.Resolutions {
+		width, height := RenditionSize(request.Metadata, ResolutionHeight(resolution))
+
+		download := Download{
+			Resolution: resolution,
+			Width:      width,
+			Height:     height,
+			Encoder:    encoder,
+			Path:       DownloadName(request.StoragePrefix(), resolution),
+		}
+
+		job := DownloadJob{
+			InputFilePath:  request.InputFilePath,
+			Width:          width,
+			Height:         height,
+			VideoEncoder:   encoder,
+			AudioEncoder:   "aac",
+			AudioStream:    audioStream,
+			Overlay:        request.Overlay,
+			Loudness:       defaultLoudnessCorrection(request),
+			OutputFilePath: filepath.Join(outputDir, filepath.Base(download.Path)),
+		}
+
+		if err := transcoder.EncodeDownload(ctx, job); err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(job.OutputFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("download reading error %s: %v", job.OutputFilePath, err)
+		}
+
+		filename := DownloadFilename(Video{ID: request.VideoID, VideoMetadata: request.Metadata})
+
+		attached, err := storeDownload(storages, download.Path, data, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if attached {
+			download.Filename = filename
+		}
+
+		download.Size = int64(len(data))
+		download.Checksum = Checksum(data)
+		downloads = append(downloads, download)
+	}
+
+	return downloads, nil
+}
+
+// storeDownload stores the MP4 with its Content-Disposition in the storages
+// supporting it, and reports whether all of them did.
+func storeDownload(storages []FileStorage, filePath string, content []byte, filename string) (bool, error) {
+	attached := true
+
+	for _, storage := range storages {
+		storer, ok := storage.(AttachmentStorer)
+		if !ok {
+			attached = false
+			if err := storage.Store(filePath, content); err != nil {
+				return false, fmt.Errorf("buffer store error %s: %v", filePath, err)
+			}
+
+			continue
+		}
+
+		if err := storer.StoreAttachment(filePath, content, filename); err != nil {
+			return false, fmt.Errorf("buffer store error %s: %v", filePath, err)
+		}
+	}
+
+	return attached, nil
+}
+
+// defaultAudioStream returns the audio-relative index of the default track,
+// or of the first one.
+func defaultAudioStream(metadata VideoMetadata) int {
+	for _, track := range metadata.AudioTracks {
+		if track.Default {
+			return track.Index
+		}
+	}
+
+	return 0
+}
+
+// defaultLoudnessCorrection returns the correction of the default audio
+// track, if it was measured.
+func defaultLoudnessCorrection(request ProcessRequest) *LoudnessCorrection {
+	for _, track := range request.Metadata.AudioTracks {
+		if track.Index == defaultAudioStream(request.Metadata) {
+			return loudnessCorrection(request.Loudness, track)
+		}
+	}
+
+	return nil
+}
+
+// GetDownload returns the download in the given resolution, or the largest
+// one when resolution is empty.
+func (v *Video) GetDownload(resolution string) *Download {
+	var selected *Download
+
+	for i, download := range v.Downloads {
+		if resolution != "" && download.Resolution == resolution {
+			return &v.Downloads[i]
+		}
+
+		if resolution == "" && (selected == nil || ResolutionHeight(download.Resolution) > ResolutionHeight(selected.Resolution)) {
+			selected = &v.Downloads[i]
+		}
+	}
+
+	return selected
+}
+
+// SignedDownloadURL signs the MP4 so browsers save it under the video's name.
+// Objects stored with that name as their Content-Disposition get a plain
+// signed URL; others need a signer overriding the response header, and no
+// URL is returned when the storage has none.
+func SignedDownloadURL(storage FileStorage, video Video, download Download) (string, error) {
+	filename := DownloadFilename(video)
+	if download.Filename == filename {
+		return storage.SignedURL(download.Path, storage.URLTTL())
+	}
+
+	if signer, ok := storage.(AttachmentSigner); ok {
+		return signer.SignedAttachmentURL(download.Path, storage.URLTTL(), filename)
+	}
+
+	return "", fmt.Errorf("download signing error %s: storage cannot set Content-Disposition", download.Path)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessVideoDownloads(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	storage := NewMemoryFileStorage()
+
+	metadata := landscape
+	metadata.Name = "holiday.mov"
+	metadata.AudioTracks = []AudioTrack{{Index: 0, Language: "por"}, {Index: 1, Language: "eng", Default: true}}
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Downloads:     DownloadSettings{Enabled: true, Resolutions: []string{"360p", "720p"}},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(response.Downloads) != 2 || len(transcoder.Downloads) != 2 {
+		t.Fatalf("expected 2 downloads, got %+v", response.Downloads)
+	}
+
+	job := transcoder.Downloads[1]
+	if job.Width != 1280 || job.Height != 720 || job.VideoEncoder != "libx264" || job.AudioStream != 1 {
+		t.Fatalf("unexpected download job %+v", job)
+	}
+
+	download := response.Downloads[1]
+	content, ok := storage.Object("video-1/download_720p.mp4")
+	if !ok || download.Path != "video-1/download_720p.mp4" || download.Size != int64(len(content)) || download.Checksum != Checksum(content) {
+		t.Fatalf("unexpected stored download %+v", download)
+	}
+
+	if download.Filename != "holiday.mp4" || storage.Disposition(download.Path) != `attachment; filename=holiday.mp4` {
+		t.Fatalf("expected the object stored with its Content-Disposition, got %+v", download)
+	}
+}
+
+func TestSignedDownloadURLWithCDN(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cdn, _ := NewCloudFrontSigner(URLSignerSettings{Domain: "d111.cloudfront.net", KeyPairID: "K"}, key)
+
+	bucket := NewMemoryFileStorage()
+	storage := WithURLSigner(bucket, cdn)
+
+	video := readyVideo("video-1")
+	video.VideoMetadata.Name = "holiday.mov"
+
+	download := Download{Resolution: "720p", Path: DownloadName("video-1", "720p")}
+
+	attached, err := storeDownload([]FileStorage{storage}, download.Path, []byte("mp4"), DownloadFilename(video))
+	if err != nil || !attached || bucket.Disposition(download.Path) != ContentDisposition("holiday.mp4") {
+		t.Fatalf("expected the Content-Disposition stored in the bucket, got %v, %q", err, bucket.Disposition(download.Path))
+	}
+
+	if _, err := SignedDownloadURL(storage, video, download); err == nil {
+		t.Fatal("expected an error for a download stored without its Content-Disposition")
+	}
+
+	download.Filename = "holiday.mp4"
+
+	signed, err := SignedDownloadURL(storage, video, download)
+	if err != nil || !strings.HasPrefix(signed, "https://d111.cloudfront.net/video-1/download_720p.mp4?") {
+		t.Fatalf("expected a CDN URL for the attachment, got %s, %v", signed, err)
+	}
+}
+
+func TestProcessVideoDownloadFailureKeepsVideo(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.FailNth("EncodeDownload", 1, errors.New("encoder crashed"))
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      landscape,
+		Downloads:     DownloadSettings{Enabled: true},
+	}, []FileStorage{NewMemoryFileStorage()})
+	if err != nil {
+		t.Fatalf("expected download failure not to fail processing, got %v", err)
+	}
+
+	if len(response.Downloads) != 0 || len(response.Resolutions) == 0 {
+		t.Fatalf("expected renditions without downloads, got %+v", response)
+	}
+}
+
+func TestDownloadJobArgs(t *testing.T) {
+	job := DownloadJob{
+		InputFilePath:  "in.mp4",
+		Width:          1280,
+		Height:         720,
+		VideoEncoder:   "libx264",
+		AudioEncoder:   "aac",
+		AudioStream:    1,
+		OutputFilePath: "out.mp4",
+	}
+
+	expected := []string{
+		"-y", "-v", "error",
+		"-i", "in.mp4",
+		"-map", "0:v:0",
+		"-map", "0:a:1?",
+		"-vf", "scale=1280:720,setsar=1",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"out.mp4",
+	}
+
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+}
+
+func TestGetDownloadURLHandler(t *testing.T) {
+	video := readyVideo("video-1")
+	video.VideoMetadata.Name = "férias 2024.mov"
+	video.Downloads = []Download{
+		{Resolution: "360p", Path: DownloadName("video-1", "360p")},
+		{Resolution: "720p", Path: DownloadName("video-1", "720p")},
+	}
+
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase(video, readyVideo("video-2"))))
+
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+		object   string
+	}{
+		{"largest by default", "/video/video-1/download", http.StatusOK, "video-1/download_720p.mp4"},
+		{"requested resolution", "/video/video-1/download?resolution=360p", http.StatusOK, "video-1/download_360p.mp4"},
+		{"missing resolution", "/video/video-1/download?resolution=1080p", http.StatusNotFound, ""},
+		{"no downloads", "/video/video-2/download", http.StatusNotFound, ""},
+		{"video not found", "/video/missing/download", http.StatusNotFound, ""},
+	}
+
+	if response := serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/download", nil)); response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without an API key, got %d", response.Code)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			request.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+			response := serve(router, request)
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+
+			if test.expected != http.StatusOK {
+				return
+			}
+
+			body := response.Body.String()
+			if !strings.Contains(body, test.object) {
+				t.Fatalf("expected URL for %s, got %s", test.object, body)
+			}
+
+			if !strings.Contains(body, url.QueryEscape(`attachment; filename*=utf-8''f%C3%A9rias%202024.mp4`)) {
+				t.Fatalf("expected content disposition from the video name, got %s", body)
+			}
+		})
+	}
+}
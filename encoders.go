@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+type CodecFamily string
+
+const (
+	CodecH264 CodecFamily = "h264"
+	CodecHEVC CodecFamily = "hevc"
+	CodecVP9  CodecFamily = "vp9"
+	CodecAV1  CodecFamily = "av1"
+)
+
+// codecEncoders lists the ffmpeg encoders of each codec family in order of
+// preference: software encoders first for predictable quality, then hardware.
+var codecEncoders = map[CodecFamily][]string{
+	CodecH264: {"libx264", "h264_nvenc", "h264_qsv", "h264_videotoolbox"},
+	CodecHEVC: {"libx265", "hevc_nvenc", "hevc_qsv", "hevc_videotoolbox"},
+	CodecVP9:  {"libvpx-vp9", "vp9_qsv"},
+	CodecAV1:  {"libsvtav1", "libaom-av1", "av1_nvenc", "av1_qsv"},
+}
+
+func IsValidCodecFamily(codec CodecFamily) bool {
+	_, ok := codecEncoders[codec]
+	return ok
+}
+
+// EncoderRegistry records which encoders the local ffmpeg build provides.
+type EncoderRegistry struct {
+	available map[string]bool
+}
+
+func NewEncoderRegistry(encoders []string) *EncoderRegistry {
+	available := make(map[string]bool)
+	for _, encoder := range encoders {
+		available[encoder] = true
+	}
+
+	return &EncoderRegistry{
+		available: available,
+	}
+}
+
+func DetectEncoders(ctx context.Context, transcoder Transcoder) (*EncoderRegistry, error) {
+	encoders, err := transcoder.Encoders(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("encoders loading error: %v", err)
+	}
+
+	return NewEncoderRegistry(encoders), nil
+}
+
+// Encoder returns the preferred available encoder of the codec family.
+func (r *EncoderRegistry) Encoder(codec CodecFamily) (string, bool) {
+	for _, encoder := range codecEncoders[codec] {
+		if r.available[encoder] {
+			return encoder, true
+		}
+	}
+
+	return "", false
+}
+
+// Families lists the codec families with at least one available encoder.
+func (r *EncoderRegistry) Families() []CodecFamily {
+	families := make([]CodecFamily, 0)
+
+	for codec := range codecEncoders {
+		if _, ok := r.Encoder(codec); ok {
+			families = append(families, codec)
+		}
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i] < families[j]
+	})
+
+	return families
+}
+
+// Resolve picks the codec family and encoder for a profile, trying its codec
+// first and then each fallback in order.
+func (r *EncoderRegistry) Resolve(profile EncodingProfile) (CodecFamily, string, error) {
+	for _, codec := range profile.Codecs() {
+		if encoder, ok := r.Encoder(codec); ok {
+			return codec, encoder, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("encoding profile %q: no encoder available for %v", profile.Name, profile.Codecs())
+}
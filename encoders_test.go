@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestEncoderRegistryPreference(t *testing.T) {
+	registry := NewEncoderRegistry([]string{"h264_qsv", "h264_nvenc", "libaom-av1", "libsvtav1"})
+
+	if encoder, ok := registry.Encoder(CodecH264); !ok || encoder != "h264_nvenc" {
+		t.Fatalf("expected h264_nvenc, got %s", encoder)
+	}
+
+	if encoder, ok := registry.Encoder(CodecAV1); !ok || encoder != "libsvtav1" {
+		t.Fatalf("expected libsvtav1, got %s", encoder)
+	}
+
+	if _, ok := registry.Encoder(CodecHEVC); ok {
+		t.Fatal("expected HEVC to be unavailable")
+	}
+
+	if families := registry.Families(); !reflect.DeepEqual(families, []CodecFamily{CodecAV1, CodecH264}) {
+		t.Fatalf("unexpected families: %v", families)
+	}
+}
+
+func TestEncoderRegistryResolveFallback(t *testing.T) {
+	registry := NewEncoderRegistry([]string{"libx264", "libvpx-vp9"})
+
+	profile := EncodingProfile{Name: "1080p_av1", Codec: CodecAV1, Fallbacks: []CodecFamily{CodecHEVC, CodecVP9, CodecH264}}
+
+	codec, encoder, err := registry.Resolve(profile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if codec != CodecVP9 || encoder != "libvpx-vp9" {
+		t.Fatalf("expected vp9 fallback, got %s (%s)", codec, encoder)
+	}
+
+	if _, _, err := registry.Resolve(EncodingProfile{Name: "hevc", Codec: CodecHEVC}); err == nil {
+		t.Fatal("expected error without fallbacks")
+	}
+}
+
+func TestDetectEncoders(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.AvailableEncoders = []string{"libx265"}
+
+	registry, err := DetectEncoders(context.Background(), transcoder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if encoder, ok := registry.Encoder(CodecHEVC); !ok || encoder != "libx265" {
+		t.Fatalf("expected libx265, got %s", encoder)
+	}
+}
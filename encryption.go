@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const encryptionKeySize = 16
+
+type EncryptionSettings struct {
+	Enabled          bool   `yaml:"enabled"`
+	KeyURL           string `yaml:"key_url"`
+	Secret           string `yaml:"secret"`
+	RotationSegments int    `yaml:"rotation_segments"`
+}
+
+// EncryptionKey is an AES-128 content key. Keys live in the database only and
+// are delivered to players by the key endpoint.
+type EncryptionKey struct {
+	ID      string
+	VideoID string
+	Key     []byte
+}
+
+// KeyDelivery builds the EXT-X-KEY URIs players fetch keys from: the key
+// endpoint of this server, authorized by a token valid for ttl.
+type KeyDelivery struct {
+	BaseURL string
+	Signer  *TokenSigner
+	TTL     time.Duration
+}
+
+// NewKeyDelivery signs key URIs for ttl, which must cover the segment URLs of
+// the playlists they are listed in.
+func NewKeyDelivery(settings EncryptionSettings, ttl time.Duration) (*KeyDelivery, error) {
+	if !settings.Enabled {
+		return nil, nil
+	}
+
+	if settings.KeyURL == "" || settings.Secret == "" {
+		return nil, fmt.Errorf("encryption: key_url and secret are required")
+	}
+
+	if settings.RotationSegments < 0 {
+		return nil, fmt.Errorf("encryption: rotation_segments must not be negative")
+	}
+
+	return &KeyDelivery{
+		BaseURL: settings.KeyURL,
+		Signer:  NewTokenSigner(settings.Secret),
+		TTL:     ttl,
+	}, nil
+}
+
+func KeyTokenSubject(videoID string, keyID string) string {
+	return fmt.Sprintf("key:%s:%s", videoID, keyID)
+}
+
+func (k *KeyDelivery) KeyURI(videoID string, keyID string) string {
+	token := k.Signer.Sign(KeyTokenSubject(videoID, keyID), time.Now().Add(k.TTL))
+
+	return fmt.Sprintf("%s/video/%s/key/%s?token=%s", k.BaseURL, url.PathEscape(videoID), url.PathEscape(keyID), url.QueryEscape(token))
+}
+
+// segmentEncrypter encrypts the segments of every rendition of a video with
+// keys shared across renditions: segment i uses key i/rotation, so switching
+// renditions does not require a new key. A rotation of 0 uses a single key.
+type segmentEncrypter struct {
+	videoID  string
+	rotation int
+	keys     []EncryptionKey
+}
+
+func newSegmentEncrypter(videoID string, rotation int) *segmentEncrypter {
+	return &segmentEncrypter{
+		videoID:  videoID,
+		rotation: rotation,
+	}
+}
+
+func (e *segmentEncrypter) keyIndex(segment int) int {
+	if e.rotation <= 0 {
+		return 0
+	}
+
+	return segment / e.rotation
+}
+
+func (e *segmentEncrypter) key(index int) (EncryptionKey, error) {
+	for len(e.keys) <= index {
+		key := make([]byte, encryptionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return EncryptionKey{}, fmt.Errorf("key generation error: %v", err)
+		}
+
+		e.keys = append(e.keys, EncryptionKey{
+			ID:      uuid.New().String(),
+			VideoID: e.videoID,
+			Key:     key,
+		})
+	}
+
+	return e.keys[index], nil
+}
+
+// Encrypt applies HLS AES-128: CBC with PKCS#7 padding over the whole segment.
+// The IV is the segment's media sequence number, the HLS default when
+// EXT-X-KEY has no IV attribute.
+func (e *segmentEncrypter) Encrypt(segment int, data []byte) ([]byte, string, error) {
+	key, err := e.key(e.keyIndex(segment))
+	if err != nil {
+		return nil, "", err
+	}
+
+	encrypted, err := encryptSegment(key.Key, segment, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return encrypted, key.ID, nil
+}
+
+func encryptSegment(key []byte, sequence int, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("segment encryption error: %v", err)
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plaintext := append(append(make([]byte, 0, len(data)+padding), data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, sequenceIV(sequence)).CryptBlocks(encrypted, plaintext)
+
+	return encrypted, nil
+}
+
+func sequenceIV(sequence int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+
+	return iv
+}
+
+// segmentKeyURIs returns the key URI of each segment of a rendition encrypted
+// with keyIDs, or nil for clear renditions.
+func segmentKeyURIs(videoID string, resolution Resolution, segments int, keys *KeyDelivery) ([]string, error) {
+	if len(resolution.KeyIDs) == 0 {
+		return nil, nil
+	}
+
+	if keys == nil {
+		return nil, fmt.Errorf("rendition %s is encrypted but key delivery is not configured", resolution.Resolution)
+	}
+
+	uris := make([]string, segments)
+	byKey := make(map[string]string)
+
+	for i := range uris {
+		index := 0
+		if resolution.KeyRotation > 0 {
+			index = i / resolution.KeyRotation
+		}
+
+		if index >= len(resolution.KeyIDs) {
+			return nil, fmt.Errorf("rendition %s has no key for segment %d", resolution.Resolution, i)
+		}
+
+		keyID := resolution.KeyIDs[index]
+		if _, ok := byKey[keyID]; !ok {
+			byKey[keyID] = keys.KeyURI(videoID, keyID)
+		}
+
+		uris[i] = byKey[keyID]
+	}
+
+	return uris, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSigner(t *testing.T) {
+	signer := NewTokenSigner("secret")
+	token := signer.Sign("key:video-1:key-1", time.Now().Add(time.Minute))
+
+	if err := signer.Verify("key:video-1:key-1", token); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		signer   *TokenSigner
+		subject  string
+		token    string
+		expected VideoError
+	}{
+		{"other subject", signer, "key:video-1:key-2", token, ErrTokenInvalid},
+		{"other secret", NewTokenSigner("other"), "key:video-1:key-1", token, ErrTokenInvalid},
+		{"malformed", signer, "key:video-1:key-1", "garbage", ErrTokenInvalid},
+		{"tampered expiry", signer, "key:video-1:key-1", "9999999999" + token[strings.Index(token, "."):], ErrTokenInvalid},
+		{"expired", signer, "key:video-1:key-1", signer.Sign("key:video-1:key-1", time.Now().Add(-time.Minute)), ErrTokenExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.signer.Verify(test.subject, test.token)
+			if err == nil || err.Error() != string(test.expected) {
+				t.Fatalf("expected %s, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestEncryptSegment(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, encryptionKeySize)
+	data := []byte("720p segment 3")
+
+	encrypted, err := encryptSegment(key, 3, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(encrypted) != aes.BlockSize {
+		t.Fatalf("expected a single padded block, got %d bytes", len(encrypted))
+	}
+
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, aes.BlockSize)
+	iv[aes.BlockSize-1] = 3
+
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+
+	padding := int(decrypted[len(decrypted)-1])
+	if !bytes.Equal(decrypted[:len(decrypted)-padding], data) {
+		t.Fatalf("expected %q, got %q", data, decrypted)
+	}
+}
+
+func TestProcessVideoEncryption(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.DefaultSegments = 5
+
+	storage := NewMemoryFileStorage()
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      landscape,
+		Profiles:      []EncodingProfile{{Name: "720p", Resolution: "720p", Codec: CodecH264, Packaging: PackagingCMAF}},
+		Encryption:    EncryptionSettings{Enabled: true, RotationSegments: 2},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(response.Keys) != 3 {
+		t.Fatalf("expected 3 rotating keys for 5 segments, got %d", len(response.Keys))
+	}
+
+	resolution := response.Resolutions[0]
+	if resolution.KeyRotation != 2 || len(resolution.KeyIDs) != 3 || resolution.KeyIDs[2] != response.Keys[2].ID {
+		t.Fatalf("unexpected keys on rendition: %+v", resolution)
+	}
+
+	if init, _ := storage.Object("video-1/init_720p.mp4"); string(init) != "720p init" {
+		t.Fatalf("expected clear init segment, got %q", init)
+	}
+
+	segment, _ := storage.Object("video-1/video_720p_004.m4s")
+	expected, _ := encryptSegment(response.Keys[2].Key, 4, []byte("720p segment 4"))
+	if !bytes.Equal(segment, expected) {
+		t.Fatal("expected segment 4 to be encrypted with the third key")
+	}
+
+	keys := &KeyDelivery{BaseURL: "https://api.example.com", Signer: NewTokenSigner("secret"), TTL: time.Minute}
+
+	manifest, err := signedMediaPlaylist("video-1", resolution, storage, keys)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count := strings.Count(manifest, "#EXT-X-KEY:METHOD=AES-128"); count != 3 {
+		t.Fatalf("expected a key tag per key, got %d:\n%s", count, manifest)
+	}
+
+	if _, err := signedMediaPlaylist("video-1", resolution, storage, nil); err == nil {
+		t.Fatal("expected error without key delivery")
+	}
+
+	if _, err := signedDashManifest(Video{ID: "video-1", Resolutions: response.Resolutions}, storage); err == nil {
+		t.Fatal("expected DASH to be unavailable for encrypted renditions")
+	}
+}
+
+func TestGetKeyHandler(t *testing.T) {
+	db := NewMemoryDatabase(readyVideo("video-1"))
+	db.SaveKeys(context.Background(), "video-1", []EncryptionKey{{ID: "key-1", VideoID: "video-1", Key: []byte("0123456789abcdef")}})
+
+	service := newTestService(NewMemoryFileStorage(), db)
+	service.Keys = &KeyDelivery{BaseURL: "https://api.example.com", Signer: NewTokenSigner("secret"), TTL: time.Minute}
+
+	router := newTestRouter(service)
+
+	keyURI, err := url.Parse(service.Keys.KeyURI("video-1", "key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, keyURI.RequestURI(), nil))
+	if response.Code != http.StatusOK || response.Body.String() != "0123456789abcdef" {
+		t.Fatalf("expected key, got %d: %s", response.Code, response.Body.String())
+	}
+
+	if response.Header().Get("Cache-Control") != "no-store" {
+		t.Fatal("expected key not to be cached")
+	}
+
+	otherToken := url.QueryEscape(service.Keys.Signer.Sign(KeyTokenSubject("video-1", "key-2"), time.Now().Add(time.Minute)))
+
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+	}{
+		{"missing token", "/video/video-1/key/key-1", http.StatusUnauthorized},
+		{"token for another key", "/video/video-1/key/key-1?token=" + otherToken, http.StatusUnauthorized},
+		{"unknown key", "/video/video-1/key/key-2?token=" + otherToken, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewKeyDeliveryTTL(t *testing.T) {
+	storage := NewMemoryFileStorage()
+
+	keys, err := NewKeyDelivery(EncryptionSettings{Enabled: true, KeyURL: "https://api.example.com", Secret: "secret"}, segmentURLTTL(storage))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if keys.TTL != 66*time.Minute {
+		t.Fatalf("expected key tokens to outlive the segment URLs, got %s", keys.TTL)
+	}
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Faults injects failures and latency into the in-memory fakes. Calls are
+// counted per method name starting at 1, so FailNth("Store", 3, err) makes the
+// third Store call return err.
+type Faults struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	failures map[string]map[int]error
+	latency  time.Duration
+}
+
+func (f *Faults) FailNth(method string, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures == nil {
+		f.failures = make(map[string]map[int]error)
+	}
+
+	if f.failures[method] == nil {
+		f.failures[method] = make(map[int]error)
+	}
+
+	f.failures[method][n] = err
+}
+
+func (f *Faults) SetLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latency = latency
+}
+
+func (f *Faults) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+func (f *Faults) call(method string) error {
+	f.mu.Lock()
+
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+
+	f.calls[method]++
+	err := f.failures[method][f.calls[method]]
+	latency := f.latency
+
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	return err
+}
+
+type MemoryFileStorage struct {
+	Faults
+
+	mu           sync.Mutex
+	objects      map[string][]byte
+	dispositions map[string]string
+	ttls         map[string]time.Duration
+	TTL          time.Duration
+}
+
+func NewMemoryFileStorage() *MemoryFileStorage {
+	return &MemoryFileStorage{
+		objects:      make(map[string][]byte),
+		dispositions: make(map[string]string),
+		ttls:         make(map[string]time.Duration),
+		TTL:          defaultURLTTL,
+	}
+}
+
+func (m *MemoryFileStorage) Store(filePath string, fileContent []byte) error {
+	if err := m.call("Store"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[filePath] = append([]byte(nil), fileContent...)
+	delete(m.dispositions, filePath)
+	return nil
+}
+
+func (m *MemoryFileStorage) StoreAttachment(filePath string, fileContent []byte, filename string) error {
+	if err := m.Store(filePath, fileContent); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dispositions[filePath] = ContentDisposition(filename)
+	return nil
+}
+
+// Disposition returns the Content-Disposition an object was stored with.
+func (m *MemoryFileStorage) Disposition(filePath string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.dispositions[filePath]
+}
+
+func (m *MemoryFileStorage) SignedURL(filePath string, ttl time.Duration) (string, error) {
+	if err := m.call("SignedURL"); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.ttls[filePath] = ttl
+	m.mu.Unlock()
+
+	return fmt.Sprintf("https://memory.test/%s?signature=%d", filePath, m.Calls("SignedURL")), nil
+}
+
+func (m *MemoryFileStorage) SignedAttachmentURL(filePath string, ttl time.Duration, filename string) (string, error) {
+	signed, err := m.SignedURL(filePath, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "&response-content-disposition=" + url.QueryEscape(ContentDisposition(filename)), nil
+}
+
+func (m *MemoryFileStorage) URLTTL() time.Duration {
+	return m.TTL
+}
+
+// SignedTTL returns the lifetime of the last URL signed for filePath.
+func (m *MemoryFileStorage) SignedTTL(filePath string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ttls[filePath]
+}
+
+func (m *MemoryFileStorage) Retrieve(filePath string) ([]byte, error) {
+	if err := m.call("Retrieve"); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, ok := m.objects[filePath]
+	if !ok {
+		return nil, fmt.Errorf("object not found: %s", filePath)
+	}
+
+	return append([]byte(nil), content...), nil
+}
+
+func (m *MemoryFileStorage) Object(filePath string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, ok := m.objects[filePath]
+	return content, ok
+}
+
+func (m *MemoryFileStorage) Paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := make([]string, 0, len(m.objects))
+	for path := range m.objects {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+type MemoryDatabase struct {
+	Faults
+
+	mu     sync.Mutex
+	videos map[string]Video
+	order  []string
+	keys   map[string]EncryptionKey
+}
+
+func NewMemoryDatabase(videos ...Video) *MemoryDatabase {
+	m := &MemoryDatabase{
+		videos: make(map[string]Video),
+		keys:   make(map[string]EncryptionKey),
+	}
+
+	for _, video := range videos {
+		m.put(video)
+	}
+
+	return m
+}
+
+func (m *MemoryDatabase) put(video Video) {
+	if _, ok := m.videos[video.ID]; !ok {
+		m.order = append(m.order, video.ID)
+	}
+
+	m.videos[video.ID] = video
+}
+
+func (m *MemoryDatabase) SaveVideo(ctx context.Context, video Video) error {
+	if err := m.call("SaveVideo"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(video)
+	return nil
+}
+
+func (m *MemoryDatabase) GetVideo(ctx context.Context, videoID string) (Video, error) {
+	if err := m.call("GetVideo"); err != nil {
+		return Video{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	video, ok := m.videos[videoID]
+	if !ok {
+		return Video{}, errors.New(string(ErrVideoNotFound))
+	}
+
+	return video, nil
+}
+
+func (m *MemoryDatabase) UpdateVideo(ctx context.Context, videoID string, update func(video *Video) error) (Video, error) {
+	if err := m.call("UpdateVideo"); err != nil {
+		return Video{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	video, ok := m.videos[videoID]
+	if !ok {
+		return Video{}, errors.New(string(ErrVideoNotFound))
+	}
+
+	if err := update(&video); err != nil {
+		return Video{}, err
+	}
+
+	m.put(video)
+	return video, nil
+}
+
+func (m *MemoryDatabase) GetVideos(ctx context.Context, page int, size int) (Page, error) {
+	if err := m.call("GetVideos"); err != nil {
+		return Page{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totalPages := len(m.order) / size
+	if len(m.order)%size != 0 {
+		totalPages++
+	}
+
+	start := (page - 1) * size
+	if start > len(m.order) {
+		start = len(m.order)
+	}
+
+	end := start + size
+	if end > len(m.order) {
+		end = len(m.order)
+	}
+
+	items := make([]Video, 0, end-start)
+	for _, id := range m.order[start:end] {
+		items = append(items, m.videos[id])
+	}
+
+	return Page{
+		CurrentPage: page,
+		Limit:       size,
+		TotalPages:  totalPages,
+		Items:       items,
+	}, nil
+}
+
+func (m *MemoryDatabase) SaveKeys(ctx context.Context, videoID string, keys []EncryptionKey) error {
+	if err := m.call("SaveKeys"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		m.keys[string(keyPath(videoID, key.ID))] = key
+	}
+
+	return nil
+}
+
+func (m *MemoryDatabase) GetKey(ctx context.Context, videoID string, keyID string) (EncryptionKey, error) {
+	if err := m.call("GetKey"); err != nil {
+		return EncryptionKey{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[string(keyPath(videoID, keyID))]
+	if !ok {
+		return EncryptionKey{}, errors.New(string(ErrKeyNotFound))
+	}
+
+	return key, nil
+}
+
+// ScriptedTranscoder stands in for ffmpeg. Each Transcode call writes the
+// number of segments scripted for the job's resolution (DefaultSegments when
+// unscripted) plus a playlist, unless a failure is scripted for it.
+type ScriptedTranscoder struct {
+	Faults
+
+	mu                sync.Mutex
+	AvailableEncoders []string
+	DefaultSegments   int
+	Segments          map[string]int
+	Failures          map[string]error
+	Jobs              []TranscodeJob
+	Subtitles         map[int]string
+	FrameLuma         func(time float64) uint8
+	Frames            []FrameJob
+	SpriteSheets      int
+	Previews          []PreviewJob
+	Downloads         []DownloadJob
+	Trims             []TrimJob
+	Concats           []ConcatJob
+	Measured          Loudness
+	LoudnessJobs      []LoudnessJob
+}
+
+func NewScriptedTranscoder() *ScriptedTranscoder {
+	return &ScriptedTranscoder{
+		AvailableEncoders: []string{"aac", "libx264"},
+		DefaultSegments:   2,
+		Segments:          make(map[string]int),
+		Failures:          make(map[string]error),
+		Subtitles:         make(map[int]string),
+		SpriteSheets:      1,
+		Measured:          Loudness{Integrated: -30.5, TruePeak: -4.2, LoudnessRange: 6.1, Threshold: -40.9, TargetOffset: 0.3},
+	}
+}
+
+func (s *ScriptedTranscoder) Encoders(ctx context.Context) ([]string, error) {
+	if err := s.call("Encoders"); err != nil {
+		return nil, err
+	}
+
+	return s.AvailableEncoders, nil
+}
+
+func (s *ScriptedTranscoder) Transcode(ctx context.Context, job TranscodeJob) error {
+	if err := s.call("Transcode"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Jobs = append(s.Jobs, job)
+	err := s.Failures[job.Resolution]
+	segments, ok := s.Segments[job.Resolution]
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		segments = s.DefaultSegments
+	}
+
+	if job.SingleFile {
+		return writeSingleFileRendition(job, segments)
+	}
+
+	playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n"
+
+	if job.Packaging == PackagingCMAF {
+		initFilePath := filepath.Join(filepath.Dir(job.PlaylistFilePath), job.InitFileName)
+		if err := os.WriteFile(initFilePath, []byte(job.Resolution+" init"), 0600); err != nil {
+			return err
+		}
+
+		playlist = "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:10\n" + fmt.Sprintf("#EXT-X-MAP:URI=%q\n", job.InitFileName)
+	}
+
+	for i := 0; i < segments; i++ {
+		segmentFilePath := fmt.Sprintf(job.SegmentPattern, i)
+		if err := os.WriteFile(segmentFilePath, []byte(fmt.Sprintf("%s segment %d", job.Resolution, i)), 0600); err != nil {
+			return err
+		}
+
+		playlist += fmt.Sprintf("#EXTINF:10.000000,\n%s\n", filepath.Base(segmentFilePath))
+	}
+
+	playlist += "#EXT-X-ENDLIST\n"
+
+	return os.WriteFile(job.PlaylistFilePath, []byte(playlist), 0600)
+}
+
+// writeSingleFileRendition writes the init segment (for CMAF) and every
+// segment back to back into SegmentPattern, as ffmpeg's single_file flag does.
+func writeSingleFileRendition(job TranscodeJob, segments int) error {
+	var content []byte
+
+	playlist := "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:10\n"
+	name := filepath.Base(job.SegmentPattern)
+
+	if job.Packaging == PackagingCMAF {
+		content = []byte(job.Resolution + " init")
+		playlist = "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:10\n" + fmt.Sprintf("#EXT-X-MAP:URI=%q,BYTERANGE=\"%d@0\"\n", name, len(content))
+	}
+
+	for i := 0; i < segments; i++ {
+		segment := []byte(fmt.Sprintf("%s segment %d", job.Resolution, i))
+		playlist += fmt.Sprintf("#EXTINF:10.000000,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", len(segment), len(content), name)
+		content = append(content, segment...)
+	}
+
+	playlist += "#EXT-X-ENDLIST\n"
+
+	if err := os.WriteFile(job.SegmentPattern, content, 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(job.PlaylistFilePath, []byte(playlist), 0600)
+}
+
+// ExtractSubtitles returns the WebVTT scripted for the subtitle stream.
+func (s *ScriptedTranscoder) ExtractSubtitles(ctx context.Context, inputFilePath string, stream int) ([]byte, error) {
+	if err := s.call("ExtractSubtitles"); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, ok := s.Subtitles[stream]
+	if !ok {
+		return nil, fmt.Errorf("no subtitles scripted for stream %d", stream)
+	}
+
+	return []byte(content), nil
+}
+
+// ExtractFrame writes a uniform gray JPEG whose luminance is FrameLuma(time),
+// mid-gray when unscripted, whatever the requested format.
+func (s *ScriptedTranscoder) ExtractFrame(ctx context.Context, job FrameJob) error {
+	if err := s.call("ExtractFrame"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Frames = append(s.Frames, job)
+	luma := uint8(128)
+	if s.FrameLuma != nil {
+		luma = s.FrameLuma(job.Time)
+	}
+	s.mu.Unlock()
+
+	frame := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range frame.Pix {
+		frame.Pix[i] = luma
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, frame, nil); err != nil {
+		return err
+	}
+
+	return os.WriteFile(job.OutputFilePath, buffer.Bytes(), 0600)
+}
+
+// ExtractSprites writes SpriteSheets blank sheets of Columns x Rows tiles,
+// using a 16:9 tile when the job leaves the height to ffmpeg.
+func (s *ScriptedTranscoder) ExtractSprites(ctx context.Context, job SpriteJob) error {
+	if err := s.call("ExtractSprites"); err != nil {
+		return err
+	}
+
+	height := job.Height
+	if height == 0 {
+		height = job.Width * 9 / 16
+	}
+
+	for i := 0; i < s.SpriteSheets; i++ {
+		var buffer bytes.Buffer
+		if err := jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, job.Width*job.Columns, height*job.Rows)), nil); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(fmt.Sprintf(job.OutputPattern, i), buffer.Bytes(), 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ScriptedTranscoder) ExtractPreview(ctx context.Context, job PreviewJob) error {
+	if err := s.call("ExtractPreview"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Previews = append(s.Previews, job)
+	s.mu.Unlock()
+
+	return os.WriteFile(job.OutputFilePath, []byte(fmt.Sprintf("%s preview", job.Format)), 0600)
+}
+
+func (s *ScriptedTranscoder) EncodeDownload(ctx context.Context, job DownloadJob) error {
+	if err := s.call("EncodeDownload"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Downloads = append(s.Downloads, job)
+	s.mu.Unlock()
+
+	return os.WriteFile(job.OutputFilePath, []byte(fmt.Sprintf("%dp download", job.Height)), 0600)
+}
+
+func (s *ScriptedTranscoder) Trim(ctx context.Context, job TrimJob) error {
+	if err := s.call("Trim"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Trims = append(s.Trims, job)
+	s.mu.Unlock()
+
+	return os.WriteFile(job.OutputFilePath, []byte(fmt.Sprintf("clip %.3f+%.3f", job.Start, job.Duration)), 0600)
+}
+
+func (s *ScriptedTranscoder) Concat(ctx context.Context, job ConcatJob) error {
+	if err := s.call("Concat"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.Concats = append(s.Concats, job)
+	s.mu.Unlock()
+
+	return os.WriteFile(job.OutputFilePath, []byte(fmt.Sprintf("concat of %d parts", len(job.Parts))), 0600)
+}
+
+func (s *ScriptedTranscoder) MeasureLoudness(ctx context.Context, job LoudnessJob) (Loudness, error) {
+	if err := s.call("MeasureLoudness"); err != nil {
+		return Loudness{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LoudnessJobs = append(s.LoudnessJobs, job)
+
+	return s.Measured, nil
+}
+
+func (s *ScriptedTranscoder) ExtractedFrames() []FrameJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]FrameJob(nil), s.Frames...)
+}
+
+func (s *ScriptedTranscoder) TranscodedJobs() []TranscodeJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]TranscodeJob(nil), s.Jobs...)
+}
+
+type ScriptedProber struct {
+	Faults
+
+	Metadata VideoMetadata
+}
+
+func (s *ScriptedProber) Probe(ctx context.Context, inputFilePath string) (VideoMetadata, error) {
+	if err := s.call("Probe"); err != nil {
+		return VideoMetadata{}, err
+	}
+
+	if _, err := os.Stat(inputFilePath); err != nil {
+		return VideoMetadata{}, fmt.Errorf("metadata loading error: %v", err)
+	}
+
+	metadata := s.Metadata
+	metadata.Name = filepath.Base(inputFilePath)
+
+	return metadata, nil
+}
+
+const testAPIKey = "api-key"
+
+func newTestService(storage FileStorage, database Database) *VideoService {
+	prober := &ScriptedProber{
+		Metadata: VideoMetadata{
+			Width:    1920,
+			Height:   1080,
+			Duration: 20,
+		},
+	}
+
+	service := NewVideoService([]FileStorage{storage}, database, NewScriptedTranscoder(), prober, DefaultEncodingProfiles())
+	service.Playback, _ = NewPlaybackTokens(PlaybackSettings{Secret: "secret", APIKey: testAPIKey, BaseURL: "https://api.example.com/"}, segmentURLTTL(storage))
+
+	return service
+}
+
+// waitForStatus polls the database until the background processing started
+// by CreateVideo or ReprocessVideo finishes.
+func waitForStatus(t *testing.T, database Database, videoID string) Video {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		video, err := database.GetVideo(context.Background(), videoID)
+		if err == nil && video.Status != VideoStatusPending && video.Status != VideoStatusReprocessing {
+			return video
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("video %s still pending", videoID)
+	return Video{}
+}
@@ -0,0 +1,771 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type FFmpeg struct{}
+
+func NewFFmpeg() *FFmpeg {
+	return &FFmpeg{}
+}
+
+func (f *FFmpeg) Probe(ctx context.Context, inputFilePath string) (VideoMetadata, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", inputFilePath)
+
+	var outBuffer, errBuffer bytes.Buffer
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+
+	err := cmd.Run()
+	if err != nil {
+		return VideoMetadata{}, fmt.Errorf("metadata loading error: %v, details: %s", err, errBuffer.String())
+	}
+
+	metadata, err := parseProbeOutput(outBuffer.Bytes())
+	if err != nil {
+		return VideoMetadata{}, err
+	}
+
+	metadata.Name = filepath.Base(inputFilePath)
+
+	return metadata, nil
+}
+
+type probeOutput struct {
+	Streams []probeStream `json:"streams"`
+	Format  probeFormat   `json:"format"`
+}
+
+type probeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	BitRate    string `json:"bit_rate"`
+}
+
+type probeStream struct {
+	Index          int               `json:"index"`
+	CodecType      string            `json:"codec_type"`
+	CodecName      string            `json:"codec_name"`
+	Profile        string            `json:"profile"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	SampleAspect   string            `json:"sample_aspect_ratio"`
+	PixelFormat    string            `json:"pix_fmt"`
+	AvgFrameRate   string            `json:"avg_frame_rate"`
+	RealFrameRate  string            `json:"r_frame_rate"`
+	Duration       string            `json:"duration"`
+	BitRate        string            `json:"bit_rate"`
+	ColorSpace     string            `json:"color_space"`
+	ColorTransfer  string            `json:"color_transfer"`
+	ColorPrimaries string            `json:"color_primaries"`
+	ColorRange     string            `json:"color_range"`
+	Channels       int               `json:"channels"`
+	SampleRate     string            `json:"sample_rate"`
+	Tags           map[string]string `json:"tags"`
+	Disposition    map[string]int    `json:"disposition"`
+	SideDataList   []probeSideData   `json:"side_data_list"`
+}
+
+type probeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+
+func parseProbeOutput(data []byte) (VideoMetadata, error) {
+	var output probeOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return VideoMetadata{}, fmt.Errorf("metadata parse error: %v", err)
+	}
+
+	var video, audio *probeStream
+	tracks := make([]AudioTrack, 0)
+	subtitles := make([]SubtitleStream, 0)
+
+	for i := range output.Streams {
+		stream := &output.Streams[i]
+
+		switch stream.CodecType {
+		case "video":
+			// Cover art in mp3/m4a files is reported as a single-frame video stream.
+			if video == nil && stream.Disposition["attached_pic"] == 0 {
+				video = stream
+			}
+		case "audio":
+			if audio == nil {
+				audio = stream
+			}
+
+			tracks = append(tracks, AudioTrack{
+				Index:      len(tracks),
+				Codec:      stream.CodecName,
+				Channels:   stream.Channels,
+				SampleRate: int(parseFloat(stream.SampleRate)),
+				Language:   mediaLanguage(stream.tag("language")),
+				Title:      stream.tag("title"),
+				Default:    stream.Disposition["default"] == 1,
+			})
+		case "subtitle":
+			subtitles = append(subtitles, SubtitleStream{
+				Index:    len(subtitles),
+				Codec:    stream.CodecName,
+				Language: mediaLanguage(stream.tag("language")),
+				Title:    stream.tag("title"),
+				Default:  stream.Disposition["default"] == 1,
+				Forced:   stream.Disposition["forced"] == 1,
+			})
+		}
+	}
+
+	if video == nil {
+		return VideoMetadata{}, fmt.Errorf("metadata loading error: no video stream")
+	}
+
+	metadata := VideoMetadata{
+		Width:          video.Width,
+		Height:         video.Height,
+		SampleAspect:   video.SampleAspect,
+		Container:      output.Format.FormatName,
+		VideoCodec:     video.CodecName,
+		VideoProfile:   video.Profile,
+		FrameRate:      parseRational(video.AvgFrameRate),
+		PixelFormat:    video.PixelFormat,
+		Rotation:       video.rotation(),
+		ColorSpace:     video.ColorSpace,
+		ColorTransfer:  video.ColorTransfer,
+		ColorPrimaries: video.ColorPrimaries,
+		ColorRange:     video.ColorRange,
+	}
+
+	if metadata.FrameRate == 0 {
+		metadata.FrameRate = parseRational(video.RealFrameRate)
+	}
+
+	metadata.Duration = parseFloat(output.Format.Duration)
+	if metadata.Duration == 0 {
+		metadata.Duration = parseFloat(video.Duration)
+	}
+
+	metadata.Bitrate = int64(parseFloat(output.Format.BitRate))
+	if metadata.Bitrate == 0 {
+		metadata.Bitrate = int64(parseFloat(video.BitRate))
+	}
+
+	if audio != nil {
+		metadata.AudioCodec = audio.CodecName
+		metadata.AudioChannels = audio.Channels
+		metadata.AudioSampleRate = int(parseFloat(audio.SampleRate))
+	}
+
+	if len(tracks) > 0 {
+		flags := make([]bool, len(tracks))
+		for i, track := range tracks {
+			flags[i] = track.Default
+		}
+
+		chosen := defaultIndex(flags)
+		for i := range tracks {
+			tracks[i].Default = i == chosen
+		}
+
+		metadata.AudioTracks = tracks
+	}
+
+	if len(subtitles) > 0 {
+		flags := make([]bool, len(subtitles))
+		for i, stream := range subtitles {
+			flags[i] = stream.Default
+		}
+
+		chosen := defaultIndex(flags)
+		for i := range subtitles {
+			subtitles[i].Default = i == chosen
+		}
+
+		metadata.SubtitleTracks = subtitles
+	}
+
+	return metadata, nil
+}
+
+// rotation returns the clockwise rotation a player applies to the stream,
+// normalized to 0, 90, 180 or 270. The display matrix side data is counter
+// clockwise, while the legacy "rotate" tag is clockwise.
+func (s *probeStream) rotation() int {
+	rotation := 0
+
+	for _, sideData := range s.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			rotation = -int(math.Round(sideData.Rotation))
+		}
+	}
+
+	if rotation == 0 {
+		if tag, ok := s.Tags["rotate"]; ok {
+			rotation, _ = strconv.Atoi(tag)
+		}
+	}
+
+	return ((rotation % 360) + 360) % 360
+}
+
+// tag reads a stream tag regardless of case: Matroska sources report
+// "LANGUAGE" or "title" depending on the muxer that wrote them.
+func (s *probeStream) tag(name string) string {
+	for key, value := range s.Tags {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func parseRational(value string) float64 {
+	numerator, denominator, found := strings.Cut(value, "/")
+	if !found {
+		numerator, denominator, found = strings.Cut(value, ":")
+	}
+
+	if !found {
+		return parseFloat(value)
+	}
+
+	n := parseFloat(numerator)
+	d := parseFloat(denominator)
+	if d == 0 {
+		return 0
+	}
+
+	return n / d
+}
+
+func parseFloat(value string) float64 {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+
+	return number
+}
+
+func (f *FFmpeg) Encoders(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEncoders(out.String()), nil
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, job TranscodeJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("FFMPEG starting error: %v", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("FFMPEG finishing wait step error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+// ExtractSubtitles converts the stream-th subtitle stream of the input to
+// WebVTT, written to stdout.
+func (f *FFmpeg) ExtractSubtitles(ctx context.Context, inputFilePath string, stream int) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", inputFilePath, "-map", fmt.Sprintf("0:s:%d", stream), "-c:s", "webvtt", "-f", "webvtt", "-")
+
+	var outBuffer, errBuffer bytes.Buffer
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("subtitles extraction error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return outBuffer.Bytes(), nil
+}
+
+func (f *FFmpeg) ExtractFrame(ctx context.Context, job FrameJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("frame extraction error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+// ffmpegArgs seeks before opening the input so only the keyframes around
+// Time are decoded.
+func (job FrameJob) ffmpegArgs() []string {
+	height := job.Height
+	if height == 0 {
+		height = -2
+	}
+
+	args := []string{
+		"-v", "error",
+		"-ss", strconv.FormatFloat(job.Time, 'f', 3, 64),
+		"-i", job.InputFilePath,
+	}
+	args = append(args, overlayInputArgs(job.Overlay)...)
+
+	args = append(args, "-frames:v", "1")
+
+	filter, video := videoFilterArgs(fmt.Sprintf("scale=%d:%d,setsar=1", job.Width, height), overlayHeight(job.Width, job.Height), job.Overlay)
+	args = append(args, filter...)
+
+	if job.Overlay != nil {
+		args = append(args, "-map", video)
+	}
+
+	if job.Format == ImageFormatWebP {
+		args = append(args, "-c:v", "libwebp", "-quality", "80")
+	} else {
+		args = append(args, "-c:v", "mjpeg", "-q:v", "3")
+	}
+
+	return append(args, "-y", job.OutputFilePath)
+}
+
+func (f *FFmpeg) ExtractSprites(ctx context.Context, job SpriteJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sprite extraction error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+// ffmpegArgs samples one frame per interval and lays them out on sheets of
+// Columns x Rows tiles, numbered from 0.
+func (job SpriteJob) ffmpegArgs() []string {
+	height := job.Height
+	if height == 0 {
+		height = -2
+	}
+
+	sample := fmt.Sprintf("fps=1/%s,scale=%d:%d,setsar=1", strconv.FormatFloat(job.Interval, 'f', -1, 64), job.Width, height)
+	tile := fmt.Sprintf("tile=%dx%d", job.Columns, job.Rows)
+
+	args := []string{"-v", "error", "-i", job.InputFilePath}
+
+	if job.Overlay == nil {
+		args = append(args, "-vf", sample+","+tile)
+	} else {
+		args = append(args, overlayInputArgs(job.Overlay)...)
+		args = append(args,
+			"-filter_complex", overlayFilterGraph("0:v:0", sample, 1, overlayHeight(job.Width, job.Height), job.Overlay, "tiles")+";[tiles]"+tile+"[v]",
+			"-map", "[v]",
+		)
+	}
+
+	return append(args,
+		"-q:v", "4",
+		"-start_number", "0",
+		"-y", job.OutputPattern,
+	)
+}
+
+func (f *FFmpeg) ExtractPreview(ctx context.Context, job PreviewJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("preview extraction error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+// ffmpegArgs opens the input once per excerpt with an input seek, so only
+// the excerpts are decoded, and joins them with the concat filter. The
+// overlay image, if any, is the input after the excerpts.
+func (job PreviewJob) ffmpegArgs() []string {
+	height := job.Height
+	if height == 0 {
+		height = -2
+	}
+
+	args := []string{"-v", "error"}
+	filter := ""
+	inputs := ""
+
+	for i, start := range job.Starts {
+		args = append(args,
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(job.ExcerptDuration, 'f', 3, 64),
+			"-i", job.InputFilePath,
+		)
+
+		filter += fmt.Sprintf("[%d:v:0]fps=%d,scale=%d:%d,setsar=1,setpts=PTS-STARTPTS[v%d];", i, job.FrameRate, job.Width, height, i)
+		inputs += fmt.Sprintf("[v%d]", i)
+	}
+
+	if job.Overlay == nil {
+		filter += fmt.Sprintf("%sconcat=n=%d:v=1:a=0[out]", inputs, len(job.Starts))
+	} else {
+		args = append(args, overlayInputArgs(job.Overlay)...)
+		filter += fmt.Sprintf("%sconcat=n=%d:v=1:a=0[joined];", inputs, len(job.Starts)) +
+			overlayFilterGraph("joined", "", len(job.Starts), overlayHeight(job.Width, job.Height), job.Overlay, "out")
+	}
+
+	args = append(args, "-filter_complex", filter, "-map", "[out]", "-an")
+
+	if job.Format == PreviewFormatWebP {
+		args = append(args, "-c:v", "libwebp", "-loop", "0", "-quality", "60")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "28", "-pix_fmt", "yuv420p", "-movflags", "+faststart")
+	}
+
+	return append(args, "-y", job.OutputFilePath)
+}
+
+func (f *FFmpeg) EncodeDownload(ctx context.Context, job DownloadJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("download encoding error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+func (f *FFmpeg) Trim(ctx context.Context, job TrimJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("trim error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+// ffmpegArgs seeks before the input, which ffmpeg makes exact when
+// re-encoding by decoding from the previous keyframe and dropping the frames
+// before Start. Subtitles and data streams are not carried over.
+func (job TrimJob) ffmpegArgs() []string {
+	args := []string{
+		"-y", "-v", "error",
+		"-ss", strconv.FormatFloat(job.Start, 'f', 3, 64),
+		"-i", job.InputFilePath,
+		"-t", strconv.FormatFloat(job.Duration, 'f', 3, 64),
+		"-map", "0:v:0",
+		"-map", "0:a?",
+	}
+
+	args = append(args, intermediateCodecArgs(job.VideoEncoder, job.AudioEncoder)...)
+
+	return append(args,
+		"-sn", "-dn",
+		"-f", "matroska",
+		job.OutputFilePath,
+	)
+}
+
+func (f *FFmpeg) Concat(ctx context.Context, job ConcatJob) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("concat error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return nil
+}
+
+func (job ConcatJob) ffmpegArgs() []string {
+	args := []string{"-y", "-v", "error"}
+
+	for _, part := range job.Parts {
+		args = append(args, "-i", part.InputFilePath)
+	}
+
+	args = append(args,
+		"-filter_complex", job.filterGraph(),
+		"-map", "[v]",
+		"-map", "[a]",
+	)
+
+	args = append(args, intermediateCodecArgs(job.VideoEncoder, job.AudioEncoder)...)
+
+	return append(args,
+		"-f", "matroska",
+		job.OutputFilePath,
+	)
+}
+
+// MeasureLoudness runs the first loudnorm pass, decoding the whole track
+// without writing any output.
+func (f *FFmpeg) MeasureLoudness(ctx context.Context, job LoudnessJob) (Loudness, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", job.ffmpegArgs()...)
+
+	var errBuffer bytes.Buffer
+	cmd.Stderr = &errBuffer
+
+	if err := cmd.Run(); err != nil {
+		return Loudness{}, fmt.Errorf("loudness measurement error: %v, details: %s", err, errBuffer.String())
+	}
+
+	return parseLoudnormOutput(errBuffer.String())
+}
+
+func (job LoudnessJob) ffmpegArgs() []string {
+	return []string{
+		"-hide_banner", "-nostats",
+		"-i", job.InputFilePath,
+		"-map", fmt.Sprintf("0:a:%d", job.AudioStream),
+		"-vn", "-sn", "-dn",
+		"-af", job.Target.filter() + ":print_format=json",
+		"-f", "null",
+		"-",
+	}
+}
+
+// intermediateCodecArgs encodes files that are transcoded again by the
+// pipeline, near-lossless so the final renditions do not lose quality.
+func intermediateCodecArgs(videoEncoder string, audioEncoder string) []string {
+	args := []string{"-c:v", videoEncoder}
+
+	if videoEncoder == "libx264" {
+		args = append(args, "-crf", "16", "-preset", "fast")
+	}
+
+	return append(args, "-c:a", audioEncoder, "-b:a", "192k")
+}
+
+// ffmpegArgs writes a progressive MP4: yuv420p for the widest player
+// support and faststart so playback can begin before the file is complete.
+func (job DownloadJob) ffmpegArgs() []string {
+	scale := TranscodeJob{Width: job.Width, Height: job.Height}.scaleFilter()
+	filter, video := videoFilterArgs(scale, job.Height, job.Overlay)
+
+	args := []string{"-y", "-v", "error", "-i", job.InputFilePath}
+	args = append(args, overlayInputArgs(job.Overlay)...)
+
+	args = append(args,
+		"-map", video,
+		"-map", fmt.Sprintf("0:a:%d?", job.AudioStream),
+		filter[0], filter[1],
+		"-c:v", job.VideoEncoder,
+		"-pix_fmt", "yuv420p",
+	)
+
+	args = append(args, loudnessArgs(job.Loudness)...)
+
+	return append(args,
+		"-c:a", job.AudioEncoder,
+		"-b:a", "128k",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		job.OutputFilePath,
+	)
+}
+
+func (job TranscodeJob) ffmpegArgs() []string {
+	args := []string{"-i", job.InputFilePath}
+	filter, video := videoFilterArgs(job.scaleFilter(), job.Height, job.Overlay)
+
+	if !job.AudioOnly {
+		args = append(args, overlayInputArgs(job.Overlay)...)
+	}
+
+	switch {
+	case job.AudioOnly:
+		args = append(args,
+			"-map", fmt.Sprintf("0:a:%d", job.AudioStream),
+			"-vn",
+		)
+		args = append(args, loudnessArgs(job.Loudness)...)
+		args = append(args,
+			"-c:a", job.AudioEncoder,
+			"-b:a", strconv.Itoa(job.AudioBitrate),
+		)
+	case job.NoAudio:
+		args = append(args, filter...)
+		args = append(args, "-c:v", job.VideoEncoder)
+		args = append(args, job.codecArgs()...)
+		args = append(args, "-map", video, "-an")
+	default:
+		args = append(args, filter...)
+		args = append(args, "-c:v", job.VideoEncoder)
+		args = append(args, job.codecArgs()...)
+		args = append(args,
+			"-c:a", job.AudioEncoder,
+			"-map", video,
+			"-map", "0:a?",
+		)
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(job.SegmentTime),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", job.SegmentPattern,
+	)
+
+	if job.Packaging == PackagingCMAF {
+		args = append(args, "-hls_segment_type", "fmp4")
+
+		if job.InitFileName != "" {
+			args = append(args, "-hls_fmp4_init_filename", job.InitFileName)
+		}
+	} else {
+		args = append(args, "-hls_segment_type", "mpegts")
+	}
+
+	if job.SingleFile {
+		args = append(args, "-hls_flags", "single_file")
+	}
+
+	return append(args, job.PlaylistFilePath)
+}
+
+// codecArgs tunes each codec family for segmented delivery. HEVC is tagged
+// hvc1 as required by Apple players, VP9 enables row multithreading and AV1
+// through libaom uses its realtime-friendly speed settings.
+func (job TranscodeJob) codecArgs() []string {
+	switch job.Codec {
+	case CodecHEVC:
+		return []string{"-tag:v", "hvc1"}
+	case CodecVP9:
+		if job.VideoEncoder == "libvpx-vp9" {
+			return []string{"-row-mt", "1", "-deadline", "good", "-cpu-used", "4", "-b:v", "0", "-crf", "33"}
+		}
+	case CodecAV1:
+		switch job.VideoEncoder {
+		case "libaom-av1":
+			return []string{"-cpu-used", "6", "-row-mt", "1", "-b:v", "0", "-crf", "32"}
+		case "libsvtav1":
+			return []string{"-preset", "8", "-crf", "32"}
+		}
+	}
+
+	return nil
+}
+
+// scaleFilter squares the pixels of anamorphic sources with setsar=1 so
+// players display the rendition at the size recorded on its Resolution.
+// Rotation is applied by ffmpeg's autorotate before the filter graph runs.
+func (job TranscodeJob) scaleFilter() string {
+	if job.Width == 0 {
+		return fmt.Sprintf("scale=-2:%d,setsar=1", job.Height)
+	}
+
+	return fmt.Sprintf("scale=%d:%d,setsar=1", job.Width, job.Height)
+}
+
+// videoFilterArgs returns the filter arguments that scale the first video
+// stream and, with an overlay, brand it, along with the stream to map.
+func videoFilterArgs(scale string, height int, overlay *OverlayProfile) ([]string, string) {
+	if overlay == nil {
+		return []string{"-vf", scale}, "0:v:0"
+	}
+
+	return []string{"-filter_complex", overlayFilterGraph("0:v:0", scale, 1, height, overlay, "v")}, "[v]"
+}
+
+// overlayInputArgs opens the overlay image as the next input.
+func overlayInputArgs(overlay *OverlayProfile) []string {
+	if overlay == nil || overlay.Image == nil {
+		return nil
+	}
+
+	return []string{"-i", overlay.Image.Path}
+}
+
+// loudnessArgs applies the second loudnorm pass of a correction.
+func loudnessArgs(correction *LoudnessCorrection) []string {
+	if correction == nil {
+		return nil
+	}
+
+	return []string{"-af", correction.filter(), "-ar", strconv.Itoa(correction.SampleRate)}
+}
+
+// parseEncoders reads the table printed by `ffmpeg -encoders`, which lists
+// one encoder per line after a "------" separator as "<flags> <name> <description>".
+func parseEncoders(output string) []string {
+	encoders := make([]string, 0)
+	started := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "------") {
+			started = true
+			continue
+		}
+
+		if !started {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) > 1 {
+			encoders = append(encoders, parts[1])
+		}
+	}
+
+	return encoders
+}
+
+func ListAvailableCodecs() ([]string, error) {
+	cmd := exec.Command("ffmpeg", "-codecs")
+
+	var outBuffer bytes.Buffer
+	cmd.Stdout = &outBuffer
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("codecs loading error: %v", err)
+	}
+
+	codecs := []string{}
+	lines := strings.Split(outBuffer.String(), "\n")
+	for _, line := range lines {
+		if strings.Contains(line, "V") {
+			parts := strings.Fields(line)
+			if len(parts) > 1 {
+				codecs = append(codecs, parts[1])
+			}
+		}
+	}
+
+	return codecs, nil
+}
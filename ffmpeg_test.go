@@ -0,0 +1,245 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEncoders(t *testing.T) {
+	output := `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+`
+
+	expected := []string{"libx264", "h264_nvenc", "aac"}
+	if encoders := parseEncoders(output); !reflect.DeepEqual(encoders, expected) {
+		t.Fatalf("expected %v, got %v", expected, encoders)
+	}
+}
+
+func TestTranscodeJobArgs(t *testing.T) {
+	job := TranscodeJob{
+		InputFilePath:    "in.mp4",
+		Resolution:       "720p",
+		Width:            1280,
+		Height:           720,
+		VideoEncoder:     "libx264",
+		AudioEncoder:     "aac",
+		SegmentTime:      10,
+		SegmentPattern:   "out/video_720p_%03d.ts",
+		PlaylistFilePath: "out/playlist_720p.m3u8",
+	}
+
+	expected := []string{
+		"-i", "in.mp4",
+		"-vf", "scale=1280:720,setsar=1",
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-map", "0:v:0",
+		"-map", "0:a?",
+		"-f", "hls",
+		"-hls_time", "10",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", "out/video_720p_%03d.ts",
+		"-hls_segment_type", "mpegts",
+		"out/playlist_720p.m3u8",
+	}
+
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+
+	job.Packaging = PackagingCMAF
+	job.SegmentPattern = "out/video_720p_%03d.m4s"
+	job.InitFileName = "init_720p.mp4"
+
+	args := job.ffmpegArgs()
+	expectedTail := []string{
+		"-hls_segment_filename", "out/video_720p_%03d.m4s",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init_720p.mp4",
+	}
+
+	if args[len(args)-1] != "out/playlist_720p.m3u8" || !reflect.DeepEqual(args[len(args)-7:len(args)-1], expectedTail) {
+		t.Fatalf("unexpected CMAF args: %v", args)
+	}
+
+	job.SingleFile = true
+	job.SegmentPattern = "out/video_720p.m4s"
+	job.InitFileName = ""
+
+	args = job.ffmpegArgs()
+	expectedTail = []string{
+		"-hls_segment_filename", "out/video_720p.m4s",
+		"-hls_segment_type", "fmp4",
+		"-hls_flags", "single_file",
+	}
+
+	if !reflect.DeepEqual(args[len(args)-7:len(args)-1], expectedTail) {
+		t.Fatalf("unexpected single file args: %v", args)
+	}
+}
+
+func TestTranscodeJobArgsSeparateAudio(t *testing.T) {
+	video := TranscodeJob{
+		InputFilePath:    "in.mp4",
+		Height:           720,
+		VideoEncoder:     "libx264",
+		NoAudio:          true,
+		SegmentTime:      10,
+		SegmentPattern:   "out/video_720p_%03d.ts",
+		PlaylistFilePath: "out/playlist_720p.m3u8",
+	}
+
+	expected := []string{"-i", "in.mp4", "-vf", "scale=-2:720,setsar=1", "-c:v", "libx264", "-map", "0:v:0", "-an", "-f", "hls"}
+	if args := video.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("unexpected video args: %v", args)
+	}
+
+	audio := TranscodeJob{
+		InputFilePath:    "in.mp4",
+		Packaging:        PackagingCMAF,
+		AudioOnly:        true,
+		AudioStream:      1,
+		AudioEncoder:     "aac",
+		AudioBitrate:     128000,
+		SegmentTime:      10,
+		SegmentPattern:   "out/audio_1_%03d.m4s",
+		InitFileName:     "init_audio_1.mp4",
+		PlaylistFilePath: "out/playlist_audio_1.m3u8",
+	}
+
+	expected = []string{"-i", "in.mp4", "-map", "0:a:1", "-vn", "-c:a", "aac", "-b:a", "128000", "-f", "hls"}
+	if args := audio.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("unexpected audio args: %v", args)
+	}
+}
+
+func TestFrameJobArgs(t *testing.T) {
+	job := FrameJob{InputFilePath: "in.mp4", Time: 12.5, Width: 320, Format: ImageFormatWebP, OutputFilePath: "out/poster_320.webp"}
+
+	expected := []string{
+		"-v", "error",
+		"-ss", "12.500",
+		"-i", "in.mp4",
+		"-frames:v", "1",
+		"-vf", "scale=320:-2,setsar=1",
+		"-c:v", "libwebp", "-quality", "80",
+		"-y", "out/poster_320.webp",
+	}
+
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+}
+
+func TestSpriteJobArgs(t *testing.T) {
+	job := SpriteJob{InputFilePath: "in.mp4", Interval: 2.5, Width: 160, Height: 90, Columns: 10, Rows: 5, OutputPattern: "out/sprite_%03d.jpg"}
+
+	expected := []string{
+		"-v", "error",
+		"-i", "in.mp4",
+		"-vf", "fps=1/2.5,scale=160:90,setsar=1,tile=10x5",
+		"-q:v", "4",
+		"-start_number", "0",
+		"-y", "out/sprite_%03d.jpg",
+	}
+
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+}
+
+func TestParseProbeOutput(t *testing.T) {
+	output := `{
+  "streams": [
+    {"index": 0, "codec_type": "audio", "codec_name": "aac", "channels": 2, "sample_rate": "48000", "tags": {"language": "por"}},
+    {"index": 1, "codec_type": "video", "codec_name": "mjpeg", "width": 320, "height": 320, "disposition": {"attached_pic": 1}},
+    {
+      "index": 2, "codec_type": "video", "codec_name": "h264", "profile": "High",
+      "width": 1920, "height": 1080, "sample_aspect_ratio": "1:1", "pix_fmt": "yuv420p",
+      "avg_frame_rate": "30000/1001", "r_frame_rate": "30/1",
+      "color_space": "bt709", "color_transfer": "bt709", "color_primaries": "bt709", "color_range": "tv",
+      "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]
+    },
+    {"index": 3, "codec_type": "audio", "codec_name": "ac3", "channels": 6, "sample_rate": "44100", "tags": {"LANGUAGE": "eng", "title": "Surround"}, "disposition": {"default": 1}},
+    {"index": 4, "codec_type": "audio", "codec_name": "aac", "channels": 1, "sample_rate": "44100", "tags": {"language": "und"}, "disposition": {"default": 1}},
+    {"index": 5, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}},
+    {"index": 6, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "por"}}
+  ],
+  "format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "234.500000", "bit_rate": "5000000"}
+}`
+
+	metadata, err := parseProbeOutput([]byte(output))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := VideoMetadata{
+		Width:           1920,
+		Height:          1080,
+		SampleAspect:    "1:1",
+		Duration:        234.5,
+		Container:       "mov,mp4,m4a,3gp,3g2,mj2",
+		VideoCodec:      "h264",
+		VideoProfile:    "High",
+		FrameRate:       30000.0 / 1001.0,
+		Bitrate:         5000000,
+		PixelFormat:     "yuv420p",
+		Rotation:        90,
+		ColorSpace:      "bt709",
+		ColorTransfer:   "bt709",
+		ColorPrimaries:  "bt709",
+		ColorRange:      "tv",
+		AudioCodec:      "aac",
+		AudioChannels:   2,
+		AudioSampleRate: 48000,
+		AudioTracks: []AudioTrack{
+			{Index: 0, Codec: "aac", Channels: 2, SampleRate: 48000, Language: "pt"},
+			{Index: 1, Codec: "ac3", Channels: 6, SampleRate: 44100, Language: "en", Title: "Surround", Default: true},
+			{Index: 2, Codec: "aac", Channels: 1, SampleRate: 44100},
+		},
+		SubtitleTracks: []SubtitleStream{
+			{Index: 0, Codec: "subrip", Language: "en", Default: true},
+			{Index: 1, Codec: "subrip", Language: "pt"},
+		},
+	}
+
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, metadata)
+	}
+}
+
+func TestParseProbeOutputFallbacks(t *testing.T) {
+	output := `{
+  "streams": [
+    {"codec_type": "video", "codec_name": "vp9", "width": 640, "height": 360, "avg_frame_rate": "0/0", "r_frame_rate": "25/1", "duration": "12.0", "bit_rate": "800000", "tags": {"rotate": "-90"}}
+  ],
+  "format": {"format_name": "matroska,webm", "duration": "N/A"}
+}`
+
+	metadata, err := parseProbeOutput([]byte(output))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if metadata.Duration != 12 || metadata.FrameRate != 25 || metadata.Bitrate != 800000 || metadata.Rotation != 270 {
+		t.Fatalf("unexpected metadata: %+v", metadata)
+	}
+
+	if metadata.AudioCodec != "" || metadata.AudioChannels != 0 {
+		t.Fatalf("expected no audio, got %+v", metadata)
+	}
+}
+
+func TestParseProbeOutputWithoutVideo(t *testing.T) {
+	output := `{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {"duration": "3.0"}}`
+
+	if _, err := parseProbeOutput([]byte(output)); err == nil {
+		t.Fatal("expected error for audio-only input")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ByteRange is a sub-range of a resource, as in EXT-X-BYTERANGE. Offsets left
+// implicit in the playlist are resolved when parsing.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d@%d", r.Length, r.Offset)
+}
+
+// parseByteRange reads "<length>[@<offset>]", using next when the offset is
+// omitted.
+func parseByteRange(value string, next int64) (*ByteRange, error) {
+	lengthValue, offsetValue, hasOffset := strings.Cut(value, "@")
+
+	length, err := strconv.ParseInt(lengthValue, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("playlist byte range error: %v", err)
+	}
+
+	offset := next
+	if hasOffset {
+		offset, err = strconv.ParseInt(offsetValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("playlist byte range error: %v", err)
+		}
+	}
+
+	return &ByteRange{Length: length, Offset: offset}, nil
+}
+
+type MediaSegment struct {
+	URI       string
+	Duration  float64
+	KeyURI    string
+	ByteRange *ByteRange
+}
+
+// MediaPlaylist is the subset of an HLS media playlist written by ffmpeg that
+// the server needs to re-publish it with signed URLs.
+type MediaPlaylist struct {
+	TargetDuration int
+	Map            string
+	MapByteRange   *ByteRange
+	Segments       []MediaSegment
+}
+
+func ParseMediaPlaylist(data []byte) (*MediaPlaylist, error) {
+	playlist := &MediaPlaylist{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	duration := -1.0
+
+	// A byte range without offset continues the previous range of the same
+	// resource, which is only known once the URI line is read.
+	var byteRange string
+	rangeEnds := make(map[string]int64)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			target, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+			if err != nil {
+				return nil, fmt.Errorf("playlist target duration error: %v", err)
+			}
+			playlist.TargetDuration = target
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attributes := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			playlist.Map = attributes["URI"]
+
+			if value, ok := attributes["BYTERANGE"]; ok {
+				mapRange, err := parseByteRange(value, 0)
+				if err != nil {
+					return nil, err
+				}
+
+				playlist.MapByteRange = mapRange
+				rangeEnds[playlist.Map] = mapRange.Offset + mapRange.Length
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			byteRange = strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			segmentDuration, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("playlist segment duration error: %v", err)
+			}
+			duration = segmentDuration
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if duration < 0 {
+				return nil, fmt.Errorf("playlist segment without duration: %s", line)
+			}
+
+			segment := MediaSegment{
+				URI:      line,
+				Duration: duration,
+			}
+
+			if byteRange != "" {
+				segmentRange, err := parseByteRange(byteRange, rangeEnds[line])
+				if err != nil {
+					return nil, err
+				}
+
+				segment.ByteRange = segmentRange
+				rangeEnds[line] = segmentRange.Offset + segmentRange.Length
+			}
+
+			playlist.Segments = append(playlist.Segments, segment)
+			duration = -1
+			byteRange = ""
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if playlist.TargetDuration == 0 {
+		for _, segment := range playlist.Segments {
+			playlist.TargetDuration = int(math.Max(float64(playlist.TargetDuration), math.Ceil(segment.Duration)))
+		}
+	}
+
+	return playlist, nil
+}
+
+// Render writes the playlist replacing every URI (segments and init segment)
+// with the result of sign, called once per distinct URI so single-file
+// renditions need one signature. Playlists with an init segment are fragmented
+// MP4 and need version 7 for EXT-X-MAP outside I-frame playlists; byte ranges
+// need version 4. The init segment is written before any EXT-X-KEY, as it is
+// stored in the clear.
+func (p *MediaPlaylist) Render(sign func(uri string) (string, error)) (string, error) {
+	var manifest strings.Builder
+
+	signed := make(map[string]string)
+	signOnce := func(uri string) (string, error) {
+		if url, ok := signed[uri]; ok {
+			return url, nil
+		}
+
+		url, err := sign(uri)
+		if err != nil {
+			return "", err
+		}
+
+		signed[uri] = url
+		return url, nil
+	}
+
+	manifest.WriteString("#EXTM3U\n")
+
+	switch {
+	case p.Map != "":
+		manifest.WriteString("#EXT-X-VERSION:7\n")
+	case p.HasByteRanges():
+		manifest.WriteString("#EXT-X-VERSION:4\n")
+	default:
+		manifest.WriteString("#EXT-X-VERSION:3\n")
+	}
+
+	manifest.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", p.TargetDuration))
+	manifest.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	manifest.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	if p.Map != "" {
+		manifest.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+		signedMap, err := signOnce(p.Map)
+		if err != nil {
+			return "", err
+		}
+
+		if p.MapByteRange != nil {
+			manifest.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=%q,BYTERANGE=\"%s\"\n", signedMap, p.MapByteRange))
+		} else {
+			manifest.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=%q\n", signedMap))
+		}
+	}
+
+	keyURI := ""
+
+	for _, segment := range p.Segments {
+		// Segments without IV use their media sequence number, so a key tag
+		// is only needed when the key changes.
+		if segment.KeyURI != keyURI {
+			manifest.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=%q\n", segment.KeyURI))
+			keyURI = segment.KeyURI
+		}
+
+		signedSegment, err := signOnce(segment.URI)
+		if err != nil {
+			return "", err
+		}
+
+		manifest.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", segment.Duration))
+
+		if segment.ByteRange != nil {
+			manifest.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%s\n", segment.ByteRange))
+		}
+
+		manifest.WriteString(signedSegment + "\n")
+	}
+
+	manifest.WriteString("#EXT-X-ENDLIST\n")
+
+	return manifest.String(), nil
+}
+
+// HasByteRanges reports whether segments are sub-ranges of larger files, as
+// written by ffmpeg's single_file flag.
+func (p *MediaPlaylist) HasByteRanges() bool {
+	for _, segment := range p.Segments {
+		if segment.ByteRange != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+type MasterVariant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Width            int
+	Height           int
+	Codecs           string
+	FrameRate        float64
+	Audio            string
+	Subtitles        string
+}
+
+// MediaRendition is an EXT-X-MEDIA audio or subtitles rendition shared by the
+// variants whose group of the same type matches its GroupID.
+type MediaRendition struct {
+	Type     string
+	GroupID  string
+	Name     string
+	Language string
+	Default  bool
+	Forced   bool
+	Channels int
+	URI      string
+}
+
+// RenderMasterPlaylist lists every variant with the attributes players use to
+// choose between them. Players skip variants whose CODECS they cannot decode,
+// so HEVC/VP9/AV1 renditions sit alongside H.264 without breaking old clients.
+func RenderMasterPlaylist(media []MediaRendition, variants []MasterVariant) string {
+	var manifest strings.Builder
+
+	manifest.WriteString("#EXTM3U\n")
+	manifest.WriteString("#EXT-X-VERSION:7\n")
+	manifest.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	for _, rendition := range media {
+		attributes := []string{
+			fmt.Sprintf("TYPE=%s", rendition.Type),
+			fmt.Sprintf("GROUP-ID=%q", rendition.GroupID),
+			fmt.Sprintf("NAME=%q", rendition.Name),
+		}
+
+		if rendition.Language != "" {
+			attributes = append(attributes, fmt.Sprintf("LANGUAGE=%q", rendition.Language))
+		}
+
+		attributes = append(attributes, fmt.Sprintf("DEFAULT=%s", hlsBool(rendition.Default)), "AUTOSELECT=YES")
+
+		if rendition.Type == "SUBTITLES" {
+			attributes = append(attributes, fmt.Sprintf("FORCED=%s", hlsBool(rendition.Forced)))
+		}
+
+		if rendition.Channels > 0 {
+			attributes = append(attributes, fmt.Sprintf("CHANNELS=\"%d\"", rendition.Channels))
+		}
+
+		attributes = append(attributes, fmt.Sprintf("URI=%q", rendition.URI))
+
+		manifest.WriteString(fmt.Sprintf("#EXT-X-MEDIA:%s\n", strings.Join(attributes, ",")))
+	}
+
+	for _, variant := range variants {
+		attributes := []string{fmt.Sprintf("BANDWIDTH=%d", variant.Bandwidth)}
+
+		if variant.AverageBandwidth > 0 {
+			attributes = append(attributes, fmt.Sprintf("AVERAGE-BANDWIDTH=%d", variant.AverageBandwidth))
+		}
+
+		if variant.Width > 0 && variant.Height > 0 {
+			attributes = append(attributes, fmt.Sprintf("RESOLUTION=%dx%d", variant.Width, variant.Height))
+		}
+
+		if variant.FrameRate > 0 {
+			attributes = append(attributes, fmt.Sprintf("FRAME-RATE=%.3f", variant.FrameRate))
+		}
+
+		if variant.Codecs != "" {
+			attributes = append(attributes, fmt.Sprintf("CODECS=%q", variant.Codecs))
+		}
+
+		if variant.Audio != "" {
+			attributes = append(attributes, fmt.Sprintf("AUDIO=%q", variant.Audio))
+		}
+
+		if variant.Subtitles != "" {
+			attributes = append(attributes, fmt.Sprintf("SUBTITLES=%q", variant.Subtitles))
+		}
+
+		manifest.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attributes, ","), variant.URI))
+	}
+
+	return manifest.String()
+}
+
+func hlsBool(value bool) string {
+	if value {
+		return "YES"
+	}
+
+	return "NO"
+}
+
+// parseAttributes reads an HLS attribute list such as
+// URI="init.mp4",BYTERANGE="720@0". Quoted values may contain commas.
+func parseAttributes(list string) map[string]string {
+	attributes := make(map[string]string)
+
+	for len(list) > 0 {
+		key, rest, found := strings.Cut(list, "=")
+		if !found {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+
+		attributes[strings.TrimSpace(key)] = value
+		list = strings.TrimPrefix(rest, ",")
+	}
+
+	return attributes
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaPlaylist(t *testing.T) {
+	data := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:11
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init_720p.mp4"
+#EXTINF:10.010000,
+video_720p_000.m4s
+#EXTINF:4.504500,
+video_720p_001.m4s
+#EXT-X-ENDLIST
+`
+
+	playlist, err := ParseMediaPlaylist([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &MediaPlaylist{
+		TargetDuration: 11,
+		Map:            "init_720p.mp4",
+		Segments: []MediaSegment{
+			{URI: "video_720p_000.m4s", Duration: 10.01},
+			{URI: "video_720p_001.m4s", Duration: 4.5045},
+		},
+	}
+
+	if !reflect.DeepEqual(playlist, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, playlist)
+	}
+}
+
+func TestParseMediaPlaylistWithoutTargetDuration(t *testing.T) {
+	playlist, err := ParseMediaPlaylist([]byte("#EXTM3U\n#EXTINF:9.8,\na.ts\n#EXTINF:10.2,\nb.ts\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if playlist.TargetDuration != 11 {
+		t.Fatalf("expected target duration 11, got %d", playlist.TargetDuration)
+	}
+}
+
+func TestParseMediaPlaylistSegmentWithoutDuration(t *testing.T) {
+	if _, err := ParseMediaPlaylist([]byte("#EXTM3U\na.ts\n")); err == nil {
+		t.Fatal("expected error for segment without EXTINF")
+	}
+}
+
+func TestRenderMediaPlaylistCMAF(t *testing.T) {
+	playlist := &MediaPlaylist{
+		TargetDuration: 10,
+		Map:            "init_720p.mp4",
+		Segments: []MediaSegment{
+			{URI: "video_720p_000.m4s", Duration: 10},
+		},
+	}
+
+	manifest, err := playlist.Render(func(uri string) (string, error) {
+		return "https://signed.test/" + uri, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="https://signed.test/init_720p.mp4"
+#EXTINF:10.000000,
+https://signed.test/video_720p_000.m4s
+#EXT-X-ENDLIST
+`
+
+	if manifest != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, manifest)
+	}
+}
+
+func TestRenderMediaPlaylistTS(t *testing.T) {
+	playlist := &MediaPlaylist{
+		TargetDuration: 10,
+		Segments:       []MediaSegment{{URI: "video_360p_000.ts", Duration: 10}},
+	}
+
+	manifest, err := playlist.Render(func(uri string) (string, error) {
+		return uri, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(manifest, "#EXT-X-VERSION:3\n") || strings.Contains(manifest, "#EXT-X-MAP") {
+		t.Fatalf("unexpected TS manifest:\n%s", manifest)
+	}
+}
+
+func TestParseMediaPlaylistByteRanges(t *testing.T) {
+	data := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="video_720p.m4s",BYTERANGE="800@0"
+#EXTINF:10.000000,
+#EXT-X-BYTERANGE:1000@800
+video_720p.m4s
+#EXTINF:5.000000,
+#EXT-X-BYTERANGE:500
+video_720p.m4s
+#EXT-X-ENDLIST
+`
+
+	playlist, err := ParseMediaPlaylist([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &MediaPlaylist{
+		TargetDuration: 10,
+		Map:            "video_720p.m4s",
+		MapByteRange:   &ByteRange{Length: 800, Offset: 0},
+		Segments: []MediaSegment{
+			{URI: "video_720p.m4s", Duration: 10, ByteRange: &ByteRange{Length: 1000, Offset: 800}},
+			{URI: "video_720p.m4s", Duration: 5, ByteRange: &ByteRange{Length: 500, Offset: 1800}},
+		},
+	}
+
+	if !reflect.DeepEqual(playlist, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, playlist)
+	}
+
+	if _, err := ParseMediaPlaylist([]byte("#EXTM3U\n#EXTINF:10,\n#EXT-X-BYTERANGE:abc\na.ts\n")); err == nil {
+		t.Fatal("expected error for invalid byte range")
+	}
+}
+
+func TestRenderMediaPlaylistByteRanges(t *testing.T) {
+	playlist := &MediaPlaylist{
+		TargetDuration: 10,
+		Segments: []MediaSegment{
+			{URI: "video_360p.ts", Duration: 10, ByteRange: &ByteRange{Length: 1000, Offset: 0}},
+			{URI: "video_360p.ts", Duration: 10, ByteRange: &ByteRange{Length: 900, Offset: 1000}},
+		},
+	}
+
+	signatures := 0
+	manifest, err := playlist.Render(func(uri string) (string, error) {
+		signatures++
+		return "https://signed.test/" + uri, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:10.000000,
+#EXT-X-BYTERANGE:1000@0
+https://signed.test/video_360p.ts
+#EXTINF:10.000000,
+#EXT-X-BYTERANGE:900@1000
+https://signed.test/video_360p.ts
+#EXT-X-ENDLIST
+`
+
+	if manifest != expected || signatures != 1 {
+		t.Fatalf("expected one signature and:\n%s\ngot %d and:\n%s", expected, signatures, manifest)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attributes := parseAttributes(`METHOD=AES-128,URI="https://keys.test/k?a=1,b=2",IV=0x1234`)
+
+	expected := map[string]string{
+		"METHOD": "AES-128",
+		"URI":    "https://keys.test/k?a=1,b=2",
+		"IV":     "0x1234",
+	}
+
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Fatalf("expected %v, got %v", expected, attributes)
+	}
+}
+
+func TestRenderMasterPlaylist(t *testing.T) {
+	manifest := RenderMasterPlaylist(nil, []MasterVariant{
+		{URI: "https://cdn.test/360p.m3u8", Bandwidth: 900000, Width: 640, Height: 360},
+		{URI: "https://cdn.test/1080p.m3u8", Bandwidth: 4500000, AverageBandwidth: 3900000, Width: 1920, Height: 1080, Codecs: "hvc1.1.6.L120.B0,mp4a.40.2", FrameRate: 30},
+	})
+
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=900000,RESOLUTION=640x360\n" +
+		"https://cdn.test/360p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=4500000,AVERAGE-BANDWIDTH=3900000,RESOLUTION=1920x1080,FRAME-RATE=30.000,CODECS=\"hvc1.1.6.L120.B0,mp4a.40.2\"\n" +
+		"https://cdn.test/1080p.m3u8\n"
+
+	if manifest != expected {
+		t.Fatalf("unexpected master playlist:\n%s", manifest)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type ImageFormat string
+
+const (
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatWebP ImageFormat = "webp"
+)
+
+type ImageKind string
+
+const (
+	ImageKindPoster    ImageKind = "poster"
+	ImageKindThumbnail ImageKind = "thumbnail"
+)
+
+// blackFrameLuma is the mean luminance (0-255) under which a candidate poster
+// frame is considered black, close to ffmpeg's blackdetect default of 10%.
+const blackFrameLuma = 24
+
+// posterCandidates are the fractions of the duration sampled when looking
+// for a poster frame that is not black.
+var posterCandidates = []float64{0.1, 0.2, 0.3, 0.4, 0.5}
+
+type ThumbnailSettings struct {
+	Disabled   bool        `yaml:"disabled"`
+	PosterTime float64     `yaml:"poster_time"`
+	Count      int         `yaml:"count"`
+	Format     ImageFormat `yaml:"format"`
+	Widths     []int       `yaml:"widths"`
+}
+
+// Image is a poster or thumbnail uploaded next to the renditions. Url is
+// signed on demand when the video is read.
+type Image struct {
+	Kind              ImageKind
+	Index             int
+	Time              float64
+	Width             int
+	Height            int
+	Format            ImageFormat
+	Path              string
+	Checksum          string
+	Url               string
+	UrlExpirationTime time.Time
+}
+
+type FrameJob struct {
+	InputFilePath  string
+	Time           float64
+	Width          int
+	Height         int
+	Format         ImageFormat
+	Overlay        *OverlayProfile
+	OutputFilePath string
+}
+
+// NormalizeThumbnailSettings fills defaults (5 JPEG thumbnails, 320 and 640
+// pixels wide, smart poster selection) and rejects unknown formats or sizes.
+func NormalizeThumbnailSettings(settings ThumbnailSettings) (ThumbnailSettings, error) {
+	if settings.Count == 0 {
+		settings.Count = 5
+	}
+
+	if settings.Format == "" {
+		settings.Format = ImageFormatJPEG
+	}
+
+	if len(settings.Widths) == 0 {
+		settings.Widths = []int{320, 640}
+	}
+
+	if settings.Format != ImageFormatJPEG && settings.Format != ImageFormatWebP {
+		return settings, fmt.Errorf("thumbnails: invalid format %q", settings.Format)
+	}
+
+	if settings.Count < 0 || settings.PosterTime < 0 {
+		return settings, fmt.Errorf("thumbnails: count and poster time must not be negative")
+	}
+
+	for _, width := range settings.Widths {
+		if width <= 0 {
+			return settings, fmt.Errorf("thumbnails: invalid width %d", width)
+		}
+	}
+
+	return settings, nil
+}
+
+func (f ImageFormat) Extension() string {
+	if f == ImageFormatWebP {
+		return "webp"
+	}
+
+	return "jpg"
+}
+
+func PosterName(videoUUID string, width int, format ImageFormat) string {
+	return fmt.Sprintf("%s/poster_%d.%s", videoUUID, width, format.Extension())
+}
+
+func ThumbnailName(videoUUID string, index int, width int, format ImageFormat) string {
+	return fmt.Sprintf("%s/thumbnail_%03d_%d.%s", videoUUID, index, width, format.Extension())
+}
+
+// ImageSize scales the displayed picture to the given width, keeping the
+// aspect ratio after rotation and sample aspect ratio. Without source
+// dimensions the height is left to ffmpeg (0).
+func ImageSize(metadata VideoMetadata, width int) (int, int) {
+	displayWidth, displayHeight := displaySize(metadata)
+	if displayWidth == 0 || displayHeight == 0 {
+		return width, 0
+	}
+
+	return width, evenDimension(float64(width) * displayHeight / displayWidth)
+}
+
+// ThumbnailTimes spreads count thumbnails evenly, away from both ends.
+func ThumbnailTimes(duration float64, count int) []float64 {
+	times := make([]float64, 0, count)
+
+	for i := 0; i < count; i++ {
+		times = append(times, duration*float64(i+1)/float64(count+1))
+	}
+
+	return times
+}
+
+// frameLuma returns the mean luminance (0-255) of an encoded frame.
+func frameLuma(data []byte) (float64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("frame decode error: %v", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0, nil
+	}
+
+	var total float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+
+	return total / float64(bounds.Dx()*bounds.Dy()), nil
+}
+
+// selectPosterTime returns the configured poster time or, when unset, the
+// first sampled frame that is not black, falling back to the brightest one.
+// Candidates are small JPEGs so they can be decoded without cgo.
+func selectPosterTime(ctx context.Context, transcoder Transcoder, request ProcessRequest, outputDir string) (float64, error) {
+	duration := request.Metadata.Duration
+
+	if request.Thumbnails.PosterTime > 0 {
+		if duration > 0 {
+			return min(request.Thumbnails.PosterTime, duration), nil
+		}
+
+		return request.Thumbnails.PosterTime, nil
+	}
+
+	if duration <= 0 {
+		return 0, nil
+	}
+
+	best, bestLuma := 0.0, -1.0
+
+	for i, fraction := range posterCandidates {
+		job := FrameJob{
+			InputFilePath:  request.InputFilePath,
+			Time:           duration * fraction,
+			Width:          64,
+			Format:         ImageFormatJPEG,
+			OutputFilePath: filepath.Join(outputDir, fmt.Sprintf("poster_candidate_%d.jpg", i)),
+		}
+
+		if err := transcoder.ExtractFrame(ctx, job); err != nil {
+			return 0, err
+		}
+
+		data, err := os.ReadFile(job.OutputFilePath)
+		if err != nil {
+			return 0, fmt.Errorf("frame reading error %s: %v", job.OutputFilePath, err)
+		}
+
+		luma, err := frameLuma(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if luma >= blackFrameLuma {
+			return job.Time, nil
+		}
+
+		if luma > bestLuma {
+			best, bestLuma = job.Time, luma
+		}
+	}
+
+	return best, nil
+}
+
+// generateImages extracts the poster and thumbnails in every configured width
+// and uploads them.
+func generateImages(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage, outputDir string) ([]Image, error) {
+	settings := request.Thumbnails
+
+	posterTime, err := selectPosterTime(ctx, transcoder, request, outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]Image, 0)
+
+	for _, width := range settings.Widths {
+		poster, err := storeImage(ctx, transcoder, request, storages, outputDir, Image{
+			Kind:   ImageKindPoster,
+			Time:   posterTime,
+			Format: settings.Format,
+			Path:   PosterName(request.StoragePrefix(), width, settings.Format),
+		}, width)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, *poster)
+	}
+
+	// Without a known duration thumbnails cannot be spread over the video.
+	count := settings.Count
+	if request.Metadata.Duration <= 0 {
+		count = 0
+	}
+
+	for index, thumbnailTime := range ThumbnailTimes(request.Metadata.Duration, count) {
+		for _, width := range settings.Widths {
+			thumbnail, err := storeImage(ctx, transcoder, request, storages, outputDir, Image{
+				Kind:   ImageKindThumbnail,
+				Index:  index,
+				Time:   thumbnailTime,
+				Format: settings.Format,
+				Path:   ThumbnailName(request.StoragePrefix(), index, width, settings.Format),
+			}, width)
+			if err != nil {
+				return nil, err
+			}
+
+			images = append(images, *thumbnail)
+		}
+	}
+
+	return images, nil
+}
+
+func storeImage(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage, outputDir string, img Image, width int) (*Image, error) {
+	img.Width, img.Height = ImageSize(request.Metadata, width)
+
+	job := FrameJob{
+		InputFilePath:  request.InputFilePath,
+		Time:           img.Time,
+		Width:          img.Width,
+		Height:         img.Height,
+		Format:         img.Format,
+		Overlay:        request.Overlay,
+		OutputFilePath: filepath.Join(outputDir, filepath.Base(img.Path)),
+	}
+
+	if err := transcoder.ExtractFrame(ctx, job); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(job.OutputFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("frame reading error %s: %v", job.OutputFilePath, err)
+	}
+
+	checksums := make(map[string]string)
+	if err := storeObject(storages, img.Path, data, checksums); err != nil {
+		return nil, err
+	}
+
+	img.Checksum = checksums[img.Path]
+
+	return &img, nil
+}
+
+func (v *Video) IsImageExpired(index int, minRemaining time.Duration) bool {
+	return urlExpiresWithin(v.Images[index].UrlExpirationTime, minRemaining)
+}
+
+// adoptImageURLs copies the URLs signed on another copy of the video onto the
+// images stored at the same paths, so URLs signed for a generation that has
+// since been replaced are dropped.
+func (v *Video) adoptImageURLs(signed []Image) {
+	for i := range v.Images {
+		for _, image := range signed {
+			if image.Path == v.Images[i].Path && image.UrlExpirationTime.After(v.Images[i].UrlExpirationTime) {
+				v.Images[i].Url = image.Url
+				v.Images[i].UrlExpirationTime = image.UrlExpirationTime
+			}
+		}
+	}
+}
+
+// SignImages refreshes the signed URL of every image whose URL expires within
+// minRemaining and reports whether any changed.
+func (v *Video) SignImages(storage FileStorage, minRemaining time.Duration) (bool, error) {
+	changed := false
+
+	for i := range v.Images {
+		if v.Images[i].Url != "" && !v.IsImageExpired(i, minRemaining) {
+			continue
+		}
+
+		url, err := storage.SignedURL(v.Images[i].Path, storage.URLTTL())
+		if err != nil {
+			return changed, err
+		}
+
+		v.Images[i].Url = url
+		v.Images[i].UrlExpirationTime = time.Now().Add(storage.URLTTL())
+		changed = true
+	}
+
+	return changed, nil
+}
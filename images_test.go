@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeThumbnailSettings(t *testing.T) {
+	settings, err := NormalizeThumbnailSettings(ThumbnailSettings{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if settings.Count != 5 || settings.Format != ImageFormatJPEG || !reflect.DeepEqual(settings.Widths, []int{320, 640}) {
+		t.Fatalf("unexpected defaults: %+v", settings)
+	}
+
+	for _, invalid := range []ThumbnailSettings{
+		{Format: "gif"},
+		{Count: -1},
+		{Widths: []int{0}},
+	} {
+		if _, err := NormalizeThumbnailSettings(invalid); err == nil {
+			t.Fatalf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	portrait := VideoMetadata{Width: 1920, Height: 1080, Rotation: 90}
+
+	if width, height := ImageSize(portrait, 320); width != 320 || height != 568 {
+		t.Fatalf("expected 320x568, got %dx%d", width, height)
+	}
+
+	if width, height := ImageSize(VideoMetadata{}, 320); width != 320 || height != 0 {
+		t.Fatalf("expected height left to ffmpeg, got %dx%d", width, height)
+	}
+}
+
+func TestProcessVideoImagesSkipBlackPoster(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.FrameLuma = func(time float64) uint8 {
+		if time < 25 {
+			return 4
+		}
+
+		return 160
+	}
+
+	storage := NewMemoryFileStorage()
+	metadata := landscape
+	metadata.Duration = 100
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "360p", Resolution: "360p", Packaging: PackagingTS}},
+		Thumbnails:    ThumbnailSettings{Count: 3, Format: ImageFormatWebP, Widths: []int{320}},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(response.Images) != 4 {
+		t.Fatalf("expected a poster and 3 thumbnails, got %+v", response.Images)
+	}
+
+	poster := response.Images[0]
+	if poster.Kind != ImageKindPoster || poster.Time != 30 || poster.Width != 320 || poster.Height != 180 || poster.Path != "video-1/poster_320.webp" {
+		t.Fatalf("unexpected poster: %+v", poster)
+	}
+
+	thumbnail := response.Images[3]
+	if thumbnail.Kind != ImageKindThumbnail || thumbnail.Index != 2 || thumbnail.Time != 75 || thumbnail.Path != "video-1/thumbnail_002_320.webp" {
+		t.Fatalf("unexpected thumbnail: %+v", thumbnail)
+	}
+
+	for _, img := range response.Images {
+		if _, ok := storage.Object(img.Path); !ok || img.Checksum == "" {
+			t.Fatalf("expected %s to be uploaded with a checksum", img.Path)
+		}
+	}
+
+	// Three candidates were sampled before finding a frame that is not black.
+	if frames := transcoder.ExtractedFrames(); len(frames) != 7 || frames[3].Format != ImageFormatWebP {
+		t.Fatalf("unexpected frame jobs: %+v", frames)
+	}
+}
+
+func TestProcessVideoImagesFailureKeepsVideo(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.FailNth("ExtractFrame", 1, context.DeadlineExceeded)
+
+	metadata := landscape
+	metadata.Duration = 10
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "360p", Resolution: "360p", Packaging: PackagingTS}},
+		Thumbnails:    ThumbnailSettings{PosterTime: 3},
+	}, []FileStorage{NewMemoryFileStorage()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(response.Resolutions) != 1 || len(response.Images) != 0 {
+		t.Fatalf("expected the rendition without images, got %+v", response)
+	}
+}
+
+func TestGetVideoSignsImages(t *testing.T) {
+	video := readyVideo("video-1")
+	video.Images = []Image{
+		{Kind: ImageKindPoster, Path: "video-1/poster_320.jpg"},
+		{Kind: ImageKindThumbnail, Path: "video-1/thumbnail_000_320.jpg", Url: "https://cached.test/thumbnail", UrlExpirationTime: time.Now().Add(time.Hour)},
+	}
+
+	db := NewMemoryDatabase(video)
+	service := newTestService(NewMemoryFileStorage(), db)
+
+	result, err := service.GetVideo(context.Background(), video.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(result.Images[0].Url, "https://memory.test/video-1/poster_320.jpg") || result.Images[1].Url != "https://cached.test/thumbnail" {
+		t.Fatalf("unexpected image URLs: %+v", result.Images)
+	}
+
+	saved, _ := db.GetVideo(context.Background(), video.ID)
+	if saved.Images[0].Url != result.Images[0].Url || db.Calls("SaveVideo") != 0 {
+		t.Fatal("expected signed URL to be cached through an update")
+	}
+}
+
+func TestAdoptImageURLsSkipsReplacedImages(t *testing.T) {
+	signed := []Image{{Path: "video-1/poster_320.jpg", Url: "https://memory.test/video-1/poster_320.jpg", UrlExpirationTime: time.Now().Add(time.Hour)}}
+
+	current := Video{Images: []Image{{Path: "video-1/generation/poster_320.jpg"}}}
+	current.adoptImageURLs(signed)
+
+	if current.Images[0].Url != "" {
+		t.Fatalf("expected no URL for an image of another generation, got %s", current.Images[0].Url)
+	}
+}
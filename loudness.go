@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	defaultLoudnessSampleRate = 48000
+	defaultTruePeak           = -1.0
+)
+
+// LoudnessSettings are the EBU R128 targets audio is normalized to: the
+// integrated loudness in LUFS, the maximum true peak in dBTP and the loudness
+// range in LU. Zero values select the defaults, except for the true peak where
+// 0 dBTP is a valid ceiling and only an unset value does.
+type LoudnessSettings struct {
+	Enabled       bool     `yaml:"enabled"`
+	Target        float64  `yaml:"target"`
+	TruePeak      *float64 `yaml:"true_peak"`
+	LoudnessRange float64  `yaml:"lra"`
+}
+
+// Loudness is the measurement of a source audio track by the first loudnorm
+// pass.
+type Loudness struct {
+	Integrated    float64
+	TruePeak      float64
+	LoudnessRange float64
+	Threshold     float64
+	TargetOffset  float64
+}
+
+// LoudnessJob measures the AudioStream-th audio stream against Target.
+type LoudnessJob struct {
+	InputFilePath string
+	AudioStream   int
+	Target        LoudnessSettings
+}
+
+// LoudnessCorrection is the second loudnorm pass, bringing a track measured
+// at Measured to Target. loudnorm resamples to 192 kHz, so the output is
+// resampled back to SampleRate.
+type LoudnessCorrection struct {
+	Target     LoudnessSettings
+	Measured   Loudness
+	SampleRate int
+}
+
+// NormalizeLoudnessSettings fills the EBU R128 defaults (-23 LUFS, -1 dBTP,
+// 7 LU) and rejects values loudnorm does not accept.
+func NormalizeLoudnessSettings(settings LoudnessSettings) (LoudnessSettings, error) {
+	if settings.Target == 0 {
+		settings.Target = -23
+	}
+
+	if settings.TruePeak == nil {
+		truePeak := defaultTruePeak
+		settings.TruePeak = &truePeak
+	}
+
+	if settings.LoudnessRange == 0 {
+		settings.LoudnessRange = 7
+	}
+
+	if settings.Target < -70 || settings.Target > -5 {
+		return settings, fmt.Errorf("loudness: target must be between -70 and -5 LUFS")
+	}
+
+	if *settings.TruePeak < -9 || *settings.TruePeak > 0 {
+		return settings, fmt.Errorf("loudness: true_peak must be between -9 and 0 dBTP")
+	}
+
+	if settings.LoudnessRange < 1 || settings.LoudnessRange > 20 {
+		return settings, fmt.Errorf("loudness: lra must be between 1 and 20 LU")
+	}
+
+	return settings, nil
+}
+
+// loudnessCorrection returns the correction of a measured track, or nil when
+// normalization is disabled or the track could not be measured.
+func loudnessCorrection(settings LoudnessSettings, track AudioTrack) *LoudnessCorrection {
+	if !settings.Enabled || track.Loudness == nil {
+		return nil
+	}
+
+	sampleRate := track.SampleRate
+	if sampleRate <= 0 {
+		sampleRate = defaultLoudnessSampleRate
+	}
+
+	return &LoudnessCorrection{
+		Target:     settings,
+		Measured:   *track.Loudness,
+		SampleRate: sampleRate,
+	}
+}
+
+func (s LoudnessSettings) filter() string {
+	truePeak := defaultTruePeak
+	if s.TruePeak != nil {
+		truePeak = *s.TruePeak
+	}
+
+	return fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f", s.Target, truePeak, s.LoudnessRange)
+}
+
+// filter applies the measurement linearly when it allows reaching the target
+// without exceeding the true peak; loudnorm falls back to dynamic
+// normalization otherwise.
+func (c LoudnessCorrection) filter() string {
+	return fmt.Sprintf("%s:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true:print_format=none",
+		c.Target.filter(), c.Measured.Integrated, c.Measured.TruePeak, c.Measured.LoudnessRange, c.Measured.Threshold, c.Measured.TargetOffset)
+}
+
+type loudnormOutput struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// parseLoudnormOutput reads the JSON block loudnorm prints to stderr at the
+// end of the first pass. Silent tracks measure -inf and cannot be corrected.
+func parseLoudnormOutput(output string) (Loudness, error) {
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return Loudness{}, fmt.Errorf("loudness measurement error: no loudnorm output")
+	}
+
+	var measured loudnormOutput
+	if err := json.Unmarshal([]byte(output[start:end+1]), &measured); err != nil {
+		return Loudness{}, fmt.Errorf("loudness measurement parse error: %v", err)
+	}
+
+	loudness := Loudness{
+		Integrated:    parseFloat(measured.InputI),
+		TruePeak:      parseFloat(measured.InputTP),
+		LoudnessRange: parseFloat(measured.InputLRA),
+		Threshold:     parseFloat(measured.InputThresh),
+		TargetOffset:  parseFloat(measured.TargetOffset),
+	}
+
+	for _, value := range []float64{loudness.Integrated, loudness.TruePeak, loudness.LoudnessRange, loudness.Threshold, loudness.TargetOffset} {
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return Loudness{}, fmt.Errorf("loudness measurement error: silent track")
+		}
+	}
+
+	if measured.InputI == "" {
+		return Loudness{}, fmt.Errorf("loudness measurement error: no integrated loudness")
+	}
+
+	return loudness, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLoudnessSettings(t *testing.T) {
+	settings, err := NormalizeLoudnessSettings(LoudnessSettings{Enabled: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if settings.Target != -23 || settings.TruePeak == nil || *settings.TruePeak != -1 || settings.LoudnessRange != 7 {
+		t.Fatalf("unexpected defaults: %+v", settings)
+	}
+
+	ceiling := 0.0
+	if settings, err := NormalizeLoudnessSettings(LoudnessSettings{TruePeak: &ceiling}); err != nil || *settings.TruePeak != 0 {
+		t.Fatalf("expected a 0 dBTP ceiling to be kept, got %+v, %v", settings, err)
+	}
+
+	above := 1.0
+	for _, invalid := range []LoudnessSettings{{Target: -3}, {TruePeak: &above}, {LoudnessRange: 30}} {
+		if _, err := NormalizeLoudnessSettings(invalid); err == nil {
+			t.Fatalf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestParseLoudnormOutput(t *testing.T) {
+	output := `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'in.mp4':
+[Parsed_loudnorm_0 @ 0x5581]
+{
+	"input_i" : "-30.52",
+	"input_tp" : "-4.21",
+	"input_lra" : "6.10",
+	"input_thresh" : "-40.93",
+	"output_i" : "-23.01",
+	"output_tp" : "-1.00",
+	"output_lra" : "5.20",
+	"output_thresh" : "-33.37",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.01"
+}
+`
+
+	loudness, err := parseLoudnormOutput(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if loudness != (Loudness{Integrated: -30.52, TruePeak: -4.21, LoudnessRange: 6.1, Threshold: -40.93, TargetOffset: 0.01}) {
+		t.Fatalf("unexpected measurement: %+v", loudness)
+	}
+
+	silent := `{"input_i" : "-inf", "input_tp" : "-inf", "input_lra" : "0.00", "input_thresh" : "-70.00", "target_offset" : "inf"}`
+	if _, err := parseLoudnormOutput(silent); err == nil {
+		t.Fatal("expected silent tracks to be rejected")
+	}
+
+	if _, err := parseLoudnormOutput("Conversion failed!"); err == nil {
+		t.Fatal("expected missing output to be rejected")
+	}
+}
+
+func TestLoudnessArgs(t *testing.T) {
+	truePeak := -1.0
+	target := LoudnessSettings{Enabled: true, Target: -23, TruePeak: &truePeak, LoudnessRange: 7}
+
+	measure := LoudnessJob{InputFilePath: "in.mp4", AudioStream: 1, Target: target}
+	expected := []string{
+		"-hide_banner", "-nostats",
+		"-i", "in.mp4",
+		"-map", "0:a:1",
+		"-vn", "-sn", "-dn",
+		"-af", "loudnorm=I=-23.0:TP=-1.0:LRA=7.0:print_format=json",
+		"-f", "null",
+		"-",
+	}
+
+	if args := measure.ffmpegArgs(); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+
+	audio := TranscodeJob{
+		InputFilePath: "in.mp4",
+		AudioOnly:     true,
+		AudioStream:   1,
+		AudioEncoder:  "aac",
+		AudioBitrate:  128000,
+		Loudness: &LoudnessCorrection{
+			Target:     target,
+			Measured:   Loudness{Integrated: -30.52, TruePeak: -4.21, LoudnessRange: 6.1, Threshold: -40.93, TargetOffset: 0.01},
+			SampleRate: 44100,
+		},
+	}
+
+	expected = []string{
+		"-i", "in.mp4",
+		"-map", "0:a:1",
+		"-vn",
+		"-af", "loudnorm=I=-23.0:TP=-1.0:LRA=7.0:measured_I=-30.52:measured_TP=-4.21:measured_LRA=6.10:measured_thresh=-40.93:offset=0.01:linear=true:print_format=none",
+		"-ar", "44100",
+		"-c:a", "aac",
+		"-b:a", "128000",
+		"-f", "hls",
+	}
+
+	if args := audio.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("expected %v, got %v", expected, args[:len(expected)])
+	}
+}
+
+func TestProcessVideoLoudness(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.FailNth("MeasureLoudness", 2, errors.New("decoder crashed"))
+
+	metadata := landscape
+	metadata.AudioTracks = []AudioTrack{{Index: 0, Default: true}, {Index: 1, SampleRate: 44100}}
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Downloads:     DownloadSettings{Enabled: true},
+		Loudness:      LoudnessSettings{Enabled: true, Target: -16},
+	}, []FileStorage{NewMemoryFileStorage()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if transcoder.Calls("MeasureLoudness") != 2 || len(transcoder.LoudnessJobs) != 1 || *transcoder.LoudnessJobs[0].Target.TruePeak != -1 {
+		t.Fatalf("expected every track to be measured, got %+v", transcoder.LoudnessJobs)
+	}
+
+	for _, job := range transcoder.TranscodedJobs() {
+		if job.AudioOnly && (job.AudioStream == 0) != (job.Loudness != nil) {
+			t.Fatalf("expected only the measured track to be normalized, got %+v", job)
+		}
+	}
+
+	if correction := transcoder.Downloads[0].Loudness; correction == nil || correction.Target.Target != -16 || correction.SampleRate != 48000 {
+		t.Fatalf("expected the download to be normalized, got %+v", correction)
+	}
+
+	if len(response.Loudness) != 1 || response.Loudness[0] != transcoder.Measured {
+		t.Fatalf("unexpected measurements %+v", response.Loudness)
+	}
+
+	if metadata.AudioTracks[0].Loudness != nil {
+		t.Fatal("expected the request metadata not to be modified")
+	}
+
+	video := Video{VideoMetadata: metadata}
+	video.applyProcessedVideo(response)
+
+	if video.VideoMetadata.Loudness == nil || video.VideoMetadata.AudioTracks[0].Loudness == nil || video.VideoMetadata.AudioTracks[1].Loudness != nil {
+		t.Fatalf("expected the measurement on the metadata, got %+v", video.VideoMetadata)
+	}
+}
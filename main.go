@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gopkg.in/yaml.v2"
@@ -12,15 +15,35 @@ type Config struct {
 	BoltLocation string `yaml:"bolt_location"`
 	Storage      struct {
 		S3 struct {
-			Bucket string `yaml:"bucket"`
-			Region string `yaml:"region"`
+			Bucket string            `yaml:"bucket"`
+			Region string            `yaml:"region"`
+			URLTTL int               `yaml:"url_ttl"`
+			Signer URLSignerSettings `yaml:"signer"`
 		} `yaml:"s3"`
 		Google struct {
-			Bucket  string `yaml:"bucket"`
-			Project string `yaml:"project"`
-			Region  string `yaml:"region"`
+			Bucket  string            `yaml:"bucket"`
+			Project string            `yaml:"project"`
+			Region  string            `yaml:"region"`
+			URLTTL  int               `yaml:"url_ttl"`
+			Signer  URLSignerSettings `yaml:"signer"`
 		} `yaml:"google"`
 	} `yaml:"storage"`
+	SignedURLs struct {
+		MinRemaining int `yaml:"min_remaining"`
+	} `yaml:"signed_urls"`
+	Encoding struct {
+		Profiles    []EncodingProfile            `yaml:"profiles"`
+		ProfileSets map[string][]EncodingProfile `yaml:"profile_sets"`
+		Thumbnails  ThumbnailSettings            `yaml:"thumbnails"`
+		Sprites     SpriteSettings               `yaml:"sprites"`
+		Previews    PreviewSettings              `yaml:"previews"`
+		Downloads   DownloadSettings             `yaml:"downloads"`
+		Overlays    OverlaySettings              `yaml:"overlays"`
+		Loudness    LoudnessSettings             `yaml:"loudness"`
+	} `yaml:"encoding"`
+	Encryption EncryptionSettings `yaml:"encryption"`
+	Playback   PlaybackSettings   `yaml:"playback"`
+	Archive    ArchiveSettings    `yaml:"archive"`
 }
 
 func main() {
@@ -40,17 +63,79 @@ func main() {
 		log.Fatalf("Bolt location not set")
 	}
 
-	codecAvailable, err := SelectH264Encoder()
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s verify <video-id>", os.Args[0])
+		}
+
+		os.Exit(runVerify(config, os.Args[2]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s backfill <video-id|all> [profile-set]", os.Args[0])
+		}
+
+		profileSet := ""
+		if len(os.Args) > 3 {
+			profileSet = os.Args[3]
+		}
+
+		os.Exit(runBackfill(config, os.Args[2], profileSet))
+	}
+
+	ffmpeg := NewFFmpeg()
+
+	registry, err := DetectEncoders(context.Background(), ffmpeg)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Error detecting encoders: %v", err)
+	}
+
+	for _, codec := range registry.Families() {
+		encoder, _ := registry.Encoder(codec)
+		log.Printf("Codec %s available: %s", codec, encoder)
 	}
 
-	if codecAvailable == "" {
-		panic("H264 codec not available")
+	videoService := newVideoService(config, ffmpeg)
+
+	profiles := append([]EncodingProfile{}, videoService.Profiles...)
+	for _, set := range videoService.ProfileSets {
+		profiles = append(profiles, set...)
 	}
 
-	log.Printf("H264 codec available: %s", codecAvailable)
+	for _, profile := range profiles {
+		codec, encoder, err := registry.Resolve(profile)
+		if err != nil {
+			log.Fatalf("Error resolving encoder: %v", err)
+		}
+
+		if codec != profile.Codec {
+			log.Printf("Encoding profile %s: %s unavailable, falling back to %s (%s)", profile.Name, profile.Codec, codec, encoder)
+		}
+	}
 
+	api := NewAPI(*videoService)
+
+	router := gin.Default()
+	router.POST("upload", api.HandleUpload)
+	router.GET("video/:id", api.GetVideo)
+	router.GET("video/:id/manifest", api.GetVideoURL)
+	router.GET("video/:id/dash", api.GetDashURL)
+	router.GET("video/:id/dash/manifest.mpd", api.GetDashManifest)
+	router.POST("video/:id/subtitles", api.UploadSubtitles)
+	router.GET("video/:id/sprites", api.GetSpritesURL)
+	router.GET("video/:id/sprites/sprites.vtt", api.GetSpriteVTT)
+	router.GET("video/:id/key/:keyId", api.GetKey)
+	router.GET("video/:id/playback", api.CreatePlaybackToken)
+	router.GET("video/:id/hls/:playlist", api.GetPlaylist)
+	router.GET("video/:id/download", api.GetDownloadURL)
+	router.POST("video/:id/reprocess", api.ReprocessVideo)
+	router.POST("video/:id/clips", api.CreateClip)
+	router.POST("video/concat", api.CreateConcat)
+	router.Run(":8080")
+}
+
+func newVideoService(config Config, ffmpeg *FFmpeg) *VideoService {
 	storageClients, err := InitStorageClients(config)
 	fileStorages := make([]FileStorage, 0)
 
@@ -59,11 +144,25 @@ func main() {
 	}
 
 	if storageClients.AWS != nil {
-		fileStorages = append(fileStorages, NewS3FileStorage(storageClients.AWS, config.Storage.S3.Bucket))
+		s3Storage := NewS3FileStorage(storageClients.AWS, config.Storage.S3.Bucket, URLTTL(config.Storage.S3.URLTTL))
+
+		signer, err := NewURLSigner(config.Storage.S3.Signer, s3Storage)
+		if err != nil {
+			log.Fatalf("Error loading S3 URL signer: %v", err)
+		}
+
+		fileStorages = append(fileStorages, WithURLSigner(s3Storage, signer))
 	}
 
 	if storageClients.GCP != nil {
-		fileStorages = append(fileStorages, NewGCSFileStorage(storageClients.GCP, config.Storage.Google.Bucket))
+		gcsStorage := NewGCSFileStorage(storageClients.GCP, config.Storage.Google.Bucket, URLTTL(config.Storage.Google.URLTTL))
+
+		signer, err := NewURLSigner(config.Storage.Google.Signer, gcsStorage)
+		if err != nil {
+			log.Fatalf("Error loading GCS URL signer: %v", err)
+		}
+
+		fileStorages = append(fileStorages, WithURLSigner(gcsStorage, signer))
 	}
 
 	if len(fileStorages) == 0 {
@@ -72,14 +171,171 @@ func main() {
 
 	db := NewBoltDB(config.BoltLocation)
 
-	api := NewAPI(VideoService{
-		Storages: fileStorages,
-		Database: db,
-	})
+	profiles, err := NormalizeEncodingProfiles(config.Encoding.Profiles)
+	if err != nil {
+		log.Fatalf("Error loading encoding profiles: %v", err)
+	}
 
-	router := gin.Default()
-	router.POST("upload", api.HandleUpload)
-	router.GET("video/:id", api.GetVideo)
-	router.GET("video/:id/manifest", api.GetVideoURL)
-	router.Run(":8080")
+	thumbnails, err := NormalizeThumbnailSettings(config.Encoding.Thumbnails)
+	if err != nil {
+		log.Fatalf("Error loading thumbnail settings: %v", err)
+	}
+
+	videoService := NewVideoService(fileStorages, db, ffmpeg, ffmpeg, profiles)
+	videoService.Thumbnails = thumbnails
+
+	videoService.ProfileSets, err = NormalizeProfileSets(config.Encoding.ProfileSets)
+	if err != nil {
+		log.Fatalf("Error loading profile sets: %v", err)
+	}
+
+	if config.Archive.Enabled {
+		videoService.Archive, err = newArchiveStorage(config, storageClients)
+		if err != nil {
+			log.Fatalf("Error loading archive settings: %v", err)
+		}
+
+		videoService.ArchivePrefix = config.Archive.Prefix
+	}
+
+	videoService.Overlays, err = NormalizeOverlaySettings(config.Encoding.Overlays)
+	if err != nil {
+		log.Fatalf("Error loading overlay settings: %v", err)
+	}
+
+	videoService.Loudness, err = NormalizeLoudnessSettings(config.Encoding.Loudness)
+	if err != nil {
+		log.Fatalf("Error loading loudness settings: %v", err)
+	}
+
+	videoService.Sprites, err = NormalizeSpriteSettings(config.Encoding.Sprites)
+	if err != nil {
+		log.Fatalf("Error loading sprite settings: %v", err)
+	}
+
+	videoService.Previews, err = NormalizePreviewSettings(config.Encoding.Previews)
+	if err != nil {
+		log.Fatalf("Error loading preview settings: %v", err)
+	}
+
+	videoService.Downloads, err = NormalizeDownloadSettings(config.Encoding.Downloads)
+	if err != nil {
+		log.Fatalf("Error loading download settings: %v", err)
+	}
+
+	if config.SignedURLs.MinRemaining > 0 {
+		videoService.MinURLLifetime = time.Duration(config.SignedURLs.MinRemaining) * time.Second
+	}
+
+	if err := ValidateURLTTLs(fileStorages, videoService.MinURLLifetime); err != nil {
+		log.Fatalf("Error loading storage settings: %v", err)
+	}
+
+	// Key URIs are listed next to the segments, signed by the first storage.
+	videoService.Encryption = config.Encryption
+	videoService.Keys, err = NewKeyDelivery(config.Encryption, segmentURLTTL(fileStorages[0]))
+	if err != nil {
+		log.Fatalf("Error loading encryption settings: %v", err)
+	}
+
+	videoService.Playback, err = NewPlaybackTokens(config.Playback, segmentURLTTL(fileStorages[0]))
+	if err != nil {
+		log.Fatalf("Error loading playback settings: %v", err)
+	}
+
+	return videoService
+}
+
+func runVerify(config Config, videoID string) int {
+	videoService := newVideoService(config, NewFFmpeg())
+
+	report, err := videoService.VerifyVideo(context.Background(), videoID)
+	if err != nil {
+		log.Printf("Error verifying video: %v", err)
+		return 1
+	}
+
+	for _, object := range report.Objects {
+		switch {
+		case object.Error != "":
+			fmt.Printf("ERROR    %s %s: %s\n", object.Storage, object.Path, object.Error)
+		case !object.Valid():
+			fmt.Printf("MISMATCH %s %s: expected %s, got %s\n", object.Storage, object.Path, object.Expected, object.Actual)
+		default:
+			fmt.Printf("OK       %s %s\n", object.Storage, object.Path)
+		}
+	}
+
+	failures := report.Failures()
+	fmt.Printf("%d objects verified, %d failures\n", len(report.Objects), len(failures))
+
+	if len(failures) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runBackfill adds the missing renditions of a profile set to one video, or
+// to every video with "all".
+func runBackfill(config Config, videoID string, profileSet string) int {
+	videoService := newVideoService(config, NewFFmpeg())
+	ctx := context.Background()
+
+	videoIDs := []string{videoID}
+	if videoID == "all" {
+		var err error
+
+		videoIDs, err = allVideoIDs(ctx, videoService.Database)
+		if err != nil {
+			log.Printf("Error listing videos: %v", err)
+			return 1
+		}
+	}
+
+	failures := 0
+
+	for _, id := range videoIDs {
+		added, err := videoService.BackfillVideo(ctx, id, profileSet)
+		if err != nil {
+			fmt.Printf("ERROR    %s: %v\n", id, err)
+			failures++
+			continue
+		}
+
+		for _, resolution := range added {
+			fmt.Printf("ADDED    %s %s\n", id, resolution.Resolution)
+		}
+
+		if len(added) == 0 {
+			fmt.Printf("OK       %s\n", id)
+		}
+	}
+
+	fmt.Printf("%d videos backfilled, %d failures\n", len(videoIDs), failures)
+
+	if failures > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func allVideoIDs(ctx context.Context, database Database) ([]string, error) {
+	videoIDs := make([]string, 0)
+
+	for page := 1; ; page++ {
+		videos, err := database.GetVideos(ctx, page, 100)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, video := range videos.Items {
+			videoIDs = append(videoIDs, video.ID)
+		}
+
+		if page >= videos.TotalPages {
+			return videoIDs, nil
+		}
+	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// CodecsFromInitSegment builds the RFC 6381 codecs string ("avc1.64001f,mp4a.40.2")
+// of a fragmented MP4 from the sample entries found in its init segment.
+// Players need it to pick a representation before downloading any media.
+func CodecsFromInitSegment(init []byte) string {
+	codecs := make([]string, 0)
+
+	if avcC := boxPayload(init, "avcC"); len(avcC) >= 4 {
+		codecs = append(codecs, fmt.Sprintf("avc1.%02x%02x%02x", avcC[1], avcC[2], avcC[3]))
+	}
+
+	if hvcC := boxPayload(init, "hvcC"); len(hvcC) >= 13 {
+		codecs = append(codecs, hevcCodec(init, hvcC))
+	}
+
+	if vpcC := boxPayload(init, "vpcC"); len(vpcC) >= 7 {
+		codecs = append(codecs, fmt.Sprintf("vp09.%02d.%02d.%02d", vpcC[4], vpcC[5], vpcC[6]>>4))
+	}
+
+	if av1C := boxPayload(init, "av1C"); len(av1C) >= 3 {
+		codecs = append(codecs, av1Codec(av1C))
+	}
+
+	if boxPayload(init, "mp4a") != nil {
+		codecs = append(codecs, mp4aCodec(init))
+	}
+
+	return strings.Join(codecs, ",")
+}
+
+// hevcCodec follows ISO/IEC 14496-15 annex E: sample entry, profile space and
+// profile, reversed compatibility flags, tier and level, then the constraint
+// bytes without trailing zeros (e.g. "hvc1.1.6.L93.B0").
+func hevcCodec(init []byte, hvcC []byte) string {
+	sampleEntry := "hev1"
+	if bytes.Contains(init, []byte("hvc1")) {
+		sampleEntry = "hvc1"
+	}
+
+	profileSpace := []string{"", "A", "B", "C"}[hvcC[1]>>6]
+	tier := "L"
+	if hvcC[1]&0x20 != 0 {
+		tier = "H"
+	}
+
+	profile := hvcC[1] & 0x1f
+	compatibility := bits.Reverse32(binary.BigEndian.Uint32(hvcC[2:6]))
+
+	codec := fmt.Sprintf("%s.%s%d.%X.%s%d", sampleEntry, profileSpace, profile, compatibility, tier, hvcC[12])
+
+	constraints := hvcC[6:12]
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+
+	for _, constraint := range constraints[:last] {
+		codec += fmt.Sprintf(".%X", constraint)
+	}
+
+	return codec
+}
+
+// av1Codec follows the AV1 ISOBMFF binding: profile, level and tier, bit depth
+// (e.g. "av01.0.08M.08").
+func av1Codec(av1C []byte) string {
+	profile := av1C[1] >> 5
+	level := av1C[1] & 0x1f
+
+	tier := "M"
+	if av1C[2]&0x80 != 0 {
+		tier = "H"
+	}
+
+	bitDepth := 8
+	if av1C[2]&0x40 != 0 {
+		bitDepth = 10
+		if profile == 2 && av1C[2]&0x20 != 0 {
+			bitDepth = 12
+		}
+	}
+
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", profile, level, tier, bitDepth)
+}
+
+// mp4aCodec reads the audio object type from the AudioSpecificConfig inside
+// esds, defaulting to AAC-LC (mp4a.40.2) when it cannot be parsed.
+func mp4aCodec(init []byte) string {
+	esds := boxPayload(init, "esds")
+	if len(esds) < 4 {
+		return "mp4a.40.2"
+	}
+
+	// Skip version and flags, then walk ES_Descriptor (0x03) ->
+	// DecoderConfigDescriptor (0x04) -> DecoderSpecificInfo (0x05).
+	data := esds[4:]
+
+	tag, payload := readDescriptor(data)
+	if tag != 0x03 || len(payload) < 3 {
+		return "mp4a.40.2"
+	}
+
+	flags := payload[2]
+	offset := 3
+	if flags&0x80 != 0 {
+		offset += 2
+	}
+	if flags&0x40 != 0 && offset < len(payload) {
+		offset += 1 + int(payload[offset])
+	}
+	if flags&0x20 != 0 {
+		offset += 2
+	}
+	if offset >= len(payload) {
+		return "mp4a.40.2"
+	}
+
+	tag, payload = readDescriptor(payload[offset:])
+	if tag != 0x04 || len(payload) < 13 {
+		return "mp4a.40.2"
+	}
+
+	objectTypeIndication := payload[0]
+
+	tag, payload = readDescriptor(payload[13:])
+	if tag != 0x05 || len(payload) < 1 {
+		return fmt.Sprintf("mp4a.%02x", objectTypeIndication)
+	}
+
+	return fmt.Sprintf("mp4a.%02x.%d", objectTypeIndication, payload[0]>>3)
+}
+
+// readDescriptor reads an MPEG-4 descriptor tag and its payload. Sizes are
+// encoded in up to four bytes with the high bit marking continuation.
+func readDescriptor(data []byte) (byte, []byte) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+
+	size := 0
+	i := 1
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+
+	start := i + 1
+	end := start + size
+	if end > len(data) {
+		end = len(data)
+	}
+
+	if start > end {
+		return data[0], nil
+	}
+
+	return data[0], data[start:end]
+}
+
+// boxPayload returns the bytes following the first occurrence of the box type.
+// Init segments are small and sample entries only appear once per track, so a
+// byte search avoids walking the full moov hierarchy.
+func boxPayload(data []byte, boxType string) []byte {
+	index := bytes.Index(data, []byte(boxType))
+	if index < 4 {
+		return nil
+	}
+
+	return data[index+len(boxType):]
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestCodecsFromInitSegment(t *testing.T) {
+	init := []byte{0x00, 0x00, 0x00, 0x10}
+	init = append(init, []byte("avcC")...)
+	init = append(init, 0x01, 0x64, 0x00, 0x1f, 0xff)
+
+	init = append(init, 0x00, 0x00, 0x00, 0x40)
+	init = append(init, []byte("mp4a")...)
+	init = append(init, make([]byte, 28)...)
+	init = append(init, 0x00, 0x00, 0x00, 0x30)
+	init = append(init, []byte("esds")...)
+	init = append(init,
+		0x00, 0x00, 0x00, 0x00, // version and flags
+		0x03, 0x19, 0x00, 0x01, 0x00, // ES_Descriptor
+		0x04, 0x11, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // DecoderConfigDescriptor
+		0x05, 0x02, 0x12, 0x10, // AudioSpecificConfig: AAC-LC, 44.1kHz, stereo
+		0x06, 0x01, 0x02,
+	)
+
+	if codecs := CodecsFromInitSegment(init); codecs != "avc1.64001f,mp4a.40.2" {
+		t.Fatalf("expected avc1.64001f,mp4a.40.2, got %s", codecs)
+	}
+}
+
+func TestCodecsFromInitSegmentHEAAC(t *testing.T) {
+	init := []byte{0x00, 0x00, 0x00, 0x10}
+	init = append(init, []byte("mp4a")...)
+	init = append(init, 0x00, 0x00, 0x00, 0x30)
+	init = append(init, []byte("esds")...)
+	init = append(init,
+		0x00, 0x00, 0x00, 0x00,
+		0x03, 0x80, 0x80, 0x80, 0x1c, 0x00, 0x01, 0x00,
+		0x04, 0x80, 0x80, 0x80, 0x14, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x05, 0x80, 0x80, 0x80, 0x02, 0x2b, 0x92,
+	)
+
+	if codecs := CodecsFromInitSegment(init); codecs != "mp4a.40.5" {
+		t.Fatalf("expected mp4a.40.5, got %s", codecs)
+	}
+}
+
+func TestCodecsFromInitSegmentUnknown(t *testing.T) {
+	if codecs := CodecsFromInitSegment([]byte("not an init segment")); codecs != "" {
+		t.Fatalf("expected no codecs, got %s", codecs)
+	}
+}
+
+func TestCodecsFromInitSegmentHEVC(t *testing.T) {
+	init := []byte("....hvc1....")
+	init = append(init, []byte("hvcC")...)
+	init = append(init, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0xb0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d)
+
+	if codecs := CodecsFromInitSegment(init); codecs != "hvc1.1.6.L93.B0" {
+		t.Fatalf("expected hvc1.1.6.L93.B0, got %s", codecs)
+	}
+}
+
+func TestCodecsFromInitSegmentAV1(t *testing.T) {
+	init := []byte("....av01....")
+	init = append(init, []byte("av1C")...)
+	init = append(init, 0x81, 0x08, 0x4c, 0x00)
+
+	if codecs := CodecsFromInitSegment(init); codecs != "av01.0.08M.10" {
+		t.Fatalf("expected av01.0.08M.10, got %s", codecs)
+	}
+}
+
+func TestCodecsFromInitSegmentVP9(t *testing.T) {
+	init := []byte("....vp09....")
+	init = append(init, []byte("vpcC")...)
+	init = append(init, 0x01, 0x00, 0x00, 0x00, 0x00, 0x1f, 0x82)
+
+	if codecs := CodecsFromInitSegment(init); codecs != "vp09.00.31.08" {
+		t.Fatalf("expected vp09.00.31.08, got %s", codecs)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type OverlayPosition string
+
+const (
+	defaultOverlayMargin  = 0.03
+	defaultOverlayOpacity = 1.0
+)
+
+const (
+	OverlayTopLeft     OverlayPosition = "top-left"
+	OverlayTopRight    OverlayPosition = "top-right"
+	OverlayBottomLeft  OverlayPosition = "bottom-left"
+	OverlayBottomRight OverlayPosition = "bottom-right"
+	OverlayCenter      OverlayPosition = "center"
+)
+
+// OverlaySettings are the branding profiles uploads can choose from. Uploads
+// that do not choose one get Default, if set.
+type OverlaySettings struct {
+	Default  string                    `yaml:"default"`
+	Profiles map[string]OverlayProfile `yaml:"profiles"`
+}
+
+// OverlayProfile brands every video rendition, download, poster, thumbnail,
+// preview and sprite tile with an image, a text, or both. Sizes and margins
+// are fractions of the output height, so the overlay looks the same across
+// the ladder. Margin and opacity are pointers as 0 is a valid value for both.
+type OverlayProfile struct {
+	Image *ImageOverlay `yaml:"image"`
+	Text  *TextOverlay  `yaml:"text"`
+}
+
+type ImageOverlay struct {
+	Path     string          `yaml:"path"`
+	Position OverlayPosition `yaml:"position"`
+	Height   float64         `yaml:"height"`
+	Margin   *float64        `yaml:"margin"`
+	Opacity  *float64        `yaml:"opacity"`
+}
+
+type TextOverlay struct {
+	Text     string          `yaml:"text"`
+	Position OverlayPosition `yaml:"position"`
+	Size     float64         `yaml:"size"`
+	Margin   *float64        `yaml:"margin"`
+	Opacity  *float64        `yaml:"opacity"`
+	Color    string          `yaml:"color"`
+	FontFile string          `yaml:"font_file"`
+}
+
+// NormalizeOverlaySettings fills defaults (bottom-right logo at 10% of the
+// height, top-left text at 5%, 3% margins, opaque white) and rejects unknown
+// positions, out of range fractions, missing images and a default that is
+// not a profile.
+func NormalizeOverlaySettings(settings OverlaySettings) (OverlaySettings, error) {
+	profiles := make(map[string]OverlayProfile, len(settings.Profiles))
+
+	for name, profile := range settings.Profiles {
+		if profile.Image == nil && profile.Text == nil {
+			return settings, fmt.Errorf("overlay %q: image or text required", name)
+		}
+
+		if profile.Image != nil {
+			image, err := normalizeImageOverlay(*profile.Image)
+			if err != nil {
+				return settings, fmt.Errorf("overlay %q: %v", name, err)
+			}
+
+			profile.Image = &image
+		}
+
+		if profile.Text != nil {
+			text, err := normalizeTextOverlay(*profile.Text)
+			if err != nil {
+				return settings, fmt.Errorf("overlay %q: %v", name, err)
+			}
+
+			profile.Text = &text
+		}
+
+		profiles[name] = profile
+	}
+
+	if _, ok := profiles[settings.Default]; settings.Default != "" && !ok {
+		return settings, fmt.Errorf("overlays: default %q is not a profile", settings.Default)
+	}
+
+	settings.Profiles = profiles
+
+	return settings, nil
+}
+
+func normalizeImageOverlay(image ImageOverlay) (ImageOverlay, error) {
+	if image.Position == "" {
+		image.Position = OverlayBottomRight
+	}
+
+	if image.Height == 0 {
+		image.Height = 0.1
+	}
+
+	image.Margin = overlayFraction(image.Margin, defaultOverlayMargin)
+	image.Opacity = overlayFraction(image.Opacity, defaultOverlayOpacity)
+
+	if _, err := os.Stat(image.Path); image.Path == "" || err != nil {
+		return image, fmt.Errorf("image %q not readable", image.Path)
+	}
+
+	return image, validateOverlayPlacement(image.Position, image.Height, *image.Margin, *image.Opacity)
+}
+
+func normalizeTextOverlay(text TextOverlay) (TextOverlay, error) {
+	if text.Position == "" {
+		text.Position = OverlayTopLeft
+	}
+
+	if text.Size == 0 {
+		text.Size = 0.05
+	}
+
+	text.Margin = overlayFraction(text.Margin, defaultOverlayMargin)
+	text.Opacity = overlayFraction(text.Opacity, defaultOverlayOpacity)
+
+	if text.Color == "" {
+		text.Color = "white"
+	}
+
+	if strings.TrimSpace(text.Text) == "" {
+		return text, fmt.Errorf("text required")
+	}
+
+	return text, validateOverlayPlacement(text.Position, text.Size, *text.Margin, *text.Opacity)
+}
+
+func validateOverlayPlacement(position OverlayPosition, size float64, margin float64, opacity float64) error {
+	switch position {
+	case OverlayTopLeft, OverlayTopRight, OverlayBottomLeft, OverlayBottomRight, OverlayCenter:
+	default:
+		return fmt.Errorf("invalid position %q", position)
+	}
+
+	if size <= 0 || size > 1 || margin < 0 || margin >= 0.5 || opacity < 0 || opacity > 1 {
+		return fmt.Errorf("size, margin and opacity must be fractions between 0 and 1")
+	}
+
+	return nil
+}
+
+// overlayFraction returns a pointer to value, or to fallback when value is
+// unset.
+func overlayFraction(value *float64, fallback float64) *float64 {
+	if value != nil {
+		fallback = *value
+	}
+
+	return &fallback
+}
+
+// overlayFilterGraph applies filters to the input stream and brands the
+// result, for an output that is height pixels tall. The image, when there is
+// one, is the ffmpeg input numbered image. The result is labelled output.
+func overlayFilterGraph(input string, filters string, image int, height int, overlay *OverlayProfile, output string) string {
+	graph := make([]string, 0, 3)
+	chain := "[" + input + "]" + filters
+	filtered := filters != ""
+
+	if logo := overlay.Image; logo != nil {
+		x, y := overlayCoordinates(logo.Position, overlayPixels(*overlayFraction(logo.Margin, defaultOverlayMargin), height), "main_w", "main_h", "overlay_w", "overlay_h")
+
+		graph = append(graph, fmt.Sprintf("[%d:v:0]scale=-2:%d,format=rgba,colorchannelmixer=aa=%.2f[logo]",
+			image, evenDimension(logo.Height*float64(height)), *overlayFraction(logo.Opacity, defaultOverlayOpacity)))
+
+		base := "[" + input + "]"
+		if filtered {
+			graph = append(graph, chain+"[base]")
+			base = "[base]"
+		}
+
+		chain = fmt.Sprintf("%s[logo]overlay=x=%s:y=%s:format=auto", base, x, y)
+		filtered = true
+	}
+
+	if text := overlay.Text; text != nil {
+		x, y := overlayCoordinates(text.Position, overlayPixels(*overlayFraction(text.Margin, defaultOverlayMargin), height), "w", "h", "text_w", "text_h")
+
+		options := []string{
+			"text=" + escapeFilterValue(text.Text),
+			"expansion=none",
+			fmt.Sprintf("fontsize=%d", overlayPixels(text.Size, height)),
+			fmt.Sprintf("fontcolor=%s@%.2f", escapeFilterValue(text.Color), *overlayFraction(text.Opacity, defaultOverlayOpacity)),
+			"x=" + x,
+			"y=" + y,
+		}
+
+		if text.FontFile != "" {
+			options = append(options, "fontfile="+escapeFilterValue(text.FontFile))
+		}
+
+		if filtered {
+			chain += ","
+		}
+
+		chain += "drawtext=" + strings.Join(options, ":")
+	}
+
+	return strings.Join(append(graph, chain+"["+output+"]"), ";")
+}
+
+// overlayHeight is the height overlays are sized against. Images whose height
+// is left to ffmpeg are assumed to be 16:9.
+func overlayHeight(width int, height int) int {
+	if height > 0 {
+		return height
+	}
+
+	return evenDimension(float64(width) * 9 / 16)
+}
+
+// overlayCoordinates returns the x and y expressions placing an overlay of
+// size (width, height) inside a frame of size (frameWidth, frameHeight),
+// named as the filter evaluating them calls them.
+func overlayCoordinates(position OverlayPosition, margin int, frameWidth string, frameHeight string, width string, height string) (string, string) {
+	left := strconv.Itoa(margin)
+	top := left
+	right := fmt.Sprintf("%s-%s-%d", frameWidth, width, margin)
+	bottom := fmt.Sprintf("%s-%s-%d", frameHeight, height, margin)
+
+	switch position {
+	case OverlayTopRight:
+		return right, top
+	case OverlayBottomLeft:
+		return left, bottom
+	case OverlayBottomRight:
+		return right, bottom
+	case OverlayCenter:
+		return fmt.Sprintf("(%s-%s)/2", frameWidth, width), fmt.Sprintf("(%s-%s)/2", frameHeight, height)
+	default:
+		return left, top
+	}
+}
+
+func overlayPixels(fraction float64, height int) int {
+	return int(math.Round(fraction * float64(height)))
+}
+
+// escapeFilterValue escapes an option value for a -filter_complex graph: once
+// for the option parser (\ ' :) and once more for the graph parser.
+func escapeFilterValue(value string) string {
+	option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(option)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeLogo(t *testing.T) string {
+	t.Helper()
+
+	logoFilePath := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(logoFilePath, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return logoFilePath
+}
+
+func fraction(value float64) *float64 {
+	return &value
+}
+
+func TestNormalizeOverlaySettings(t *testing.T) {
+	logo := writeLogo(t)
+
+	settings, err := NormalizeOverlaySettings(OverlaySettings{
+		Default: "brand",
+		Profiles: map[string]OverlayProfile{
+			"brand": {Image: &ImageOverlay{Path: logo}, Text: &TextOverlay{Text: "Example"}},
+			"flush": {Image: &ImageOverlay{Path: logo, Margin: fraction(0), Opacity: fraction(0)}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	brand := settings.Profiles["brand"]
+	if image := brand.Image; image.Position != OverlayBottomRight || image.Height != 0.1 || *image.Margin != 0.03 || *image.Opacity != 1 {
+		t.Fatalf("unexpected image defaults: %+v", image)
+	}
+
+	if text := brand.Text; text.Position != OverlayTopLeft || text.Size != 0.05 || *text.Margin != 0.03 || *text.Opacity != 1 || text.Color != "white" {
+		t.Fatalf("unexpected text defaults: %+v", text)
+	}
+
+	if flush := settings.Profiles["flush"].Image; *flush.Margin != 0 || *flush.Opacity != 0 {
+		t.Fatalf("expected a zero margin and opacity to be kept, got %+v", flush)
+	}
+
+	invalid := []OverlaySettings{
+		{Profiles: map[string]OverlayProfile{"empty": {}}},
+		{Profiles: map[string]OverlayProfile{"missing": {Image: &ImageOverlay{Path: filepath.Join(t.TempDir(), "missing.png")}}}},
+		{Profiles: map[string]OverlayProfile{"position": {Image: &ImageOverlay{Path: logo, Position: "middle"}}}},
+		{Profiles: map[string]OverlayProfile{"opacity": {Text: &TextOverlay{Text: "Example", Opacity: fraction(1.5)}}}},
+		{Profiles: map[string]OverlayProfile{"blank": {Text: &TextOverlay{Text: " "}}}},
+		{Default: "brand"},
+	}
+
+	for _, settings := range invalid {
+		if _, err := NormalizeOverlaySettings(settings); err == nil {
+			t.Fatalf("expected error for %+v", settings)
+		}
+	}
+}
+
+func TestTranscodeJobArgsOverlay(t *testing.T) {
+	job := TranscodeJob{
+		InputFilePath: "in.mp4",
+		Width:         1280,
+		Height:        720,
+		VideoEncoder:  "libx264",
+		NoAudio:       true,
+		Overlay: &OverlayProfile{
+			Image: &ImageOverlay{Path: "logo.png", Position: OverlayTopRight, Height: 0.1, Margin: fraction(0.03), Opacity: fraction(0.8)},
+			Text:  &TextOverlay{Text: "It's live: [now]", Position: OverlayBottomLeft, Size: 0.05, Margin: fraction(0.02), Opacity: fraction(0.5), Color: "white"},
+		},
+	}
+
+	graph := "[1:v:0]scale=-2:72,format=rgba,colorchannelmixer=aa=0.80[logo];" +
+		"[0:v:0]scale=1280:720,setsar=1[base];" +
+		"[base][logo]overlay=x=main_w-overlay_w-22:y=22:format=auto," +
+		`drawtext=text=It\\\'s live\\: \[now\]:expansion=none:fontsize=36:fontcolor=white@0.50:x=14:y=h-text_h-14[v]`
+
+	expected := []string{"-i", "in.mp4", "-i", "logo.png", "-filter_complex", graph, "-c:v", "libx264", "-map", "[v]", "-an", "-f", "hls"}
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("expected %v, got %v", expected, args[:len(expected)])
+	}
+
+	job.Overlay = &OverlayProfile{Text: job.Overlay.Text}
+
+	expected = []string{"-i", "in.mp4", "-filter_complex"}
+	if args := job.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("expected no image input, got %v", args)
+	}
+}
+
+func TestImageJobArgsOverlay(t *testing.T) {
+	overlay := &OverlayProfile{Image: &ImageOverlay{Path: "logo.png", Position: OverlayBottomRight, Height: 0.1, Margin: fraction(0), Opacity: fraction(1)}}
+
+	frame := FrameJob{InputFilePath: "in.mp4", Time: 12.5, Width: 320, Format: ImageFormatJPEG, Overlay: overlay, OutputFilePath: "out/poster_320.jpg"}
+	expected := []string{
+		"-v", "error",
+		"-ss", "12.500",
+		"-i", "in.mp4",
+		"-i", "logo.png",
+		"-frames:v", "1",
+		"-filter_complex", "[1:v:0]scale=-2:18,format=rgba,colorchannelmixer=aa=1.00[logo];[0:v:0]scale=320:-2,setsar=1[base];[base][logo]overlay=x=main_w-overlay_w-0:y=main_h-overlay_h-0:format=auto[v]",
+		"-map", "[v]",
+	}
+
+	if args := frame.ffmpegArgs(); !reflect.DeepEqual(args[:len(expected)], expected) {
+		t.Fatalf("expected %v, got %v", expected, args[:len(expected)])
+	}
+
+	sprite := SpriteJob{InputFilePath: "in.mp4", Interval: 5, Width: 160, Height: 90, Columns: 10, Rows: 10, Overlay: overlay, OutputPattern: "out/sprite_%03d.jpg"}
+	graph := "[1:v:0]scale=-2:10,format=rgba,colorchannelmixer=aa=1.00[logo];[0:v:0]fps=1/5,scale=160:90,setsar=1[base];" +
+		"[base][logo]overlay=x=main_w-overlay_w-0:y=main_h-overlay_h-0:format=auto[tiles];[tiles]tile=10x10[v]"
+
+	if args := strings.Join(sprite.ffmpegArgs(), " "); !strings.Contains(args, "-i in.mp4 -i logo.png -filter_complex "+graph+" -map [v]") {
+		t.Fatalf("expected branded tiles, got %s", args)
+	}
+
+	preview := PreviewJob{InputFilePath: "in.mp4", Starts: []float64{10, 30}, ExcerptDuration: 2, Width: 320, Height: 180, FrameRate: 15, Format: PreviewFormatMP4, Overlay: overlay, OutputFilePath: "out/preview.mp4"}
+	graph = "[v0][v1]concat=n=2:v=1:a=0[joined];[2:v:0]scale=-2:18,format=rgba,colorchannelmixer=aa=1.00[logo];" +
+		"[joined][logo]overlay=x=main_w-overlay_w-0:y=main_h-overlay_h-0:format=auto[out]"
+
+	if args := strings.Join(preview.ffmpegArgs(), " "); !strings.Contains(args, "-i in.mp4 -i logo.png -filter_complex") || !strings.Contains(args, graph+" -map [out]") {
+		t.Fatalf("expected a branded preview, got %s", args)
+	}
+}
+
+func TestCreateVideoOverlay(t *testing.T) {
+	db := NewMemoryDatabase()
+	service := newTestService(NewMemoryFileStorage(), db)
+	service.Downloads = DownloadSettings{Enabled: true}
+	service.Overlays = OverlaySettings{
+		Default: "brand",
+		Profiles: map[string]OverlayProfile{
+			"brand":   {Text: &TextOverlay{Text: "Example"}},
+			"partner": {Image: &ImageOverlay{Path: "partner.png"}},
+		},
+	}
+
+	video, err := service.CreateVideo(context.Background(), writeInput(t), "partner")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if processed := waitForStatus(t, db, video.ID); processed.Status != VideoStatusComplete || processed.Overlay != "partner" {
+		t.Fatalf("unexpected processed video: %+v", processed)
+	}
+
+	transcoder := service.Transcoder.(*ScriptedTranscoder)
+	for _, job := range transcoder.TranscodedJobs() {
+		if job.AudioOnly != (job.Overlay == nil) || (job.Overlay != nil && job.Overlay.Image.Path != "partner.png") {
+			t.Fatalf("expected the partner overlay on video renditions only, got %+v", job)
+		}
+	}
+
+	if len(transcoder.Downloads) != 1 || transcoder.Downloads[0].Overlay == nil {
+		t.Fatalf("expected the download to be branded, got %+v", transcoder.Downloads)
+	}
+
+	// Poster candidates are only sampled for their luminance.
+	for _, frame := range transcoder.ExtractedFrames() {
+		if frame.Width != 64 && frame.Overlay == nil {
+			t.Fatalf("expected posters and thumbnails to be branded, got %+v", frame)
+		}
+	}
+
+	video, err = service.CreateVideo(context.Background(), writeInput(t), "")
+	if err != nil || video.Overlay != "brand" {
+		t.Fatalf("expected the default overlay, got %+v, %v", video, err)
+	}
+
+	waitForStatus(t, db, video.ID)
+
+	if _, err := service.CreateVideo(context.Background(), writeInput(t), "unknown"); err == nil || err.Error() != string(ErrOverlayNotFound) {
+		t.Fatalf("expected %s, got %v", ErrOverlayNotFound, err)
+	}
+}
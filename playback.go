@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const masterPlaylistName = "master"
+
+// variantPlaylistPrefix names a master playlist restricted to one resolution,
+// which still lists the audio and subtitle groups the video plays with.
+const variantPlaylistPrefix = "master_"
+
+type PlaybackSettings struct {
+	Secret   string `yaml:"secret"`
+	APIKey   string `yaml:"api_key"`
+	BaseURL  string `yaml:"base_url"`
+	TokenTTL int    `yaml:"token_ttl"`
+}
+
+// PlaybackToken grants access to the playlists of a single video served by
+// the API until it expires.
+type PlaybackToken struct {
+	Token          string
+	ExpirationTime time.Time
+	Url            string
+}
+
+// PlaybackTokens issues the tokens gating the playlist proxy, the only way
+// HLS playlists, DASH manifests and sprite tracks are served. Every manifest
+// served through it is signed for the request, so viewers never share segment
+// URLs. Tokens are only issued to callers presenting APIKey.
+type PlaybackTokens struct {
+	BaseURL    string
+	APIKey     string
+	Signer     *TokenSigner
+	TTL        time.Duration
+	SessionTTL time.Duration
+}
+
+// NewPlaybackTokens requires a secret and an API key. Tokens live 5 minutes
+// unless token_ttl (seconds) is set. The media playlists listed in a master
+// playlist get session tokens living sessionTTL, which must cover the segment
+// URLs of the master's playlists, so a player switching quality or language
+// late in the video is not turned away.
+func NewPlaybackTokens(settings PlaybackSettings, sessionTTL time.Duration) (*PlaybackTokens, error) {
+	if settings.Secret == "" || settings.APIKey == "" {
+		return nil, fmt.Errorf("playback: secret and api_key are required")
+	}
+
+	if settings.TokenTTL < 0 {
+		return nil, fmt.Errorf("playback: token_ttl must not be negative")
+	}
+
+	ttl := time.Duration(settings.TokenTTL) * time.Second
+	if ttl == 0 {
+		ttl = time.Minute * 5
+	}
+
+	return &PlaybackTokens{
+		BaseURL:    strings.TrimSuffix(settings.BaseURL, "/"),
+		APIKey:     settings.APIKey,
+		Signer:     NewTokenSigner(settings.Secret),
+		TTL:        ttl,
+		SessionTTL: max(ttl, sessionTTL),
+	}, nil
+}
+
+func PlaybackTokenSubject(videoID string) string {
+	return fmt.Sprintf("playback:%s", videoID)
+}
+
+// PlaybackSessionSubject is signed into the tokens of the media playlists
+// listed in a master playlist. They cannot fetch a master playlist, so a
+// session cannot be extended by refetching it.
+func PlaybackSessionSubject(videoID string) string {
+	return fmt.Sprintf("playback-session:%s", videoID)
+}
+
+// reservedPlaylistName reports whether the proxy would serve a rendition of
+// this name as a master playlist instead of its media playlist.
+func reservedPlaylistName(name string) bool {
+	return name == masterPlaylistName || strings.HasPrefix(name, variantPlaylistPrefix)
+}
+
+func ProxyPlaylistPath(videoID string, name string) string {
+	return fmt.Sprintf("/video/%s/hls/%s.m3u8", url.PathEscape(videoID), url.PathEscape(name))
+}
+
+func ProxyDashPath(videoID string) string {
+	return fmt.Sprintf("/video/%s/dash/manifest.mpd", url.PathEscape(videoID))
+}
+
+func ProxySpritesPath(videoID string) string {
+	return fmt.Sprintf("/video/%s/sprites/sprites.vtt", url.PathEscape(videoID))
+}
+
+// Authorize checks the API key presented by a caller asking for a token.
+func (p *PlaybackTokens) Authorize(apiKey string) error {
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(p.APIKey)) != 1 {
+		return errors.New(string(ErrUnauthorized))
+	}
+
+	return nil
+}
+
+// Issue returns a token for the video along with the URL of the proxy path
+// carrying it.
+func (p *PlaybackTokens) Issue(videoID string, proxyPath string) PlaybackToken {
+	expires := time.Now().Add(p.TTL)
+	token := p.Signer.Sign(PlaybackTokenSubject(videoID), expires)
+
+	return PlaybackToken{
+		Token:          token,
+		ExpirationTime: expires,
+		Url:            fmt.Sprintf("%s%s?token=%s", p.BaseURL, proxyPath, url.QueryEscape(token)),
+	}
+}
+
+// IssueSession returns the token carried by the media playlist URIs of a
+// master playlist.
+func (p *PlaybackTokens) IssueSession(videoID string) string {
+	return p.Signer.Sign(PlaybackSessionSubject(videoID), time.Now().Add(p.SessionTTL))
+}
+
+func (p *PlaybackTokens) Verify(videoID string, token string) error {
+	return p.Signer.Verify(PlaybackTokenSubject(videoID), token)
+}
+
+// VerifyMedia accepts a session token or a playback token for a media
+// playlist.
+func (p *PlaybackTokens) VerifyMedia(videoID string, token string) error {
+	if p.Signer.Verify(PlaybackSessionSubject(videoID), token) == nil {
+		return nil
+	}
+
+	return p.Verify(videoID, token)
+}
+
+// ProxyMasterPlaylist renders the master playlist with relative variant URIs
+// back to the proxy, carrying the given session token.
+func ProxyMasterPlaylist(video *Video, token string) (string, error) {
+	return renderMasterPlaylist(video, func(rendition Resolution) (string, error) {
+		return fmt.Sprintf("%s.m3u8?token=%s", url.PathEscape(rendition.Resolution), url.QueryEscape(token)), nil
+	})
+}
+
+// ProxyVariantPlaylist renders a master playlist with the single named
+// resolution, so players of a pinned quality still get the separate audio.
+func ProxyVariantPlaylist(video *Video, resolution string, token string) (string, error) {
+	rendition := video.GetResolution(resolution)
+	if rendition == nil {
+		return "", errors.New(string(ErrResolutionNotFound))
+	}
+
+	variant := *video
+	variant.Resolutions = []Resolution{*rendition}
+
+	return ProxyMasterPlaylist(&variant, token)
+}
+
+// ProxyMediaPlaylist renders the named video, audio or subtitle playlist with
+// segment URLs signed for this request.
+func ProxyMediaPlaylist(video *Video, name string, storage FileStorage, keys *KeyDelivery) (string, error) {
+	for _, resolution := range video.Resolutions {
+		if resolution.Resolution == name {
+			return signedMediaPlaylist(video.ID, resolution, storage, keys)
+		}
+	}
+
+	for _, rendition := range video.AudioRenditions {
+		if rendition.Name == name {
+			return signedMediaPlaylist(video.ID, rendition.rendition(), storage, keys)
+		}
+	}
+
+	for _, track := range video.Subtitles {
+		if track.Name == name {
+			return signedMediaPlaylist(video.ID, track.rendition(), storage, keys)
+		}
+	}
+
+	return "", errors.New(string(ErrResolutionNotFound))
+}
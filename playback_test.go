@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistProxy(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	storage.TTL = 20 * time.Minute
+
+	service := newTestService(storage, NewMemoryDatabase(readyVideo("video-1")))
+	router := newTestRouter(service)
+
+	request := httptest.NewRequest(http.MethodGet, "/video/video-1/playback", nil)
+	request.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+	response := serve(router, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.Code, response.Body.String())
+	}
+
+	var token PlaybackToken
+	if err := json.Unmarshal(response.Body.Bytes(), &token); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if !strings.HasPrefix(token.Url, "https://api.example.com/video/video-1/hls/master.m3u8?token=") {
+		t.Fatalf("unexpected playback url %s", token.Url)
+	}
+
+	masterURL, _ := url.Parse(token.Url)
+	response = serve(router, httptest.NewRequest(http.MethodGet, masterURL.RequestURI(), nil))
+	if response.Code != http.StatusOK || response.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("expected uncached master playlist, got %d: %s", response.Code, response.Body.String())
+	}
+
+	variant := playlistURI(response.Body.String(), "360p.m3u8?token=")
+	if variant == "" || strings.Contains(variant, url.QueryEscape(token.Token)) {
+		t.Fatalf("expected relative variant URI with a session token, got:\n%s", response.Body.String())
+	}
+
+	response = serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/hls/"+variant, nil))
+	if response.Code != http.StatusOK || strings.Count(response.Body.String(), "#EXTINF") != 2 {
+		t.Fatalf("expected media playlist, got %d: %s", response.Code, response.Body.String())
+	}
+
+	if len(storage.Paths()) != 0 {
+		t.Fatalf("expected nothing written to storage, got %v", storage.Paths())
+	}
+
+	if ttl := storage.SignedTTL("video-1/video_360p_000.ts"); ttl != 22*time.Minute {
+		t.Fatalf("expected segments signed 10%% longer than the storage TTL, got %v", ttl)
+	}
+
+	expired := url.QueryEscape(service.Playback.Signer.Sign(PlaybackTokenSubject("video-1"), time.Now().Add(-time.Second)))
+	otherVideo := url.QueryEscape(service.Playback.Issue("video-2", ProxyPlaylistPath("video-2", masterPlaylistName)).Token)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+	}{
+		{"missing token", "/video/video-1/hls/master.m3u8", http.StatusUnauthorized},
+		{"expired token", "/video/video-1/hls/master.m3u8?token=" + expired, http.StatusUnauthorized},
+		{"token for another video", "/video/video-1/hls/master.m3u8?token=" + otherVideo, http.StatusUnauthorized},
+		{"unknown playlist", "/video/video-1/hls/720p.m3u8?token=" + url.QueryEscape(token.Token), http.StatusNotFound},
+		{"not a playlist", "/video/video-1/hls/360p.ts?token=" + url.QueryEscape(token.Token), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if response.Code != test.expected {
+				t.Fatalf("expected %d, got %d: %s", test.expected, response.Code, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestPlaylistProxyAfterMasterTokenExpired(t *testing.T) {
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1")))
+	router := newTestRouter(service)
+
+	expires := time.Now().Add(time.Second)
+	token := service.Playback.Signer.Sign(PlaybackTokenSubject("video-1"), expires)
+
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/hls/master.m3u8?token="+url.QueryEscape(token), nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected master playlist, got %d: %s", response.Code, response.Body.String())
+	}
+
+	variant := playlistURI(response.Body.String(), "360p.m3u8?token=")
+
+	for service.Playback.Verify("video-1", token) == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	response = serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/hls/"+variant, nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected the variant to outlive the master token, got %d: %s", response.Code, response.Body.String())
+	}
+
+	session := strings.TrimPrefix(variant, "360p.m3u8")
+	response = serve(router, httptest.NewRequest(http.MethodGet, "/video/video-1/hls/master.m3u8"+session, nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a session token to be refused for the master playlist, got %d", response.Code)
+	}
+}
+
+// playlistURI returns the line of playlist starting with prefix.
+func playlistURI(playlist string, prefix string) string {
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+
+	return ""
+}
+
+func TestPlaybackTokenRequiresAPIKey(t *testing.T) {
+	router := newTestRouter(newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1"))))
+
+	for _, authorization := range []string{"", "Bearer wrong", testAPIKey} {
+		request := httptest.NewRequest(http.MethodGet, "/video/video-1/playback", nil)
+		request.Header.Set("Authorization", authorization)
+
+		if response := serve(router, request); response.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %q, got %d", authorization, response.Code)
+		}
+	}
+
+	for _, settings := range []PlaybackSettings{{Secret: "secret"}, {APIKey: testAPIKey}} {
+		if _, err := NewPlaybackTokens(settings, time.Hour); err == nil {
+			t.Fatalf("expected error for %+v", settings)
+		}
+	}
+}
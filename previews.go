@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type PreviewFormat string
+
+const (
+	PreviewFormatMP4  PreviewFormat = "mp4"
+	PreviewFormatWebP PreviewFormat = "webp"
+)
+
+type PreviewSettings struct {
+	Enabled         bool    `yaml:"enabled"`
+	Excerpts        int     `yaml:"excerpts"`
+	ExcerptDuration float64 `yaml:"excerpt_duration"`
+	Width           int     `yaml:"width"`
+	FrameRate       int     `yaml:"frame_rate"`
+}
+
+// Preview is a short muted loop made of excerpts across the video.
+type Preview struct {
+	Format            PreviewFormat
+	Width             int
+	Height            int
+	Duration          float64
+	Path              string
+	Checksum          string
+	Url               string
+	UrlExpirationTime time.Time
+}
+
+type PreviewJob struct {
+	InputFilePath   string
+	Starts          []float64
+	ExcerptDuration float64
+	Width           int
+	Height          int
+	FrameRate       int
+	Format          PreviewFormat
+	Overlay         *OverlayProfile
+	OutputFilePath  string
+}
+
+// NormalizePreviewSettings fills defaults (4 excerpts of 2 seconds, 320
+// pixels wide at 15 fps) and rejects negative values.
+func NormalizePreviewSettings(settings PreviewSettings) (PreviewSettings, error) {
+	if settings.Excerpts == 0 {
+		settings.Excerpts = 4
+	}
+
+	if settings.ExcerptDuration == 0 {
+		settings.ExcerptDuration = 2
+	}
+
+	if settings.Width == 0 {
+		settings.Width = 320
+	}
+
+	if settings.FrameRate == 0 {
+		settings.FrameRate = 15
+	}
+
+	if settings.Excerpts < 0 || settings.ExcerptDuration < 0 || settings.Width < 0 || settings.FrameRate < 0 {
+		return settings, fmt.Errorf("previews: excerpts, excerpt duration, width and frame rate must be positive")
+	}
+
+	return settings, nil
+}
+
+func PreviewName(videoUUID string, format PreviewFormat) string {
+	return fmt.Sprintf("%s/preview.%s", videoUUID, format)
+}
+
+// PreviewStarts centers count excerpts on evenly spaced points of the video,
+// keeping each one inside it. Videos too short for separate excerpts get a
+// single one from the start.
+func PreviewStarts(duration float64, count int, excerptDuration float64) []float64 {
+	if duration <= float64(count)*excerptDuration {
+		return []float64{0}
+	}
+
+	starts := make([]float64, 0, count)
+
+	for i := 0; i < count; i++ {
+		start := duration*float64(i+1)/float64(count+1) - excerptDuration/2
+		starts = append(starts, math.Max(0, math.Min(start, duration-excerptDuration)))
+	}
+
+	return starts
+}
+
+func generatePreviews(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage, outputDir string) ([]Preview, error) {
+	settings := request.Previews
+	duration := request.Metadata.Duration
+
+	if duration <= 0 {
+		return nil, fmt.Errorf("preview generation error: unknown duration")
+	}
+
+	starts := PreviewStarts(duration, settings.Excerpts, settings.ExcerptDuration)
+	excerptDuration := math.Min(settings.ExcerptDuration*float64(settings.Excerpts), duration)
+	if len(starts) > 1 {
+		excerptDuration = settings.ExcerptDuration
+	}
+
+	width, height := ImageSize(request.Metadata, settings.Width)
+	previews := make([]Preview, 0)
+
+	for _, format := range []PreviewFormat{PreviewFormatMP4, PreviewFormatWebP} {
+		preview := Preview{
+			Format:   format,
+			Width:    width,
+			Height:   height,
+			Duration: excerptDuration * float64(len(starts)),
+			Path:     PreviewName(request.StoragePrefix(), format),
+		}
+
+		job := PreviewJob{
+			InputFilePath:   request.InputFilePath,
+			Starts:          starts,
+			ExcerptDuration: excerptDuration,
+			Width:           width,
+			Height:          height,
+			FrameRate:       settings.FrameRate,
+			Format:          format,
+			Overlay:         request.Overlay,
+			OutputFilePath:  filepath.Join(outputDir, filepath.Base(preview.Path)),
+		}
+
+		if err := transcoder.ExtractPreview(ctx, job); err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(job.OutputFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("preview reading error %s: %v", job.OutputFilePath, err)
+		}
+
+		checksums := make(map[string]string)
+		if err := storeObject(storages, preview.Path, data, checksums); err != nil {
+			return nil, err
+		}
+
+		preview.Checksum = checksums[preview.Path]
+		previews = append(previews, preview)
+	}
+
+	return previews, nil
+}
+
+// adoptPreviewURLs copies the URLs signed on another copy of the video onto
+// the previews stored at the same paths.
+func (v *Video) adoptPreviewURLs(signed []Preview) {
+	for i := range v.Previews {
+		for _, preview := range signed {
+			if preview.Path == v.Previews[i].Path && preview.UrlExpirationTime.After(v.Previews[i].UrlExpirationTime) {
+				v.Previews[i].Url = preview.Url
+				v.Previews[i].UrlExpirationTime = preview.UrlExpirationTime
+			}
+		}
+	}
+}
+
+// SignPreviews refreshes the signed URL of every preview whose URL expires
+// within minRemaining and reports whether any changed.
+func (v *Video) SignPreviews(storage FileStorage, minRemaining time.Duration) (bool, error) {
+	changed := false
+
+	for i := range v.Previews {
+		if v.Previews[i].Url != "" && !urlExpiresWithin(v.Previews[i].UrlExpirationTime, minRemaining) {
+			continue
+		}
+
+		url, err := storage.SignedURL(v.Previews[i].Path, storage.URLTTL())
+		if err != nil {
+			return changed, err
+		}
+
+		v.Previews[i].Url = url
+		v.Previews[i].UrlExpirationTime = time.Now().Add(storage.URLTTL())
+		changed = true
+	}
+
+	return changed, nil
+}
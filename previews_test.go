@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPreviewStarts(t *testing.T) {
+	if starts := PreviewStarts(100, 4, 2); !reflect.DeepEqual(starts, []float64{19, 39, 59, 79}) {
+		t.Fatalf("unexpected starts: %v", starts)
+	}
+
+	if starts := PreviewStarts(6, 4, 2); !reflect.DeepEqual(starts, []float64{0}) {
+		t.Fatalf("expected a single excerpt for short videos, got %v", starts)
+	}
+}
+
+func TestProcessVideoPreviews(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	storage := NewMemoryFileStorage()
+
+	metadata := landscape
+	metadata.Duration = 6
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "360p", Resolution: "360p", Packaging: PackagingTS}},
+		Thumbnails:    ThumbnailSettings{Disabled: true},
+		Sprites:       SpriteSettings{Disabled: true},
+		Previews:      PreviewSettings{Enabled: true},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(response.Previews) != 2 {
+		t.Fatalf("expected MP4 and WebP previews, got %+v", response.Previews)
+	}
+
+	webp := response.Previews[1]
+	if webp.Format != PreviewFormatWebP || webp.Path != "video-1/preview.webp" || webp.Width != 320 || webp.Height != 180 || webp.Duration != 6 || webp.Checksum == "" {
+		t.Fatalf("unexpected preview: %+v", webp)
+	}
+
+	// The video is shorter than 4 excerpts of 2 seconds, so it is used whole.
+	if job := transcoder.Previews[0]; !reflect.DeepEqual(job.Starts, []float64{0}) || job.ExcerptDuration != 6 || job.FrameRate != 15 {
+		t.Fatalf("unexpected preview job: %+v", job)
+	}
+
+	if _, ok := storage.Object("video-1/preview.mp4"); !ok {
+		t.Fatalf("expected MP4 preview to be uploaded, got %v", storage.Paths())
+	}
+}
+
+func TestPreviewJobArgs(t *testing.T) {
+	job := PreviewJob{
+		InputFilePath:   "in.mp4",
+		Starts:          []float64{10, 30},
+		ExcerptDuration: 2,
+		Width:           320,
+		Height:          180,
+		FrameRate:       15,
+		Format:          PreviewFormatMP4,
+		OutputFilePath:  "out/preview.mp4",
+	}
+
+	args := strings.Join(job.ffmpegArgs(), " ")
+
+	for _, expected := range []string{
+		"-ss 10.000 -t 2.000 -i in.mp4 -ss 30.000 -t 2.000 -i in.mp4",
+		"-filter_complex [0:v:0]fps=15,scale=320:180,setsar=1,setpts=PTS-STARTPTS[v0];[1:v:0]fps=15,scale=320:180,setsar=1,setpts=PTS-STARTPTS[v1];[v0][v1]concat=n=2:v=1:a=0[out]",
+		"-map [out] -an -c:v libx264",
+		"-y out/preview.mp4",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Fatalf("expected %q in %s", expected, args)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import "fmt"
+
+type Packaging string
+
+const (
+	PackagingTS   Packaging = "ts"
+	PackagingCMAF Packaging = "cmaf"
+)
+
+// StartPTS is the presentation timestamp ffmpeg starts renditions of the
+// packaging at, in 90 kHz units: mpegtsStartPTS for MPEG-TS, 0 for CMAF.
+func (p Packaging) StartPTS() int64 {
+	if p == PackagingCMAF {
+		return 0
+	}
+
+	return mpegtsStartPTS
+}
+
+// ladderPackaging is the container the audio renditions shared by a ladder
+// are packaged in, so they start at the same timestamp as the variants:
+// MPEG-TS when any rendition is, CMAF otherwise.
+func ladderPackaging(resolutions []Resolution) Packaging {
+	for _, resolution := range resolutions {
+		if resolution.Packaging != PackagingCMAF {
+			return PackagingTS
+		}
+	}
+
+	return PackagingCMAF
+}
+
+type EncodingProfile struct {
+	Name       string        `yaml:"name"`
+	Resolution string        `yaml:"resolution"`
+	Packaging  Packaging     `yaml:"packaging"`
+	Codec      CodecFamily   `yaml:"codec"`
+	Fallbacks  []CodecFamily `yaml:"fallbacks"`
+	SingleFile bool          `yaml:"single_file"`
+}
+
+func DefaultEncodingProfiles() []EncodingProfile {
+	profiles := make([]EncodingProfile, 0)
+
+	for _, res := range []string{"360p", "480p", "720p", "1080p"} {
+		profiles = append(profiles, EncodingProfile{
+			Name:       res,
+			Resolution: res,
+			Packaging:  PackagingTS,
+			Codec:      CodecH264,
+		})
+	}
+
+	return profiles
+}
+
+// NormalizeEncodingProfiles fills profile defaults (name from resolution, H.264,
+// TS packaging or CMAF for other codecs) and rejects duplicated names, unknown
+// packaging or codecs and resolutions that are not "<height>p" labels. Only
+// H.264 may be packaged in MPEG-TS. A ladder cannot mix packagings: its audio
+// and subtitles are shared by every variant and can only be aligned with one
+// start timestamp.
+func NormalizeEncodingProfiles(profiles []EncodingProfile) ([]EncodingProfile, error) {
+	if len(profiles) == 0 {
+		return DefaultEncodingProfiles(), nil
+	}
+
+	normalized := make([]EncodingProfile, 0, len(profiles))
+	names := make(map[string]bool)
+
+	for _, profile := range profiles {
+		if ResolutionHeight(profile.Resolution) <= 0 {
+			return nil, fmt.Errorf("encoding profile %q: invalid resolution %q", profile.Name, profile.Resolution)
+		}
+
+		if profile.Name == "" {
+			profile.Name = profile.Resolution
+		}
+
+		if profile.Codec == "" {
+			profile.Codec = CodecH264
+		}
+
+		tsCompatible := true
+		for _, codec := range profile.Codecs() {
+			if !IsValidCodecFamily(codec) {
+				return nil, fmt.Errorf("encoding profile %q: invalid codec %q", profile.Name, codec)
+			}
+
+			tsCompatible = tsCompatible && codec == CodecH264
+		}
+
+		if profile.Packaging == "" {
+			profile.Packaging = PackagingTS
+			if !tsCompatible {
+				profile.Packaging = PackagingCMAF
+			}
+		}
+
+		if profile.Packaging != PackagingTS && profile.Packaging != PackagingCMAF {
+			return nil, fmt.Errorf("encoding profile %q: invalid packaging %q", profile.Name, profile.Packaging)
+		}
+
+		if profile.Packaging == PackagingTS && !tsCompatible {
+			return nil, fmt.Errorf("encoding profile %q: %s requires cmaf packaging", profile.Name, profile.Codec)
+		}
+
+		if reservedPlaylistName(profile.Name) {
+			return nil, fmt.Errorf("encoding profile %q: name is reserved for master playlists", profile.Name)
+		}
+
+		if names[profile.Name] {
+			return nil, fmt.Errorf("encoding profile %q: duplicated name", profile.Name)
+		}
+
+		if len(normalized) > 0 && profile.Packaging != normalized[0].Packaging {
+			return nil, fmt.Errorf("encoding profile %q: %s packaging cannot be mixed with %s in one ladder", profile.Name, profile.Packaging, normalized[0].Packaging)
+		}
+
+		names[profile.Name] = true
+		normalized = append(normalized, profile)
+	}
+
+	return normalized, nil
+}
+
+// NormalizeProfileSets normalizes every named set of profiles a video can be
+// reprocessed with. Unlike the default ladder, a set cannot be empty.
+func NormalizeProfileSets(sets map[string][]EncodingProfile) (map[string][]EncodingProfile, error) {
+	normalized := make(map[string][]EncodingProfile, len(sets))
+
+	for name, profiles := range sets {
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("profile set %q: no profiles", name)
+		}
+
+		set, err := NormalizeEncodingProfiles(profiles)
+		if err != nil {
+			return nil, fmt.Errorf("profile set %q: %v", name, err)
+		}
+
+		normalized[name] = set
+	}
+
+	return normalized, nil
+}
+
+// Codecs returns the codec families the profile accepts in order of preference.
+func (p EncodingProfile) Codecs() []CodecFamily {
+	codec := p.Codec
+	if codec == "" {
+		codec = CodecH264
+	}
+
+	return append([]CodecFamily{codec}, p.Fallbacks...)
+}
+
+func (p EncodingProfile) SegmentExtension() string {
+	if p.Packaging == PackagingCMAF {
+		return "m4s"
+	}
+
+	return "ts"
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestNormalizeEncodingProfiles(t *testing.T) {
+	profiles, err := NormalizeEncodingProfiles([]EncodingProfile{{Resolution: "720p"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if profiles[0].Name != "720p" || profiles[0].Packaging != PackagingTS {
+		t.Fatalf("expected defaults to be filled, got %+v", profiles[0])
+	}
+
+	profiles, err = NormalizeEncodingProfiles([]EncodingProfile{
+		{Name: "720p_cmaf", Resolution: "720p", Packaging: PackagingCMAF},
+		{Name: "1080p_hevc", Resolution: "1080p", Codec: CodecHEVC},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if profiles[0].SegmentExtension() != "m4s" || profiles[1].Packaging != PackagingCMAF {
+		t.Fatalf("expected m4s segments for CMAF, got %+v", profiles)
+	}
+}
+
+func TestNormalizeEncodingProfilesDefaults(t *testing.T) {
+	profiles, err := NormalizeEncodingProfiles(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(profiles) != 4 || profiles[3].Name != "1080p" {
+		t.Fatalf("expected default ladder, got %+v", profiles)
+	}
+}
+
+func TestNormalizeEncodingProfilesInvalid(t *testing.T) {
+	tests := map[string][]EncodingProfile{
+		"resolution": {{Name: "bad", Resolution: "hd"}},
+		"packaging":  {{Resolution: "720p", Packaging: "webm"}},
+		"duplicated": {{Resolution: "720p"}, {Resolution: "720p"}},
+		"mixed":      {{Resolution: "720p"}, {Resolution: "1080p", Packaging: PackagingCMAF}},
+		"master":     {{Name: "master", Resolution: "720p"}},
+		"variant":    {{Name: "master_720p", Resolution: "720p"}},
+	}
+
+	for name, profiles := range tests {
+		if _, err := NormalizeEncodingProfiles(profiles); err == nil {
+			t.Fatalf("expected %s error", name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+type URLSignerType string
+
+const (
+	URLSignerPresign    URLSignerType = "presign"
+	URLSignerCloudFront URLSignerType = "cloudfront"
+)
+
+type CloudFrontPolicy string
+
+const (
+	CloudFrontPolicyCanned CloudFrontPolicy = "canned"
+	CloudFrontPolicyCustom CloudFrontPolicy = "custom"
+)
+
+// URLSigner hands out time-limited URLs for stored objects. Storages sign
+// with a bucket presign unless a CDN signer is configured.
+type URLSigner interface {
+	SignedURL(filePath string, ttl time.Duration) (string, error)
+}
+
+type URLSignerSettings struct {
+	Type       URLSignerType    `yaml:"type"`
+	Domain     string           `yaml:"domain"`
+	KeyPairID  string           `yaml:"key_pair_id"`
+	PrivateKey string           `yaml:"private_key"`
+	Policy     CloudFrontPolicy `yaml:"policy"`
+	SourceIP   string           `yaml:"source_ip"`
+}
+
+// NewURLSigner returns the signer configured for a storage, which is the
+// storage's own presign when no type is set.
+func NewURLSigner(settings URLSignerSettings, presign URLSigner) (URLSigner, error) {
+	switch settings.Type {
+	case "", URLSignerPresign:
+		return presign, nil
+	case URLSignerCloudFront:
+		if settings.Domain == "" || settings.KeyPairID == "" || settings.PrivateKey == "" {
+			return nil, fmt.Errorf("cloudfront signer: domain, key_pair_id and private_key are required")
+		}
+
+		privateKey, err := sign.LoadPEMPrivKeyFile(settings.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("cloudfront signer: private key error: %v", err)
+		}
+
+		return NewCloudFrontSigner(settings, privateKey)
+	default:
+		return nil, fmt.Errorf("unknown url signer type %q", settings.Type)
+	}
+}
+
+// CloudFrontSigner points URLs at a CloudFront distribution and signs them
+// with the distribution's key pair. Canned policies sign each URL on its own;
+// custom policies cover every object of the same directory (a rendition's
+// segments share one policy) and can pin the viewer's source IP range.
+type CloudFrontSigner struct {
+	Domain     string
+	KeyPairID  string
+	PrivateKey *rsa.PrivateKey
+	Policy     CloudFrontPolicy
+	SourceIP   string
+}
+
+func NewCloudFrontSigner(settings URLSignerSettings, privateKey *rsa.PrivateKey) (*CloudFrontSigner, error) {
+	policy := settings.Policy
+	if policy == "" {
+		policy = CloudFrontPolicyCanned
+	}
+
+	if policy != CloudFrontPolicyCanned && policy != CloudFrontPolicyCustom {
+		return nil, fmt.Errorf("cloudfront signer: invalid policy %q", policy)
+	}
+
+	if settings.SourceIP != "" && policy != CloudFrontPolicyCustom {
+		return nil, fmt.Errorf("cloudfront signer: source_ip requires the custom policy")
+	}
+
+	domain := strings.TrimSuffix(settings.Domain, "/")
+	if !strings.Contains(domain, "://") {
+		domain = "https://" + domain
+	}
+
+	return &CloudFrontSigner{
+		Domain:     domain,
+		KeyPairID:  settings.KeyPairID,
+		PrivateKey: privateKey,
+		Policy:     policy,
+		SourceIP:   settings.SourceIP,
+	}, nil
+}
+
+func (c *CloudFrontSigner) SignedURL(filePath string, ttl time.Duration) (string, error) {
+	objectURL := c.Domain + "/" + (&url.URL{Path: strings.TrimPrefix(filePath, "/")}).EscapedPath()
+	expires := time.Now().Add(ttl)
+	signer := sign.NewURLSigner(c.KeyPairID, c.PrivateKey)
+
+	if c.Policy == CloudFrontPolicyCanned {
+		return signer.Sign(objectURL, expires)
+	}
+
+	statement := sign.Statement{
+		Resource: c.Domain + "/" + path.Dir(strings.TrimPrefix(filePath, "/")) + "/*",
+		Condition: sign.Condition{
+			DateLessThan: sign.NewAWSEpochTime(expires),
+		},
+	}
+
+	if c.SourceIP != "" {
+		statement.Condition.IPAddress = &sign.IPAddress{SourceIP: c.SourceIP}
+	}
+
+	return signer.SignWithPolicy(objectURL, &sign.Policy{Statements: []sign.Statement{statement}})
+}
+
+// signedFileStorage stores objects in its bucket but signs URLs with another
+// signer, such as a CDN in front of the bucket.
+type signedFileStorage struct {
+	FileStorage
+	signer URLSigner
+}
+
+// WithURLSigner replaces the URL signing of a storage, leaving it unchanged
+// when signer is the storage itself.
+func WithURLSigner(storage FileStorage, signer URLSigner) FileStorage {
+	if existing, ok := signer.(FileStorage); ok && existing == storage {
+		return storage
+	}
+
+	return &signedFileStorage{
+		FileStorage: storage,
+		signer:      signer,
+	}
+}
+
+func (s *signedFileStorage) SignedURL(filePath string, ttl time.Duration) (string, error) {
+	return s.signer.SignedURL(filePath, ttl)
+}
+
+// SignedAttachmentURL keeps the attachment name when the signer supports it.
+// CDN URLs cannot override response headers, so objects served through them
+// must be stored with their Content-Disposition instead.
+func (s *signedFileStorage) SignedAttachmentURL(filePath string, ttl time.Duration, filename string) (string, error) {
+	signer, ok := s.signer.(AttachmentSigner)
+	if !ok {
+		return "", fmt.Errorf("attachment signing error %s: signer cannot set Content-Disposition", filePath)
+	}
+
+	return signer.SignedAttachmentURL(filePath, ttl, filename)
+}
+
+func (s *signedFileStorage) StoreAttachment(filePath string, fileContent []byte, filename string) error {
+	storer, ok := s.FileStorage.(AttachmentStorer)
+	if !ok {
+		return fmt.Errorf("attachment store error %s: storage cannot set Content-Disposition", filePath)
+	}
+
+	return storer.StoreAttachment(filePath, fileContent, filename)
+}
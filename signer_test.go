@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cloudFrontDecode reverses CloudFront's URL-safe base64 variant.
+func cloudFrontDecode(t *testing.T, value string) []byte {
+	t.Helper()
+
+	replacer := strings.NewReplacer("-", "+", "_", "=", "~", "/")
+
+	decoded, err := base64.StdEncoding.DecodeString(replacer.Replace(value))
+	if err != nil {
+		t.Fatalf("invalid base64 %q: %v", value, err)
+	}
+
+	return decoded
+}
+
+func TestCloudFrontSignerCanned(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	signer, err := NewCloudFrontSigner(URLSignerSettings{Domain: "d111.cloudfront.net/", KeyPairID: "K2JCJMDEHXQW5F"}, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	signed, err := signer.SignedURL("video-1/video_360p_000.ts", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parsed, _ := url.Parse(signed)
+	if parsed.Host != "d111.cloudfront.net" || parsed.Path != "/video-1/video_360p_000.ts" {
+		t.Fatalf("expected URL on the distribution, got %s", signed)
+	}
+
+	query := parsed.Query()
+	if query.Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" || query.Get("Expires") == "" || query.Get("Signature") == "" || query.Get("Policy") != "" {
+		t.Fatalf("expected canned policy parameters, got %s", parsed.RawQuery)
+	}
+}
+
+func TestCloudFrontSignerCustomPolicy(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	signer, err := NewCloudFrontSigner(URLSignerSettings{
+		Domain:    "https://d111.cloudfront.net",
+		KeyPairID: "K2JCJMDEHXQW5F",
+		Policy:    CloudFrontPolicyCustom,
+		SourceIP:  "192.0.2.0/24",
+	}, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	signed, err := signer.SignedURL("video-1/video_360p_000.ts", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Policy and Signature use characters url.Values would decode, so they
+	// are read from the raw query.
+	params := make(map[string]string)
+	for _, param := range strings.Split(signed[strings.Index(signed, "?")+1:], "&") {
+		name, value, _ := strings.Cut(param, "=")
+		params[name] = value
+	}
+
+	policy := cloudFrontDecode(t, params["Policy"])
+	if !strings.Contains(string(policy), `"Resource":"https://d111.cloudfront.net/video-1/*"`) || !strings.Contains(string(policy), `"AWS:SourceIp":"192.0.2.0/24"`) {
+		t.Fatalf("unexpected policy %s", policy)
+	}
+
+	digest := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], cloudFrontDecode(t, params["Signature"])); err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+}
+
+func TestNewURLSigner(t *testing.T) {
+	storage := NewMemoryFileStorage()
+
+	signer, err := NewURLSigner(URLSignerSettings{}, storage)
+	if err != nil || signer != storage {
+		t.Fatalf("expected the storage presign by default, got %v, %v", signer, err)
+	}
+
+	if WithURLSigner(storage, signer) != FileStorage(storage) {
+		t.Fatal("expected storage to be left unchanged with its own signer")
+	}
+
+	for _, settings := range []URLSignerSettings{
+		{Type: "akamai"},
+		{Type: URLSignerCloudFront, Domain: "d111.cloudfront.net"},
+	} {
+		if _, err := NewURLSigner(settings, storage); err == nil {
+			t.Fatalf("expected error for %+v", settings)
+		}
+	}
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := NewCloudFrontSigner(URLSignerSettings{Domain: "d111.cloudfront.net", KeyPairID: "K", SourceIP: "192.0.2.0/24"}, key); err == nil {
+		t.Fatal("expected source_ip to require the custom policy")
+	}
+}
+
+func TestWithURLSigner(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cdn, _ := NewCloudFrontSigner(URLSignerSettings{Domain: "d111.cloudfront.net", KeyPairID: "K"}, key)
+
+	bucket := NewMemoryFileStorage()
+	storage := WithURLSigner(bucket, cdn)
+
+	if err := storage.Store("video-1/master.m3u8", []byte("#EXTM3U\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := bucket.Object("video-1/master.m3u8"); !ok {
+		t.Fatal("expected object stored in the bucket")
+	}
+
+	signed, err := storage.SignedURL("video-1/master.m3u8", storage.URLTTL())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(signed, "https://d111.cloudfront.net/video-1/master.m3u8?") || bucket.Calls("SignedURL") != 0 {
+		t.Fatalf("expected CDN URL, got %s", signed)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type SpriteSettings struct {
+	Disabled bool    `yaml:"disabled"`
+	Interval float64 `yaml:"interval"`
+	Width    int     `yaml:"width"`
+	Columns  int     `yaml:"columns"`
+	Rows     int     `yaml:"rows"`
+}
+
+// SpriteSheets are JPEG grids of preview tiles, one every Interval seconds,
+// read left to right then top to bottom across Sheets in order.
+type SpriteSheets struct {
+	Interval   float64
+	Columns    int
+	Rows       int
+	TileWidth  int
+	TileHeight int
+	Tiles      int
+	Sheets     []string
+	Checksums  map[string]string
+}
+
+type SpriteJob struct {
+	InputFilePath string
+	Interval      float64
+	Width         int
+	Height        int
+	Columns       int
+	Rows          int
+	Overlay       *OverlayProfile
+	OutputPattern string
+}
+
+// NormalizeSpriteSettings fills defaults (a 160 pixels wide tile every 5
+// seconds, 10x10 tiles per sheet) and rejects non-positive values.
+func NormalizeSpriteSettings(settings SpriteSettings) (SpriteSettings, error) {
+	if settings.Interval == 0 {
+		settings.Interval = 5
+	}
+
+	if settings.Width == 0 {
+		settings.Width = 160
+	}
+
+	if settings.Columns == 0 {
+		settings.Columns = 10
+	}
+
+	if settings.Rows == 0 {
+		settings.Rows = 10
+	}
+
+	if settings.Interval < 0 || settings.Width < 0 || settings.Columns < 0 || settings.Rows < 0 {
+		return settings, fmt.Errorf("sprites: interval, width, columns and rows must be positive")
+	}
+
+	return settings, nil
+}
+
+func SpriteSheetName(videoUUID string, index int) string {
+	return fmt.Sprintf("%s/sprite_%03d.jpg", videoUUID, index)
+}
+
+// generateSprites renders the sheets with ffmpeg's tile filter and uploads
+// them. Tile sizes are read back from the first sheet because the height is
+// left to ffmpeg when the source size is unknown.
+func generateSprites(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage, outputDir string) (*SpriteSheets, error) {
+	settings := request.Sprites
+	width, height := ImageSize(request.Metadata, settings.Width)
+
+	job := SpriteJob{
+		InputFilePath: request.InputFilePath,
+		Interval:      settings.Interval,
+		Width:         width,
+		Height:        height,
+		Columns:       settings.Columns,
+		Rows:          settings.Rows,
+		Overlay:       request.Overlay,
+		OutputPattern: filepath.Join(outputDir, "sprite_%03d.jpg"),
+	}
+
+	if err := transcoder.ExtractSprites(ctx, job); err != nil {
+		return nil, err
+	}
+
+	sprites := &SpriteSheets{
+		Interval:  settings.Interval,
+		Columns:   settings.Columns,
+		Rows:      settings.Rows,
+		Checksums: make(map[string]string),
+	}
+
+	for index := 0; ; index++ {
+		data, err := os.ReadFile(fmt.Sprintf(job.OutputPattern, index))
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("sprite reading error: %v", err)
+		}
+
+		if index == 0 {
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("sprite decode error: %v", err)
+			}
+
+			sprites.TileWidth = config.Width / settings.Columns
+			sprites.TileHeight = config.Height / settings.Rows
+		}
+
+		sheet := SpriteSheetName(request.StoragePrefix(), index)
+		if err := storeObject(storages, sheet, data, sprites.Checksums); err != nil {
+			return nil, err
+		}
+
+		sprites.Sheets = append(sprites.Sheets, sheet)
+	}
+
+	if len(sprites.Sheets) == 0 {
+		return nil, errors.New("sprite generation error: no sheets written")
+	}
+
+	// The last sheet is padded with blank tiles, so the duration decides how
+	// many tiles are real when it is known.
+	sprites.Tiles = len(sprites.Sheets) * sprites.Columns * sprites.Rows
+	if duration := request.Metadata.Duration; duration > 0 {
+		sprites.Tiles = min(sprites.Tiles, int(math.Ceil(duration/settings.Interval)))
+	}
+
+	return sprites, nil
+}
+
+// SpriteVTT maps each tile's time range to its region of a sheet using media
+// fragments ("sprite_000.jpg#xywh=160,0,160,90"). The sheet URLs come from
+// sign, as the VTT is read directly by the player.
+func (s *SpriteSheets) SpriteVTT(duration float64, sign func(path string) (string, error)) (string, error) {
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+
+	perSheet := s.Columns * s.Rows
+	urls := make(map[int]string)
+
+	for tile := 0; tile < s.Tiles; tile++ {
+		sheet := tile / perSheet
+		if sheet >= len(s.Sheets) {
+			break
+		}
+
+		url, ok := urls[sheet]
+		if !ok {
+			var err error
+			url, err = sign(s.Sheets[sheet])
+			if err != nil {
+				return "", err
+			}
+
+			urls[sheet] = url
+		}
+
+		start := float64(tile) * s.Interval
+		end := start + s.Interval
+		if duration > 0 && end > duration {
+			end = duration
+		}
+
+		position := tile % perSheet
+		x := (position % s.Columns) * s.TileWidth
+		y := (position / s.Columns) * s.TileHeight
+
+		vtt.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatCueTimestamp(time.Duration(start*float64(time.Second))),
+			formatCueTimestamp(time.Duration(end*float64(time.Second))),
+			url, x, y, s.TileWidth, s.TileHeight,
+		))
+	}
+
+	return vtt.String(), nil
+}
+
+// SignedSpriteVTT renders the thumbnail track of the video with sheet URLs
+// signed as long as the segments of a playlist.
+func SignedSpriteVTT(video Video, storage FileStorage) (string, error) {
+	if video.Sprites == nil {
+		return "", errors.New(string(ErrSpritesNotAvailable))
+	}
+
+	return video.Sprites.SpriteVTT(video.VideoMetadata.Duration, func(path string) (string, error) {
+		return storage.SignedURL(path, segmentURLTTL(storage))
+	})
+}
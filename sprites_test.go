@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessVideoSprites(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.SpriteSheets = 2
+	storage := NewMemoryFileStorage()
+
+	metadata := landscape
+	metadata.Duration = 23
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "360p", Resolution: "360p", Packaging: PackagingTS}},
+		Thumbnails:    ThumbnailSettings{Disabled: true},
+		Sprites:       SpriteSettings{Interval: 5, Width: 160, Columns: 2, Rows: 2},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sprites := response.Sprites
+	if sprites == nil || sprites.TileWidth != 160 || sprites.TileHeight != 90 || sprites.Tiles != 5 {
+		t.Fatalf("unexpected sprites: %+v", sprites)
+	}
+
+	expected := []string{"video-1/sprite_000.jpg", "video-1/sprite_001.jpg"}
+	if !reflect.DeepEqual(sprites.Sheets, expected) {
+		t.Fatalf("expected sheets %v, got %v", expected, sprites.Sheets)
+	}
+
+	for _, sheet := range expected {
+		if sprites.Checksums[sheet] == "" {
+			t.Fatalf("expected %s to be uploaded, got %v", sheet, storage.Paths())
+		}
+	}
+}
+
+func TestSpriteVTT(t *testing.T) {
+	sprites := &SpriteSheets{
+		Interval:   5,
+		Columns:    2,
+		Rows:       2,
+		TileWidth:  160,
+		TileHeight: 90,
+		Tiles:      5,
+		Sheets:     []string{"video-1/sprite_000.jpg", "video-1/sprite_001.jpg"},
+	}
+
+	vtt, err := sprites.SpriteVTT(23, func(path string) (string, error) {
+		return "https://cdn.test/" + path, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, cue := range []string{
+		"00:00:00.000 --> 00:00:05.000\nhttps://cdn.test/video-1/sprite_000.jpg#xywh=0,0,160,90\n",
+		"00:00:15.000 --> 00:00:20.000\nhttps://cdn.test/video-1/sprite_000.jpg#xywh=160,90,160,90\n",
+		"00:00:20.000 --> 00:00:23.000\nhttps://cdn.test/video-1/sprite_001.jpg#xywh=0,0,160,90\n",
+	} {
+		if !strings.Contains(vtt, cue) {
+			t.Fatalf("expected cue %q in:\n%s", cue, vtt)
+		}
+	}
+
+	if strings.Count(vtt, "-->") != 5 {
+		t.Fatalf("expected 5 cues:\n%s", vtt)
+	}
+}
+
+func TestGetSpritesURL(t *testing.T) {
+	video := readyVideo("video-1")
+	video.Sprites = &SpriteSheets{Interval: 5, Columns: 10, Rows: 10, TileWidth: 160, TileHeight: 90, Tiles: 2, Sheets: []string{"video-1/sprite_000.jpg"}}
+
+	storage := NewMemoryFileStorage()
+	db := NewMemoryDatabase(video, readyVideo("plain"))
+	service := newTestService(storage, db)
+
+	spritesURL, err := service.GetSpritesURL(context.Background(), video.ID, testAPIKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prefix := "https://api.example.com/video/video-1/sprites/sprites.vtt?token="
+	if !strings.HasPrefix(spritesURL, prefix) {
+		t.Fatalf("unexpected URL: %s", spritesURL)
+	}
+
+	token, _ := url.QueryUnescape(strings.TrimPrefix(spritesURL, prefix))
+
+	vtt, err := service.GetSpriteVTT(context.Background(), video.ID, token)
+	if err != nil || !strings.Contains(vtt, "https://memory.test/video-1/sprite_000.jpg?signature=") {
+		t.Fatalf("expected signed sheet URLs, got %v:\n%s", err, vtt)
+	}
+
+	if len(storage.Paths()) != 0 || db.Calls("UpdateVideo") != 0 {
+		t.Fatalf("expected nothing written, got %v", storage.Paths())
+	}
+
+	if _, err := service.GetSpritesURL(context.Background(), video.ID, ""); err == nil || err.Error() != string(ErrUnauthorized) {
+		t.Fatalf("expected %s, got %v", ErrUnauthorized, err)
+	}
+
+	if _, err := service.GetSpritesURL(context.Background(), "plain", testAPIKey); err == nil || err.Error() != string(ErrSpritesNotAvailable) {
+		t.Fatalf("expected sprites not available, got %v", err)
+	}
+}
@@ -3,8 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"time"
 
@@ -15,6 +21,14 @@ import (
 	"cloud.google.com/go/storage"
 )
 
+const (
+	defaultURLTTL         = time.Minute * 60
+	defaultMinURLLifetime = time.Minute * 5
+
+	// maxURLTTL is the longest lifetime S3 and GCS accept for a signed URL.
+	maxURLTTL = time.Hour * 24 * 7
+)
+
 type Clients struct {
 	AWS *s3.S3
 	GCP *storage.Client
@@ -38,25 +52,78 @@ func InitStorageClients(c Config) (*Clients, error) {
 	}, nil
 }
 
+// URLTTL returns the configured signed URL lifetime in seconds, or the
+// default of 60 minutes.
+func URLTTL(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultURLTTL
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// segmentURLTTL is the lifetime of URLs listed inside a playlist, 10% longer
+// than the playlist's own so a playlist fetched just before it expires still
+// plays to the end of its first segments.
+func segmentURLTTL(storage FileStorage) time.Duration {
+	ttl := storage.URLTTL()
+
+	return ttl + ttl/10
+}
+
+// ValidateURLTTLs checks the lifetimes of every storage: segment URLs, the
+// longest lived, must be accepted by the cloud, and cached URLs must still
+// qualify for reuse with minRemaining left.
+func ValidateURLTTLs(storages []FileStorage, minRemaining time.Duration) error {
+	for _, storage := range storages {
+		if segmentURLTTL(storage) > maxURLTTL {
+			return fmt.Errorf("storage: url_ttl plus 10%% for segment URLs must not exceed %s", maxURLTTL)
+		}
+
+		if minRemaining >= storage.URLTTL() {
+			return fmt.Errorf("signed_urls: min_remaining must be shorter than every storage url_ttl")
+		}
+	}
+
+	return nil
+}
+
 type S3FileStorage struct {
 	client     *s3.S3
 	bucketName string
+	ttl        time.Duration
 }
 
-func NewS3FileStorage(client *s3.S3, bucketName string) *S3FileStorage {
+func NewS3FileStorage(client *s3.S3, bucketName string, ttl time.Duration) *S3FileStorage {
 	return &S3FileStorage{
 		client:     client,
 		bucketName: bucketName,
+		ttl:        ttl,
 	}
 }
 
 func (s *S3FileStorage) Store(filePath string, fileContent []byte) error {
+	return s.put(filePath, fileContent, "")
+}
+
+func (s *S3FileStorage) StoreAttachment(filePath string, fileContent []byte, filename string) error {
+	return s.put(filePath, fileContent, ContentDisposition(filename))
+}
+
+func (s *S3FileStorage) put(filePath string, fileContent []byte, contentDisposition string) error {
+	checksum := sha256.Sum256(fileContent)
+
 	input := &s3.PutObjectInput{
-		Bucket:        aws.String(s.bucketName),
-		Key:           aws.String(filePath),
-		Body:          aws.ReadSeekCloser(bytes.NewReader(fileContent)),
-		ContentLength: aws.Int64(int64(len(fileContent))),
-		ContentType:   aws.String("application/octet-stream"),
+		Bucket:         aws.String(s.bucketName),
+		Key:            aws.String(filePath),
+		Body:           aws.ReadSeekCloser(bytes.NewReader(fileContent)),
+		ContentLength:  aws.Int64(int64(len(fileContent))),
+		ContentType:    aws.String("application/octet-stream"),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+	}
+
+	if contentDisposition != "" {
+		input.ContentDisposition = aws.String(contentDisposition)
 	}
 
 	_, err := s.client.PutObjectWithContext(aws.BackgroundContext(), input)
@@ -67,13 +134,13 @@ func (s *S3FileStorage) Store(filePath string, fileContent []byte) error {
 	return nil
 }
 
-func (s *S3FileStorage) SignedURL(filePath string) (string, error) {
+func (s *S3FileStorage) SignedURL(filePath string, ttl time.Duration) (string, error) {
 	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(filePath),
 	})
 
-	url, err := req.Presign(60 * time.Minute)
+	url, err := req.Presign(ttl)
 	if err != nil {
 		return "", err
 	}
@@ -81,49 +148,114 @@ func (s *S3FileStorage) SignedURL(filePath string) (string, error) {
 	return url, nil
 }
 
+func (s *S3FileStorage) SignedAttachmentURL(filePath string, ttl time.Duration, filename string) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(s.bucketName),
+		Key:                        aws.String(filePath),
+		ResponseContentDisposition: aws.String(ContentDisposition(filename)),
+	})
+
+	return req.Presign(ttl)
+}
+
+func (s *S3FileStorage) URLTTL() time.Duration {
+	return s.ttl
+}
+
+func (s *S3FileStorage) Retrieve(filePath string) ([]byte, error) {
+	output, err := s.client.GetObjectWithContext(aws.BackgroundContext(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(filePath),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer output.Body.Close()
+
+	return io.ReadAll(output.Body)
+}
+
 type GCSFileStorage struct {
 	client     *storage.Client
 	bucketName string
+	ttl        time.Duration
 }
 
-func NewGCSFileStorage(client *storage.Client, bucketName string) *GCSFileStorage {
+func NewGCSFileStorage(client *storage.Client, bucketName string, ttl time.Duration) *GCSFileStorage {
 	return &GCSFileStorage{
 		client:     client,
 		bucketName: bucketName,
+		ttl:        ttl,
 	}
 }
 
 func (g *GCSFileStorage) Store(filePath string, fileContent []byte) error {
-	ctx := context.Background()
+	return g.put(filePath, fileContent, "")
+}
+
+func (g *GCSFileStorage) StoreAttachment(filePath string, fileContent []byte, filename string) error {
+	return g.put(filePath, fileContent, ContentDisposition(filename))
+}
+
+func (g *GCSFileStorage) put(filePath string, fileContent []byte, contentDisposition string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	bucket := g.client.Bucket(g.bucketName)
 
 	object := bucket.Object(filePath)
 
+	checksum := md5.Sum(fileContent)
+
 	writer := object.NewWriter(ctx)
-	defer writer.Close()
+	writer.CRC32C = crc32.Checksum(fileContent, crc32.MakeTable(crc32.Castagnoli))
+	writer.SendCRC32C = true
+	writer.MD5 = checksum[:]
+	writer.ContentDisposition = contentDisposition
 
 	_, err := io.Copy(writer, bytes.NewReader(fileContent))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writer.Close()
 }
 
-func (g *GCSFileStorage) SignedURL(filePath string) (string, error) {
-	ctx := context.Background()
+// SignedURL signs a V4 URL with the service account credentials. The media
+// link used before never expired and required an authenticated request.
+func (g *GCSFileStorage) SignedURL(filePath string, ttl time.Duration) (string, error) {
+	return g.client.Bucket(g.bucketName).SignedURL(filePath, &storage.SignedURLOptions{
+		Method:  "GET",
+		Scheme:  storage.SigningSchemeV4,
+		Expires: time.Now().Add(ttl),
+	})
+}
 
-	bucket := g.client.Bucket(g.bucketName)
-	object := bucket.Object(filePath)
+func (g *GCSFileStorage) SignedAttachmentURL(filePath string, ttl time.Duration, filename string) (string, error) {
+	return g.client.Bucket(g.bucketName).SignedURL(filePath, &storage.SignedURLOptions{
+		Method:          "GET",
+		Scheme:          storage.SigningSchemeV4,
+		Expires:         time.Now().Add(ttl),
+		QueryParameters: url.Values{"response-content-disposition": {ContentDisposition(filename)}},
+	})
+}
 
-	attrs, err := object.Attrs(ctx)
+func (g *GCSFileStorage) URLTTL() time.Duration {
+	return g.ttl
+}
+
+func (g *GCSFileStorage) Retrieve(filePath string) ([]byte, error) {
+	ctx := context.Background()
+
+	reader, err := g.client.Bucket(g.bucketName).Object(filePath).NewReader(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	url := attrs.MediaLink
-	return url, nil
+	defer reader.Close()
+
+	return io.ReadAll(reader)
 }
 
 func initGCP(c *Config) (*storage.Client, error) {
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateURLTTLs(t *testing.T) {
+	short := NewMemoryFileStorage()
+	short.TTL = 10 * time.Minute
+
+	if err := ValidateURLTTLs([]FileStorage{NewMemoryFileStorage(), short}, 5*time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ValidateURLTTLs([]FileStorage{NewMemoryFileStorage(), short}, 10*time.Minute); err == nil {
+		t.Fatal("expected min_remaining to be checked against every storage")
+	}
+
+	// 7 days minus 10% leaves segment URLs past the signing limit.
+	long := NewMemoryFileStorage()
+	long.TTL = maxURLTTL - time.Hour
+
+	if err := ValidateURLTTLs([]FileStorage{long}, defaultMinURLLifetime); err == nil {
+		t.Fatal("expected segment URLs over 7 days to be rejected")
+	}
+}
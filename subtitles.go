@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	subtitleGroupID         = "subs"
+	subtitleSegmentDuration = 10
+
+	// mpegtsStartPTS is where ffmpeg's MPEG-TS muxer starts the timeline, its
+	// default 1.4 seconds of muxing delay in 90 kHz units.
+	mpegtsStartPTS = 126000
+)
+
+type SubtitleSource string
+
+const (
+	SubtitleSourceEmbedded SubtitleSource = "embedded"
+	SubtitleSourceUpload   SubtitleSource = "upload"
+)
+
+// SubtitleStream describes a source subtitle stream. Index counts subtitle
+// streams only, as used by ffmpeg's "0:s:<index>" stream specifier.
+type SubtitleStream struct {
+	Index    int
+	Codec    string
+	Language string
+	Title    string
+	Default  bool
+	Forced   bool
+}
+
+// textSubtitleCodecs are the subtitle codecs ffmpeg can convert to WebVTT.
+// Bitmap subtitles (PGS, VobSub, DVB) would need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+func (s SubtitleStream) IsText() bool {
+	return textSubtitleCodecs[s.Codec]
+}
+
+// SubtitleTrack is a WebVTT subtitle rendition segmented for HLS.
+type SubtitleTrack struct {
+	Name          string
+	Language      string
+	Title         string
+	Default       bool
+	Forced        bool
+	Source        SubtitleSource
+	Playlist      string
+	TotalSegments int
+	Checksums     map[string]string
+}
+
+type SubtitleCue struct {
+	Start    time.Duration
+	End      time.Duration
+	Settings string
+	Text     []string
+}
+
+func SubtitleTrackName(index int) string {
+	return fmt.Sprintf("subtitles_%d", index)
+}
+
+func SubtitleSegmentName(name string, segment int) string {
+	return fmt.Sprintf("%s_%03d.vtt", name, segment)
+}
+
+// nextSubtitleName returns the first subtitles_<n> name not used by the video.
+func nextSubtitleName(video Video) string {
+	used := make(map[string]bool)
+	for _, track := range video.Subtitles {
+		used[track.Name] = true
+	}
+
+	index := len(video.Subtitles)
+	for used[SubtitleTrackName(index)] {
+		index++
+	}
+
+	return SubtitleTrackName(index)
+}
+
+func (s SubtitleTrack) rendition() Resolution {
+	return Resolution{
+		Resolution:    s.Name,
+		Playlist:      s.Playlist,
+		TotalSegments: s.TotalSegments,
+	}
+}
+
+func (s SubtitleTrack) displayName(used map[string]bool) string {
+	return uniqueMediaName(s.Title, s.Language, "Subtitles", used)
+}
+
+// ParseSubtitles reads SRT or WebVTT cues. Files starting with the WEBVTT
+// signature are WebVTT, anything else is treated as SRT; both formats share
+// the "<start> --> <end>" timing line and differ in the millisecond separator.
+func ParseSubtitles(data []byte) ([]SubtitleCue, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+
+	cues := make([]SubtitleCue, 0)
+
+	for _, block := range strings.Split(content, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+
+		timing := -1
+		for i := 0; i < len(lines) && i < 2; i++ {
+			if strings.Contains(lines[i], "-->") {
+				timing = i
+				break
+			}
+		}
+
+		// Headers, identifiers-only, NOTE, STYLE and REGION blocks carry no cue.
+		if timing < 0 {
+			continue
+		}
+
+		cue, err := parseCueTiming(lines[timing])
+		if err != nil {
+			return nil, err
+		}
+
+		cue.Text = lines[timing+1:]
+		if len(cue.Text) == 0 {
+			continue
+		}
+
+		cues = append(cues, cue)
+	}
+
+	if len(cues) == 0 {
+		return nil, errors.New("subtitles parse error: no cues found")
+	}
+
+	return cues, nil
+}
+
+func parseCueTiming(line string) (SubtitleCue, error) {
+	start, rest, _ := strings.Cut(line, "-->")
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return SubtitleCue{}, fmt.Errorf("subtitles parse error: invalid timing %q", line)
+	}
+
+	startTime, err := parseCueTimestamp(strings.TrimSpace(start))
+	if err != nil {
+		return SubtitleCue{}, err
+	}
+
+	endTime, err := parseCueTimestamp(fields[0])
+	if err != nil {
+		return SubtitleCue{}, err
+	}
+
+	if endTime < startTime {
+		return SubtitleCue{}, fmt.Errorf("subtitles parse error: cue ends before it starts %q", line)
+	}
+
+	return SubtitleCue{
+		Start:    startTime,
+		End:      endTime,
+		Settings: strings.Join(fields[1:], " "),
+	}, nil
+}
+
+// parseCueTimestamp accepts "hh:mm:ss.ttt", "mm:ss.ttt" and the SRT form
+// "hh:mm:ss,ttt".
+func parseCueTimestamp(value string) (time.Duration, error) {
+	parts := strings.Split(strings.Replace(value, ",", ".", 1), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("subtitles parse error: invalid timestamp %q", value)
+	}
+
+	var total float64
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		if err != nil || number < 0 {
+			return 0, fmt.Errorf("subtitles parse error: invalid timestamp %q", value)
+		}
+
+		total = total*60 + number
+	}
+
+	return time.Duration(math.Round(total*1000)) * time.Millisecond, nil
+}
+
+func formatCueTimestamp(value time.Duration) string {
+	milliseconds := value.Milliseconds()
+
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		milliseconds/3600000,
+		milliseconds/60000%60,
+		milliseconds/1000%60,
+		milliseconds%1000,
+	)
+}
+
+// subtitleStartPTS returns the presentation timestamp the video renditions
+// start at, which cue time zero maps to. Ladders are packaged in a single
+// container, so every rendition starts at the same timestamp.
+func subtitleStartPTS(resolutions []Resolution) int64 {
+	if len(resolutions) == 0 {
+		return mpegtsStartPTS
+	}
+
+	return ladderPackaging(resolutions).StartPTS()
+}
+
+// SegmentSubtitles splits cues into WebVTT files of subtitleSegmentDuration
+// seconds covering the whole video. A cue overlapping two segments is
+// repeated in both, as HLS clients deduplicate them by timing. Every segment
+// maps cue time zero to startPTS with X-TIMESTAMP-MAP, as HLS requires to
+// synchronize WebVTT with the media segments.
+func SegmentSubtitles(cues []SubtitleCue, duration float64, startPTS int64) ([][]byte, []float64) {
+	for _, cue := range cues {
+		duration = math.Max(duration, cue.End.Seconds())
+	}
+
+	count := max(int(math.Ceil(duration/subtitleSegmentDuration)), 1)
+
+	segments := make([][]byte, 0, count)
+	durations := make([]float64, 0, count)
+
+	for i := 0; i < count; i++ {
+		segmentStart := time.Duration(i*subtitleSegmentDuration) * time.Second
+		segmentEnd := segmentStart + subtitleSegmentDuration*time.Second
+
+		var segment strings.Builder
+		segment.WriteString(fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", startPTS))
+
+		for _, cue := range cues {
+			if cue.Start >= segmentEnd || cue.End <= segmentStart {
+				continue
+			}
+
+			timing := fmt.Sprintf("%s --> %s", formatCueTimestamp(cue.Start), formatCueTimestamp(cue.End))
+			if cue.Settings != "" {
+				timing += " " + cue.Settings
+			}
+
+			segment.WriteString(fmt.Sprintf("\n%s\n%s\n", timing, strings.Join(cue.Text, "\n")))
+		}
+
+		segments = append(segments, []byte(segment.String()))
+		durations = append(durations, math.Min(subtitleSegmentDuration, duration-float64(i*subtitleSegmentDuration)))
+	}
+
+	return segments, durations
+}
+
+// storeSubtitles uploads the segmented WebVTT files and the media playlist
+// listing them, in the same layout as the video renditions.
+func storeSubtitles(storages []FileStorage, videoID string, name string, cues []SubtitleCue, duration float64, startPTS int64) (*SubtitleTrack, error) {
+	if reservedPlaylistName(name) {
+		return nil, fmt.Errorf("subtitle track %q: name is reserved for master playlists", name)
+	}
+
+	segments, durations := SegmentSubtitles(cues, duration, startPTS)
+
+	track := &SubtitleTrack{
+		Name:          name,
+		Playlist:      PlaylistName(videoID, name),
+		TotalSegments: len(segments),
+		Checksums:     make(map[string]string),
+	}
+
+	playlist := &MediaPlaylist{
+		TargetDuration: subtitleSegmentDuration,
+	}
+
+	for i, segment := range segments {
+		segmentName := SubtitleSegmentName(name, i)
+
+		if err := storeObject(storages, fmt.Sprintf("%s/%s", videoID, segmentName), segment, track.Checksums); err != nil {
+			return nil, err
+		}
+
+		playlist.Segments = append(playlist.Segments, MediaSegment{URI: segmentName, Duration: durations[i]})
+	}
+
+	content, err := playlist.Render(func(uri string) (string, error) {
+		return uri, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storeObject(storages, track.Playlist, []byte(content), track.Checksums); err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSubtitlesSRT(t *testing.T) {
+	srt := "\xef\xbb\xbf1\r\n00:00:01,500 --> 00:00:04,000\r\nHello\r\nworld\r\n\r\n2\r\n00:00:12,000 --> 00:00:13,250\r\n<i>Bye</i>\r\n"
+
+	cues, err := ParseSubtitles([]byte(srt))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cues) != 2 || cues[0].Start != 1500*time.Millisecond || cues[0].End != 4*time.Second || strings.Join(cues[0].Text, "|") != "Hello|world" {
+		t.Fatalf("unexpected cues: %+v", cues)
+	}
+
+	if cues[1].Start != 12*time.Second || cues[1].End != 13250*time.Millisecond {
+		t.Fatalf("unexpected second cue: %+v", cues[1])
+	}
+}
+
+func TestParseSubtitlesWebVTT(t *testing.T) {
+	vtt := "WEBVTT\n\nNOTE translated by hand\n\nSTYLE\n::cue { color: yellow }\n\nintro\n01:02.000 --> 01:03.500 line:0 align:start\nTop\n"
+
+	cues, err := ParseSubtitles([]byte(vtt))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cues) != 1 || cues[0].Start != 62*time.Second || cues[0].Settings != "line:0 align:start" || cues[0].Text[0] != "Top" {
+		t.Fatalf("unexpected cues: %+v", cues)
+	}
+}
+
+func TestParseSubtitlesInvalid(t *testing.T) {
+	for _, content := range []string{"", "WEBVTT\n", "1\n00:00:05,000 --> 00:00:01,000\nBackwards\n", "1\nabc --> def\nText\n"} {
+		if _, err := ParseSubtitles([]byte(content)); err == nil {
+			t.Fatalf("expected error for %q", content)
+		}
+	}
+}
+
+func TestStoreSubtitlesReservedName(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	cues := []SubtitleCue{{Start: 0, End: time.Second, Text: []string{"Hello"}}}
+
+	for _, name := range []string{masterPlaylistName, variantPlaylistPrefix + "720p"} {
+		if _, err := storeSubtitles([]FileStorage{storage}, "video-1", name, cues, 10, 0); err == nil {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+	}
+
+	if len(storage.Paths()) != 0 {
+		t.Fatalf("expected nothing stored, got %v", storage.Paths())
+	}
+}
+
+func TestSegmentSubtitles(t *testing.T) {
+	cues := []SubtitleCue{
+		{Start: 1 * time.Second, End: 2 * time.Second, Text: []string{"first"}},
+		{Start: 9 * time.Second, End: 11 * time.Second, Text: []string{"across"}},
+	}
+
+	segments, durations := SegmentSubtitles(cues, 25, mpegtsStartPTS)
+
+	if len(segments) != 3 || durations[0] != 10 || durations[2] != 5 {
+		t.Fatalf("unexpected segmentation: %d segments, durations %v", len(segments), durations)
+	}
+
+	header := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n"
+	expected := header + "\n00:00:01.000 --> 00:00:02.000\nfirst\n\n00:00:09.000 --> 00:00:11.000\nacross\n"
+	if string(segments[0]) != expected {
+		t.Fatalf("unexpected first segment:\n%s", segments[0])
+	}
+
+	if !strings.Contains(string(segments[1]), "across") || string(segments[2]) != header {
+		t.Fatalf("unexpected segments:\n%s\n%s", segments[1], segments[2])
+	}
+
+	if start := subtitleStartPTS([]Resolution{{Packaging: PackagingCMAF}}); start != 0 {
+		t.Fatalf("expected CMAF renditions to start at 0, got %d", start)
+	}
+
+	if start := subtitleStartPTS([]Resolution{{Packaging: PackagingCMAF}, {Packaging: PackagingTS}}); start != mpegtsStartPTS {
+		t.Fatalf("expected MPEG-TS renditions to set the start, got %d", start)
+	}
+}
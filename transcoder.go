@@ -0,0 +1,48 @@
+package main
+
+import "context"
+
+type Prober interface {
+	Probe(ctx context.Context, inputFilePath string) (VideoMetadata, error)
+}
+
+type Transcoder interface {
+	Encoders(ctx context.Context) ([]string, error)
+	Transcode(ctx context.Context, job TranscodeJob) error
+	ExtractSubtitles(ctx context.Context, inputFilePath string, stream int) ([]byte, error)
+	ExtractFrame(ctx context.Context, job FrameJob) error
+	ExtractSprites(ctx context.Context, job SpriteJob) error
+	ExtractPreview(ctx context.Context, job PreviewJob) error
+	EncodeDownload(ctx context.Context, job DownloadJob) error
+	Trim(ctx context.Context, job TrimJob) error
+	Concat(ctx context.Context, job ConcatJob) error
+	MeasureLoudness(ctx context.Context, job LoudnessJob) (Loudness, error)
+}
+
+// TranscodeJob describes one HLS rendition. Video jobs carry the source audio
+// unless NoAudio is set; AudioOnly jobs encode the AudioStream-th audio stream.
+// SingleFile jobs write every segment (and the init segment) to SegmentPattern,
+// which then has no sequence number, and address them with byte ranges.
+// Video jobs with an Overlay brand the scaled picture with it, and audio jobs
+// with a Loudness correction normalize the track.
+type TranscodeJob struct {
+	InputFilePath    string
+	Resolution       string
+	Width            int
+	Height           int
+	Packaging        Packaging
+	Codec            CodecFamily
+	VideoEncoder     string
+	AudioEncoder     string
+	AudioBitrate     int
+	AudioStream      int
+	AudioOnly        bool
+	NoAudio          bool
+	SingleFile       bool
+	Overlay          *OverlayProfile
+	Loudness         *LoudnessCorrection
+	SegmentTime      int
+	SegmentPattern   string
+	InitFileName     string
+	PlaylistFilePath string
+}
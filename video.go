@@ -1,66 +1,143 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/martian/v3/log"
+	"github.com/google/uuid"
 )
 
 type VideoStatus string
 
 const (
-	VideoStatusPending  VideoStatus = "pending"
-	VideoStatusComplete VideoStatus = "complete"
-	VideoStatusError    VideoStatus = "error"
+	VideoStatusPending      VideoStatus = "pending"
+	VideoStatusComplete     VideoStatus = "complete"
+	VideoStatusError        VideoStatus = "error"
+	VideoStatusReprocessing VideoStatus = "reprocessing"
 )
 
 type Video struct {
-	ID            string
-	VideoMetadata VideoMetadata
-	Status        VideoStatus
-	Resolutions   []Resolution
+	ID              string
+	VideoMetadata   VideoMetadata
+	Status          VideoStatus
+	Resolutions     []Resolution
+	AudioRenditions []AudioRendition
+	Subtitles       []SubtitleTrack
+	Images          []Image
+	Sprites         *SpriteSheets
+	Previews        []Preview
+	Downloads       []Download
+	Source          *ArchivedSource
+	ParentID        string
+	Clip            *ClipRange
+	Parts           []string
+	Crossfade       float64
+	Overlay         string
 }
 
 type Resolution struct {
-	Resolution        string
-	Manifest          string
-	TotalSegments     int
-	Url               string
-	UrlExpirationTime time.Time
+	Resolution       string
+	Width            int
+	Height           int
+	TotalSegments    int
+	Playlist         string
+	Packaging        Packaging
+	Codec            CodecFamily
+	Encoder          string
+	InitSegment      string
+	Codecs           string
+	Bandwidth        int
+	AverageBandwidth int
+	Checksums        map[string]string
+	KeyIDs           []string
+	KeyRotation      int
 }
 
 type FileStorage interface {
 	Store(filePath string, fileContent []byte) error
-	SignedURL(filePath string) (string, error)
+	URLSigner
+	URLTTL() time.Duration
+	Retrieve(filePath string) ([]byte, error)
 }
 
 type VideoMetadata struct {
-	Width    int
-	Height   int
-	Name     string
-	Duration string
+	Width           int
+	Height          int
+	SampleAspect    string
+	Name            string
+	Duration        float64
+	Container       string
+	VideoCodec      string
+	VideoProfile    string
+	FrameRate       float64
+	Bitrate         int64
+	PixelFormat     string
+	Rotation        int
+	ColorSpace      string
+	ColorTransfer   string
+	ColorPrimaries  string
+	ColorRange      string
+	AudioCodec      string
+	AudioChannels   int
+	AudioSampleRate int
+	AudioTracks     []AudioTrack
+	SubtitleTracks  []SubtitleStream
+	Loudness        *Loudness
 }
 
-type VideoUploadResponse struct {
-	Resolutions []Resolution
-}
+// UnmarshalJSON accepts records saved before Duration became numeric, when it
+// was stored as the raw ffprobe string (e.g. "234.000000").
+func (m *VideoMetadata) UnmarshalJSON(data []byte) error {
+	type metadata VideoMetadata
 
-func (v *Video) GetResolutionURL(resolution string) string {
-	for _, r := range v.Resolutions {
-		if r.Resolution == resolution {
-			return r.Url
+	aux := struct {
+		*metadata
+		Duration json.RawMessage
+	}{
+		metadata: (*metadata)(m),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Duration = 0
+	if len(aux.Duration) == 0 || string(aux.Duration) == "null" {
+		return nil
+	}
+
+	var duration string
+	if err := json.Unmarshal(aux.Duration, &duration); err == nil {
+		if duration == "" || duration == "N/A" {
+			return nil
 		}
+
+		m.Duration, err = strconv.ParseFloat(duration, 64)
+		return err
 	}
 
-	return ""
+	return json.Unmarshal(aux.Duration, &m.Duration)
+}
+
+type VideoUploadResponse struct {
+	Resolutions     []Resolution
+	AudioRenditions []AudioRendition
+	Subtitles       []SubtitleTrack
+	Images          []Image
+	Sprites         *SpriteSheets
+	Previews        []Preview
+	Downloads       []Download
+	Keys            []EncryptionKey
+	Loudness        map[int]Loudness
 }
 
 func (v *Video) GetResolution(resolution string) *Resolution {
@@ -73,259 +150,877 @@ func (v *Video) GetResolution(resolution string) *Resolution {
 	return nil
 }
 
-func (v *Video) VideoIsReady() bool {
-	return v.Status == VideoStatusComplete
+// MissingProfiles returns the profiles the video has no rendition for.
+func (v *Video) MissingProfiles(profiles []EncodingProfile) []EncodingProfile {
+	missing := make([]EncodingProfile, 0)
+
+	for _, profile := range profiles {
+		if v.GetResolution(profile.Name) == nil {
+			missing = append(missing, profile)
+		}
+	}
+
+	return missing
 }
 
-func (v *Video) AssignNewURL(resolution string, url string) {
-	for i, r := range v.Resolutions {
-		if r.Resolution == resolution {
-			v.Resolutions[i].Url = url
-			v.Resolutions[i].UrlExpirationTime = time.Now().Add(time.Minute * 60)
-			return
+// applyProcessedVideo replaces the outputs of a previous processing with new
+// ones. Uploaded subtitles are kept, and cached manifests are dropped as they
+// point at the previous renditions.
+func (v *Video) applyProcessedVideo(processedVideo *VideoUploadResponse) {
+	subtitles := processedVideo.Subtitles
+	for _, track := range v.Subtitles {
+		if track.Source == SubtitleSourceUpload {
+			subtitles = append(subtitles, track)
 		}
 	}
+
+	v.Resolutions = processedVideo.Resolutions
+	v.AudioRenditions = processedVideo.AudioRenditions
+	v.Subtitles = subtitles
+	v.Images = processedVideo.Images
+	v.Sprites = processedVideo.Sprites
+	v.Previews = processedVideo.Previews
+	v.Downloads = processedVideo.Downloads
+	v.VideoMetadata.applyLoudness(processedVideo.Loudness)
 }
 
-func (v *Video) IsExpired(resolution string) bool {
-	for _, r := range v.Resolutions {
-		if r.Resolution == resolution {
-			return time.Now().After(r.UrlExpirationTime)
+// applyLoudness records the loudness measured for each audio track, and for
+// the default track on the metadata itself.
+func (m *VideoMetadata) applyLoudness(loudness map[int]Loudness) {
+	for i, track := range m.AudioTracks {
+		measured, ok := loudness[track.Index]
+		if !ok {
+			continue
+		}
+
+		m.AudioTracks[i].Loudness = &measured
+		if track.Index == defaultAudioStream(*m) {
+			m.Loudness = &measured
 		}
 	}
-	return true
 }
 
-func GetMetadata(inputFilePath string) (VideoMetadata, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=width,height,duration", "-of", "default=noprint_wrappers=1:nokey=1", inputFilePath)
+// VideoIsReady reports whether the video can be played. A video being
+// reprocessed keeps serving its previous renditions until the new ones are
+// stored.
+func (v *Video) VideoIsReady() bool {
+	return v.Status == VideoStatusComplete || (v.Status == VideoStatusReprocessing && len(v.Resolutions) > 0)
+}
+
+// urlExpiresWithin reports whether a cached URL has less than minRemaining
+// left, so it is not handed to a viewer who could not finish with it.
+func urlExpiresWithin(expiration time.Time, minRemaining time.Duration) bool {
+	return !time.Now().Add(minRemaining).Before(expiration)
+}
+
+func IsValidResolution(profiles []EncodingProfile, resolution string) bool {
+	for _, profile := range profiles {
+		if profile.Name == resolution {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ProcessRequest struct {
+	InputFilePath string
+	VideoID       string
+	// Prefix is the storage prefix the objects of this processing run are
+	// written under, the video ID when empty. Reprocessing writes a new
+	// generation beside the one being served instead of overwriting it.
+	Prefix     string
+	Metadata   VideoMetadata
+	Profiles   []EncodingProfile
+	Thumbnails ThumbnailSettings
+	Sprites    SpriteSettings
+	Previews   PreviewSettings
+	Encryption EncryptionSettings
+	Downloads  DownloadSettings
+	Overlay    *OverlayProfile
+	Loudness   LoudnessSettings
+}
+
+func (r ProcessRequest) StoragePrefix() string {
+	if r.Prefix == "" {
+		return r.VideoID
+	}
+
+	return r.Prefix
+}
+
+// GenerationPrefix returns a new storage prefix under the video's own for
+// the objects of one reprocessing run.
+func GenerationPrefix(videoID string) string {
+	return path.Join(videoID, uuid.New().String())
+}
 
-	var outBuffer bytes.Buffer
-	cmd.Stdout = &outBuffer
+func ProcessVideo(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage) (*VideoUploadResponse, error) {
+	profiles := request.Profiles
+	if len(profiles) == 0 {
+		profiles = DefaultEncodingProfiles()
+	}
 
-	err := cmd.Run()
+	thumbnails, err := NormalizeThumbnailSettings(request.Thumbnails)
 	if err != nil {
-		return VideoMetadata{}, fmt.Errorf("metadata loading error: %v", err)
+		return nil, err
 	}
 
-	lines := strings.Split(outBuffer.String(), "\n")
-	if len(lines) < 3 {
-		return VideoMetadata{}, fmt.Errorf("metadata loading error: unexpected output")
+	request.Thumbnails = thumbnails
+
+	sprites, err := NormalizeSpriteSettings(request.Sprites)
+	if err != nil {
+		return nil, err
 	}
 
-	width := 0
-	height := 0
-	duration := ""
-	for i, line := range lines {
-		line = strings.TrimSpace(line) // Remove espaços em branco e caracteres de controle
+	request.Sprites = sprites
 
-		if i == 0 {
-			width, err = strconv.Atoi(line)
-			if err != nil {
-				return VideoMetadata{}, fmt.Errorf("width parse error: %v", err)
-			}
-		} else if i == 1 {
-			height, err = strconv.Atoi(line)
-			if err != nil {
-				return VideoMetadata{}, fmt.Errorf("height parse error: %v", err)
-			}
-		} else if i == 2 {
-			duration = line
+	previewSettings, err := NormalizePreviewSettings(request.Previews)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Previews = previewSettings
+
+	downloadSettings, err := NormalizeDownloadSettings(request.Downloads)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Downloads = downloadSettings
+
+	loudnessSettings, err := NormalizeLoudnessSettings(request.Loudness)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Loudness = loudnessSettings
+
+	registry, err := DetectEncoders(ctx, transcoder)
+
+	if err != nil {
+		return nil, err
+	}
+
+	outputDir := filepath.Join(os.TempDir(), request.VideoID)
+	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("dir error output creating: %v", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(outputDir); err != nil {
+			log.Errorf("Error cleaning up output directory: %v", err)
+		}
+	}()
+
+	encrypter, err := requestEncrypter(request, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	processedResolutions, err := transcodeRenditions(ctx, transcoder, registry, request, profiles, storages, outputDir, encrypter)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Loudness.Enabled {
+		request.Metadata.AudioTracks = measureLoudness(ctx, transcoder, request)
+	}
+
+	audioRenditions := make([]AudioRendition, 0)
+
+	for _, track := range request.Metadata.AudioTracks {
+		job := audioTranscodeJob(request, outputDir, track, ladderPackaging(processedResolutions))
+		if reservedPlaylistName(job.Resolution) {
+			return nil, fmt.Errorf("audio track %q: name is reserved for master playlists", job.Resolution)
+		}
+
+		if err := transcoder.Transcode(ctx, job); err != nil {
+			return nil, err
+		}
+
+		stored, err := storeRendition(storages, request.StoragePrefix(), outputDir, job.PlaylistFilePath, encrypter)
+		if err != nil {
+			return nil, err
+		}
+
+		audioRenditions = append(audioRenditions, AudioRendition{
+			Name:             job.Resolution,
+			Language:         track.Language,
+			Title:            track.Title,
+			Default:          track.Default,
+			Channels:         track.Channels,
+			Packaging:        job.Packaging,
+			Playlist:         stored.Playlist,
+			InitSegment:      stored.InitSegment,
+			Codecs:           stored.Codecs,
+			TotalSegments:    stored.TotalSegments,
+			Bandwidth:        stored.Bandwidth,
+			AverageBandwidth: stored.AverageBandwidth,
+			Checksums:        stored.Checksums,
+			KeyIDs:           stored.KeyIDs,
+			KeyRotation:      stored.KeyRotation,
+		})
+	}
+
+	subtitles := make([]SubtitleTrack, 0)
+
+	for _, stream := range request.Metadata.SubtitleTracks {
+		if !stream.IsText() {
+			continue
+		}
+
+		// A broken subtitle stream should not keep the video from playing.
+		content, err := transcoder.ExtractSubtitles(ctx, request.InputFilePath, stream.Index)
+		if err != nil {
+			log.Errorf("Error extracting subtitles %d: %v", stream.Index, err)
+			continue
+		}
+
+		cues, err := ParseSubtitles(content)
+		if err != nil {
+			log.Errorf("Error parsing subtitles %d: %v", stream.Index, err)
+			continue
+		}
+
+		track, err := storeSubtitles(storages, request.StoragePrefix(), SubtitleTrackName(stream.Index), cues, request.Metadata.Duration, subtitleStartPTS(processedResolutions))
+		if err != nil {
+			return nil, err
+		}
+
+		track.Language = stream.Language
+		track.Title = stream.Title
+		track.Default = stream.Default
+		track.Forced = stream.Forced
+		track.Source = SubtitleSourceEmbedded
+
+		subtitles = append(subtitles, *track)
+	}
+
+	images := make([]Image, 0)
+
+	if !request.Thumbnails.Disabled {
+		// Listing images are cosmetic: a failure leaves the video playable.
+		images, err = generateImages(ctx, transcoder, request, storages, outputDir)
+		if err != nil {
+			log.Errorf("Error generating images: %v", err)
+			images = make([]Image, 0)
+		}
+	}
+
+	var spriteSheets *SpriteSheets
+
+	if !request.Sprites.Disabled {
+		spriteSheets, err = generateSprites(ctx, transcoder, request, storages, outputDir)
+		if err != nil {
+			log.Errorf("Error generating sprites: %v", err)
+		}
+	}
+
+	previews := make([]Preview, 0)
+
+	if request.Previews.Enabled {
+		previews, err = generatePreviews(ctx, transcoder, request, storages, outputDir)
+		if err != nil {
+			log.Errorf("Error generating previews: %v", err)
+			previews = make([]Preview, 0)
+		}
+	}
+
+	downloads := make([]Download, 0)
+
+	if request.Downloads.Enabled {
+		downloads, err = generateDownloads(ctx, transcoder, registry, request, storages, outputDir)
+		if err != nil {
+			log.Errorf("Error generating downloads: %v", err)
+			downloads = make([]Download, 0)
 		}
 	}
 
-	return VideoMetadata{
-		Width:    width,
-		Height:   height,
-		Name:     filepath.Base(inputFilePath),
-		Duration: duration,
+	var keys []EncryptionKey
+	if encrypter != nil {
+		keys = encrypter.keys
+	}
+
+	if err := os.Remove(request.InputFilePath); err != nil {
+		log.Errorf("Error cleaning up input file: %v", err)
+	}
+
+	return &VideoUploadResponse{
+		Resolutions:     processedResolutions,
+		AudioRenditions: audioRenditions,
+		Subtitles:       subtitles,
+		Images:          images,
+		Sprites:         spriteSheets,
+		Previews:        previews,
+		Downloads:       downloads,
+		Keys:            keys,
+		Loudness:        measuredLoudness(request.Metadata.AudioTracks),
 	}, nil
 }
 
-func ListAvailableCodecs() ([]string, error) {
-	cmd := exec.Command("ffmpeg", "-codecs")
-
-	var outBuffer bytes.Buffer
-	cmd.Stdout = &outBuffer
+// measureLoudness runs the first loudnorm pass on every audio track and
+// returns a copy of the tracks with their measurement. A track that cannot be
+// measured, such as a silent one, is encoded without normalization.
+func measureLoudness(ctx context.Context, transcoder Transcoder, request ProcessRequest) []AudioTrack {
+	tracks := append([]AudioTrack(nil), request.Metadata.AudioTracks...)
+
+	for i, track := range tracks {
+		loudness, err := transcoder.MeasureLoudness(ctx, LoudnessJob{
+			InputFilePath: request.InputFilePath,
+			AudioStream:   track.Index,
+			Target:        request.Loudness,
+		})
+		if err != nil {
+			log.Errorf("Error measuring loudness of audio track %d: %v", track.Index, err)
+			continue
+		}
 
-	err := cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("codecs loading error: %v", err)
+		tracks[i].Loudness = &loudness
 	}
 
-	codecs := []string{}
-	lines := strings.Split(outBuffer.String(), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "V") {
-			parts := strings.Fields(line)
-			if len(parts) > 1 {
-				codecs = append(codecs, parts[1])
-			}
+	return tracks
+}
+
+func measuredLoudness(tracks []AudioTrack) map[int]Loudness {
+	loudness := make(map[int]Loudness)
+
+	for _, track := range tracks {
+		if track.Loudness != nil {
+			loudness[track.Index] = *track.Loudness
 		}
 	}
 
-	return codecs, nil
+	return loudness
 }
 
-func SelectH264Encoder() (string, error) {
-	cmd := exec.Command("ffmpeg", "-encoders")
+// ProcessRenditions transcodes and stores only the video renditions of the
+// request's profiles, for adding renditions to a video that already has its
+// audio, subtitles and images. Unlike ProcessVideo, the input file is kept.
+func ProcessRenditions(ctx context.Context, transcoder Transcoder, request ProcessRequest, storages []FileStorage) (*VideoUploadResponse, error) {
+	registry, err := DetectEncoders(ctx, transcoder)
+	if err != nil {
+		return nil, err
+	}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	// Another processing of the same video may be using <tmp>/<id>.
+	outputDir, err := os.MkdirTemp("", request.VideoID+"-")
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("dir error output creating: %v", err)
 	}
 
-	encoders := out.String()
-	if strings.Contains(encoders, "libx264") {
-		return "libx264", nil
-	} else if strings.Contains(encoders, "h264_nvenc") {
-		return "h264_nvenc", nil
-	} else if strings.Contains(encoders, "h264_qsv") {
-		return "h264_qsv", nil
+	defer func() {
+		if err := os.RemoveAll(outputDir); err != nil {
+			log.Errorf("Error cleaning up output directory: %v", err)
+		}
+	}()
+
+	encrypter, err := requestEncrypter(request, request.Profiles)
+	if err != nil {
+		return nil, err
 	}
 
-	return "", fmt.Errorf("H264 unavailable")
+	resolutions, err := transcodeRenditions(ctx, transcoder, registry, request, request.Profiles, storages, outputDir, encrypter)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &VideoUploadResponse{Resolutions: resolutions}
+	if encrypter != nil {
+		response.Keys = encrypter.keys
+	}
+
+	return response, nil
 }
 
-func IsValidResolution(resolution string) bool {
-	for _, res := range []string{"360p", "480p", "720p", "1080p"} {
-		if res == resolution {
-			return true
+// requestEncrypter returns the segment encrypter of a request, or nil when
+// encryption is disabled.
+func requestEncrypter(request ProcessRequest, profiles []EncodingProfile) (*segmentEncrypter, error) {
+	if !request.Encryption.Enabled {
+		return nil, nil
+	}
+
+	for _, profile := range profiles {
+		if profile.SingleFile {
+			return nil, fmt.Errorf("encoding profile %q: single_file packaging does not support encryption", profile.Name)
 		}
 	}
 
-	return false
+	return newSegmentEncrypter(request.VideoID, request.Encryption.RotationSegments), nil
 }
 
-func ProcessVideo(inputFilePath string, videoId string, storages []FileStorage) (*VideoUploadResponse, error) {
-	resolutions := []string{"360p", "480p", "720p", "1080p"}
-	processedResolutions := make([]Resolution, 0)
+// transcodeRenditions encodes and stores one video rendition per profile.
+func transcodeRenditions(ctx context.Context, transcoder Transcoder, registry *EncoderRegistry, request ProcessRequest, profiles []EncodingProfile, storages []FileStorage, outputDir string, encrypter *segmentEncrypter) ([]Resolution, error) {
+	resolutions := make([]Resolution, 0, len(profiles))
 
-	encoder, err := SelectH264Encoder()
+	// Audio is encoded once per source track and referenced from every video
+	// rendition, so video renditions drop it when the source has any.
+	separateAudio := len(request.Metadata.AudioTracks) > 0
 
+	for _, profile := range profiles {
+		codec, encoder, err := registry.Resolve(profile)
+		if err != nil {
+			return nil, err
+		}
+
+		width, height := RenditionSize(request.Metadata, ResolutionHeight(profile.Resolution))
+
+		job := TranscodeJob{
+			InputFilePath:    request.InputFilePath,
+			Resolution:       profile.Name,
+			Width:            width,
+			Height:           height,
+			Packaging:        profile.Packaging,
+			Codec:            codec,
+			VideoEncoder:     encoder,
+			AudioEncoder:     "aac",
+			NoAudio:          separateAudio,
+			SingleFile:       profile.SingleFile,
+			Overlay:          request.Overlay,
+			SegmentTime:      10,
+			SegmentPattern:   filepath.Join(outputDir, fmt.Sprintf("video_%s_%%03d.%s", profile.Name, profile.SegmentExtension())),
+			PlaylistFilePath: filepath.Join(outputDir, filepath.Base(PlaylistName(request.VideoID, profile.Name))),
+		}
+
+		// Single-file renditions keep the init segment at the start of the
+		// media file.
+		if profile.SingleFile {
+			job.SegmentPattern = filepath.Join(outputDir, SingleFileName(profile.Name, profile.SegmentExtension()))
+		} else if profile.Packaging == PackagingCMAF {
+			job.InitFileName = InitSegmentName(profile.Name)
+		}
+
+		if err := transcoder.Transcode(ctx, job); err != nil {
+			return nil, err
+		}
+
+		resolution, err := storeRendition(storages, request.StoragePrefix(), outputDir, job.PlaylistFilePath, encrypter)
+		if err != nil {
+			return nil, err
+		}
+
+		resolution.Resolution = profile.Name
+		resolution.Width = width
+		resolution.Height = height
+		resolution.Packaging = profile.Packaging
+		resolution.Codec = codec
+		resolution.Encoder = encoder
+
+		resolutions = append(resolutions, *resolution)
+	}
+
+	return resolutions, nil
+}
+
+// storeRendition uploads every file referenced by the playlist ffmpeg wrote
+// (init segment and media segments) followed by the playlist itself. Files
+// shared by byte-range segments are uploaded once. With an encrypter, media
+// segments are encrypted before upload and the keys used are recorded in
+// order; the init segment stays in the clear.
+func storeRendition(storages []FileStorage, videoId string, outputDir string, playlistFilePath string, encrypter *segmentEncrypter) (*Resolution, error) {
+	playlistBuffer, err := os.ReadFile(playlistFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("H264 loading encoder error: %v", err)
+		return nil, fmt.Errorf("playlist reading error %s: %v", playlistFilePath, err)
 	}
 
-	outputDir := videoId
-	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("dir error output creating: %v", err)
+	playlist, err := ParseMediaPlaylist(playlistBuffer)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, res := range resolutions {
-		outputPattern := filepath.Join(outputDir, fmt.Sprintf("video_%s_%%03d.ts", res))
-		cmd := exec.Command(
-			"ffmpeg",
-			"-i", inputFilePath,
-			"-vf", fmt.Sprintf("scale=-2:%s", res[:len(res)-1]),
-			"-c:v", encoder,
-			"-c:a", "aac",
-			"-f", "segment",
-			"-segment_time", "10",
-			"-reset_timestamps", "1",
-			"-map", "0",
-			outputPattern,
-		)
+	if encrypter != nil && playlist.HasByteRanges() {
+		return nil, fmt.Errorf("playlist %s: byte-range segments cannot be encrypted", playlistFilePath)
+	}
 
-		var errBuffer bytes.Buffer
-		cmd.Stderr = &errBuffer
+	resolution := &Resolution{
+		TotalSegments: len(playlist.Segments),
+		Checksums:     make(map[string]string),
+	}
+
+	if playlist.Map != "" {
+		initFileName := filepath.Join(outputDir, filepath.Base(playlist.Map))
 
-		if err := cmd.Start(); err != nil {
-			return nil, fmt.Errorf("FFMPEG starting error: %v", err)
+		initBuffer, err := os.ReadFile(initFileName)
+		if err != nil {
+			return nil, fmt.Errorf("buffer reading error %s: %v", initFileName, err)
 		}
 
-		if err := cmd.Wait(); err != nil {
-			return nil, fmt.Errorf("FFMPEG finishing wait step error: %v, details: %s", err, errBuffer.String())
+		resolution.InitSegment = fmt.Sprintf("%s/%s", videoId, filepath.Base(playlist.Map))
+		resolution.Codecs = CodecsFromInitSegment(byteRangeSlice(initBuffer, playlist.MapByteRange))
+
+		if err := storeObject(storages, resolution.InitSegment, initBuffer, resolution.Checksums); err != nil {
+			return nil, err
 		}
+	}
 
-		segmentIndex := 0
-		for {
-			segmentFileName := fmt.Sprintf("%s/%s", videoId, VideoSegmentName(res, segmentIndex))
-			if _, err := os.Stat(segmentFileName); err != nil {
-				if os.IsNotExist(err) {
-					break
-				}
-				return nil, fmt.Errorf("segment error: %v", err)
-			}
+	var totalBits, totalDuration float64
 
-			segmentBuffer, err := os.ReadFile(segmentFileName)
+	if encrypter != nil {
+		resolution.KeyRotation = encrypter.rotation
+	}
+
+	for i, segment := range playlist.Segments {
+		segmentPath := fmt.Sprintf("%s/%s", videoId, filepath.Base(segment.URI))
 
+		var size int64
+		if _, stored := resolution.Checksums[segmentPath]; !stored {
+			segmentFileName := filepath.Join(outputDir, filepath.Base(segment.URI))
+
+			segmentBuffer, err := os.ReadFile(segmentFileName)
 			if err != nil {
 				return nil, fmt.Errorf("buffer reading error %s: %v", segmentFileName, err)
 			}
 
-			for _, storage := range storages {
-				err := storage.Store(segmentFileName, segmentBuffer)
+			if encrypter != nil {
+				var keyID string
+
+				segmentBuffer, keyID, err = encrypter.Encrypt(i, segmentBuffer)
 				if err != nil {
-					return nil, fmt.Errorf("buffer store error %s: %v", segmentFileName, err)
+					return nil, err
+				}
+
+				if len(resolution.KeyIDs) == 0 || resolution.KeyIDs[len(resolution.KeyIDs)-1] != keyID {
+					resolution.KeyIDs = append(resolution.KeyIDs, keyID)
 				}
 			}
 
-			segmentIndex++
+			if err := storeObject(storages, segmentPath, segmentBuffer, resolution.Checksums); err != nil {
+				return nil, err
+			}
+
+			size = int64(len(segmentBuffer))
 		}
 
-		processedResolutions = append(processedResolutions, Resolution{
-			Resolution:    res,
-			Manifest:      ManifestName(videoId, res),
-			TotalSegments: segmentIndex,
-		})
+		if segment.ByteRange != nil {
+			size = segment.ByteRange.Length
+		}
+
+		bits := float64(size * 8)
+		totalBits += bits
+		totalDuration += segment.Duration
+
+		if segment.Duration > 0 {
+			resolution.Bandwidth = max(resolution.Bandwidth, int(math.Ceil(bits/segment.Duration)))
+		}
 	}
 
-	if err := os.RemoveAll(outputDir); err != nil {
-		log.Errorf("Error cleaning up output directory: %v", err)
+	if totalDuration > 0 {
+		resolution.AverageBandwidth = int(math.Ceil(totalBits / totalDuration))
 	}
 
-	if err := os.Remove(inputFilePath); err != nil {
-		log.Errorf("Error cleaning up input file: %v", err)
+	resolution.Playlist = fmt.Sprintf("%s/%s", videoId, filepath.Base(playlistFilePath))
+	if err := storeObject(storages, resolution.Playlist, playlistBuffer, resolution.Checksums); err != nil {
+		return nil, err
 	}
 
-	return &VideoUploadResponse{
-		Resolutions: processedResolutions,
-	}, nil
+	return resolution, nil
+}
+
+// RenditionSize returns the output size of a rendition whose label ("720p")
+// describes its short edge, so portrait sources keep their orientation instead
+// of being shrunk to the label's height. Sizes follow the displayed picture:
+// rotation swaps the axes and the sample aspect ratio stretches the width.
+// Without source dimensions the width is left to ffmpeg (0).
+func RenditionSize(metadata VideoMetadata, shortEdge int) (int, int) {
+	displayWidth, displayHeight := displaySize(metadata)
+	if displayWidth == 0 || displayHeight == 0 {
+		return 0, shortEdge
+	}
+
+	if displayWidth < displayHeight {
+		return shortEdge, evenDimension(float64(shortEdge) * displayHeight / displayWidth)
+	}
+
+	return evenDimension(float64(shortEdge) * displayWidth / displayHeight), shortEdge
+}
+
+// displaySize returns the size a player shows the source at, after applying
+// the sample aspect ratio and rotation.
+func displaySize(metadata VideoMetadata) (float64, float64) {
+	sampleAspect := parseRational(metadata.SampleAspect)
+	if sampleAspect <= 0 {
+		sampleAspect = 1
+	}
+
+	displayWidth := float64(metadata.Width) * sampleAspect
+	displayHeight := float64(metadata.Height)
+
+	if metadata.Rotation == 90 || metadata.Rotation == 270 {
+		displayWidth, displayHeight = displayHeight, displayWidth
+	}
+
+	return displayWidth, displayHeight
+}
+
+// evenDimension rounds to the nearest even size, as required by 4:2:0 encoders.
+func evenDimension(size float64) int {
+	even := int(math.Round(size/2)) * 2
+	if even < 2 {
+		return 2
+	}
+
+	return even
+}
+
+func ResolutionHeight(resolution string) int {
+	height, err := strconv.Atoi(strings.TrimSuffix(resolution, "p"))
+	if err != nil {
+		return 0
+	}
+
+	return height
+}
+
+// byteRangeSlice returns the part of data covered by byteRange, or all of it
+// when there is no range or it falls outside data.
+func byteRangeSlice(data []byte, byteRange *ByteRange) []byte {
+	if byteRange == nil || byteRange.Offset < 0 || byteRange.Length < 0 || byteRange.Offset+byteRange.Length > int64(len(data)) {
+		return data
+	}
+
+	return data[byteRange.Offset : byteRange.Offset+byteRange.Length]
+}
+
+func storeObject(storages []FileStorage, filePath string, content []byte, checksums map[string]string) error {
+	checksums[filePath] = Checksum(content)
+
+	for _, storage := range storages {
+		err := storage.Store(filePath, content)
+		if err != nil {
+			return fmt.Errorf("buffer store error %s: %v", filePath, err)
+		}
+	}
+
+	return nil
 }
 
 func VideoSegmentName(resolution string, segment int) string {
 	return fmt.Sprintf("video_%s_%03d.ts", resolution, segment)
 }
 
-func ManifestName(videoUUID string, resolution string) string {
-	return fmt.Sprintf("%s/manifest_%s.m3u8", videoUUID, resolution)
+func SingleFileName(resolution string, extension string) string {
+	return fmt.Sprintf("video_%s.%s", resolution, extension)
+}
+
+func InitSegmentName(resolution string) string {
+	return fmt.Sprintf("init_%s.mp4", resolution)
+}
+
+func PlaylistName(videoUUID string, resolution string) string {
+	return fmt.Sprintf("%s/playlist_%s.m3u8", videoUUID, resolution)
+}
+
+// segmentPrefix returns the storage prefix of the objects a stored playlist
+// lists, which live beside it in the playlist's generation.
+func segmentPrefix(videoID string, resolution Resolution) string {
+	if resolution.Playlist == "" {
+		return videoID
+	}
+
+	return path.Dir(resolution.Playlist)
+}
+
+func loadMediaPlaylist(storage FileStorage, resolution Resolution) (*MediaPlaylist, error) {
+	playlistBuffer, err := storage.Retrieve(resolution.Playlist)
+	if err != nil {
+		return nil, fmt.Errorf("playlist retrieve error %s: %v", resolution.Playlist, err)
+	}
+
+	return ParseMediaPlaylist(playlistBuffer)
 }
 
-func GenerateSegmentedManifestSigned(ctx context.Context, videoID string, resolution Resolution, storage FileStorage) (string, error) {
-	manifest := "#EXTM3U\n#EXT-X-VERSION:3\n"
+// signedMediaPlaylist rewrites the playlist stored during processing with
+// signed URLs and, for encrypted renditions, key URIs. Videos processed before
+// playlists were stored only know their segment count and are assumed to be
+// 10 second MPEG-TS segments.
+func signedMediaPlaylist(videoID string, resolution Resolution, storage FileStorage, keys *KeyDelivery) (string, error) {
+	if resolution.Playlist == "" {
+		manifest := "#EXTM3U\n#EXT-X-VERSION:3\n"
+
+		manifest += "#EXT-X-TARGETDURATION:10\n"
+		manifest += "#EXT-X-MEDIA-SEQUENCE:0\n"
 
-	manifest += "#EXT-X-TARGETDURATION:10\n"
-	manifest += "#EXT-X-MEDIA-SEQUENCE:0\n"
+		for i := 0; i < resolution.TotalSegments; i++ {
+			manifest += "#EXTINF:10.0,\n"
+			segmentToSign := fmt.Sprintf("%s/%s", videoID, VideoSegmentName(resolution.Resolution, i))
 
-	for i := 0; i <= resolution.TotalSegments; i++ {
-		manifest += "#EXTINF:10.0,\n"
-		segmentToSign := fmt.Sprintf("%s/%s", videoID, VideoSegmentName(resolution.Resolution, i))
+			signedSegment, err := storage.SignedURL(segmentToSign, segmentURLTTL(storage))
+
+			if err != nil {
+				return "", err
+			}
+
+			manifest += fmt.Sprintf("%s\n", signedSegment)
+		}
 
-		signedSegment, err := storage.SignedURL(segmentToSign)
+		manifest += "#EXT-X-ENDLIST\n"
+
+		return manifest, nil
+	}
+
+	playlist, err := loadMediaPlaylist(storage, resolution)
+	if err != nil {
+		return "", err
+	}
+
+	keyURIs, err := segmentKeyURIs(videoID, resolution, len(playlist.Segments), keys)
+	if err != nil {
+		return "", err
+	}
+
+	for i, uri := range keyURIs {
+		playlist.Segments[i].KeyURI = uri
+	}
+
+	return playlist.Render(func(uri string) (string, error) {
+		return storage.SignedURL(fmt.Sprintf("%s/%s", segmentPrefix(videoID, resolution), uri), segmentURLTTL(storage))
+	})
+}
+
+// defaultIndex returns the index of the one rendition of a group marked as
+// default, as HLS allows at most one DEFAULT=YES per group: the first flagged
+// one, else the first one. It returns -1 for an empty group.
+func defaultIndex(flags []bool) int {
+	for i, flag := range flags {
+		if flag {
+			return i
+		}
+	}
+
+	if len(flags) == 0 {
+		return -1
+	}
 
+	return 0
+}
+
+// renderMasterPlaylist lists every rendition of the video, taking the URI of
+// each media playlist from playlistURI.
+func renderMasterPlaylist(video *Video, playlistURI func(rendition Resolution) (string, error)) (string, error) {
+	media := make([]MediaRendition, 0, len(video.AudioRenditions)+len(video.Subtitles))
+	names := make(map[string]bool)
+
+	// Variant BANDWIDTH and CODECS must cover the audio players pair with it.
+	var audioBandwidth, audioAverageBandwidth int
+	var audioCodecs string
+
+	audioFlags := make([]bool, len(video.AudioRenditions))
+	for i, rendition := range video.AudioRenditions {
+		audioFlags[i] = rendition.Default
+	}
+
+	audioDefault := defaultIndex(audioFlags)
+
+	for i, rendition := range video.AudioRenditions {
+		uri, err := playlistURI(rendition.rendition())
 		if err != nil {
 			return "", err
 		}
 
-		manifest += fmt.Sprintf("%s\n", signedSegment)
+		media = append(media, MediaRendition{
+			Type:     "AUDIO",
+			GroupID:  audioGroupID,
+			Name:     rendition.displayName(names),
+			Language: rendition.Language,
+			Default:  i == audioDefault,
+			Channels: rendition.Channels,
+			URI:      uri,
+		})
+
+		audioBandwidth = max(audioBandwidth, rendition.Bandwidth)
+		audioAverageBandwidth = max(audioAverageBandwidth, rendition.AverageBandwidth)
+		if audioCodecs == "" || i == audioDefault {
+			audioCodecs = rendition.Codecs
+		}
 	}
 
-	manifest += "#EXT-X-ENDLIST\n"
+	subtitleNames := make(map[string]bool)
 
-	manifestPath := ManifestName(videoID, resolution.Resolution)
-	err := storage.Store(manifestPath, []byte(manifest))
+	subtitleFlags := make([]bool, len(video.Subtitles))
+	for i, track := range video.Subtitles {
+		subtitleFlags[i] = track.Default
+	}
 
-	if err != nil {
-		return "", nil
+	subtitleDefault := defaultIndex(subtitleFlags)
+
+	for i, track := range video.Subtitles {
+		uri, err := playlistURI(track.rendition())
+		if err != nil {
+			return "", err
+		}
+
+		media = append(media, MediaRendition{
+			Type:     "SUBTITLES",
+			GroupID:  subtitleGroupID,
+			Name:     track.displayName(subtitleNames),
+			Language: track.Language,
+			Default:  i == subtitleDefault,
+			Forced:   track.Forced,
+			URI:      uri,
+		})
 	}
 
-	manifestSigned, err := storage.SignedURL(manifestPath)
+	variants := make([]MasterVariant, 0, len(video.Resolutions))
 
-	if err != nil {
-		return "", nil
+	for _, resolution := range video.Resolutions {
+		uri, err := playlistURI(resolution)
+		if err != nil {
+			return "", err
+		}
+
+		bandwidth := resolution.Bandwidth
+		if bandwidth == 0 {
+			bandwidth = estimatedBandwidth(resolution.Resolution)
+		}
+
+		variant := MasterVariant{
+			URI:              uri,
+			Bandwidth:        bandwidth,
+			AverageBandwidth: resolution.AverageBandwidth,
+			Width:            resolution.Width,
+			Height:           resolution.Height,
+			Codecs:           resolution.Codecs,
+			FrameRate:        video.VideoMetadata.FrameRate,
+		}
+
+		if len(video.Subtitles) > 0 {
+			variant.Subtitles = subtitleGroupID
+		}
+
+		if len(video.AudioRenditions) > 0 {
+			variant.Audio = audioGroupID
+			variant.Bandwidth += audioBandwidth
+
+			if variant.AverageBandwidth > 0 {
+				variant.AverageBandwidth += audioAverageBandwidth
+			}
+
+			if variant.Codecs != "" && audioCodecs != "" {
+				variant.Codecs += "," + audioCodecs
+			}
+		}
+
+		variants = append(variants, variant)
 	}
 
-	return manifestSigned, nil
+	return RenderMasterPlaylist(media, variants), nil
+}
+
+// estimatedBandwidth covers renditions processed before segment sizes were
+// measured, using typical H.264 bitrates for each ladder rung.
+func estimatedBandwidth(resolution string) int {
+	switch height := ResolutionHeight(resolution); {
+	case height >= 2160:
+		return 16000000
+	case height >= 1440:
+		return 9000000
+	case height >= 1080:
+		return 5000000
+	case height >= 720:
+		return 2800000
+	case height >= 480:
+		return 1400000
+	default:
+		return 800000
+	}
 }
@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -11,21 +17,62 @@ import (
 type VideoError string
 
 const (
-	ErrResolutionInvalid  VideoError = "resolution_invalid"
-	ErrVideoNotFound      VideoError = "video_not_found"
-	ErrResolutionNotFound VideoError = "resolution_not_found"
-	ErrVideoNotReady      VideoError = "video_not_ready"
+	ErrResolutionInvalid   VideoError = "resolution_invalid"
+	ErrVideoNotFound       VideoError = "video_not_found"
+	ErrResolutionNotFound  VideoError = "resolution_not_found"
+	ErrVideoNotReady       VideoError = "video_not_ready"
+	ErrDashNotAvailable    VideoError = "dash_not_available"
+	ErrSubtitlesInvalid    VideoError = "subtitles_invalid"
+	ErrSpritesNotAvailable VideoError = "sprites_not_available"
+	ErrKeyNotFound         VideoError = "key_not_found"
+	ErrTokenInvalid        VideoError = "token_invalid"
+	ErrTokenExpired        VideoError = "token_expired"
+	ErrUnauthorized        VideoError = "unauthorized"
+	ErrDownloadNotFound    VideoError = "download_not_found"
+	ErrSourceNotArchived   VideoError = "source_not_archived"
+	ErrProfileSetNotFound  VideoError = "profile_set_not_found"
+	ErrVideoProcessing     VideoError = "video_processing"
+	ErrClipInvalid         VideoError = "clip_invalid"
+	ErrConcatInvalid       VideoError = "concat_invalid"
+	ErrOverlayNotFound     VideoError = "overlay_not_found"
+	ErrPackagingMismatch   VideoError = "packaging_mismatch"
 )
 
 type VideoService struct {
-	Storages []FileStorage
-	Database Database
+	Storages   []FileStorage
+	Database   Database
+	Transcoder Transcoder
+	Prober     Prober
+	Profiles   []EncodingProfile
+	Thumbnails ThumbnailSettings
+	Sprites    SpriteSettings
+	Previews   PreviewSettings
+	Downloads  DownloadSettings
+	Encryption EncryptionSettings
+	Keys       *KeyDelivery
+	Playback   *PlaybackTokens
+	Overlays   OverlaySettings
+	Loudness   LoudnessSettings
+
+	// Archive keeps the original uploads under ArchivePrefix so videos can be
+	// reprocessed with one of the ProfileSets; nil disables archiving.
+	Archive       FileStorage
+	ArchivePrefix string
+	ProfileSets   map[string][]EncodingProfile
+
+	// MinURLLifetime is how long a cached signed URL must still be valid to
+	// be handed out again; closer to expiry it is signed anew.
+	MinURLLifetime time.Duration
 }
 
-func NewVideoService(storages []FileStorage, database Database) *VideoService {
+func NewVideoService(storages []FileStorage, database Database, transcoder Transcoder, prober Prober, profiles []EncodingProfile) *VideoService {
 	return &VideoService{
-		Storages: storages,
-		Database: database,
+		Storages:       storages,
+		Database:       database,
+		Transcoder:     transcoder,
+		Prober:         prober,
+		Profiles:       profiles,
+		MinURLLifetime: defaultMinURLLifetime,
 	}
 }
 
@@ -35,11 +82,45 @@ func (vs *VideoService) GetVideo(ctx context.Context, videoID string) (*Video, e
 		return nil, err
 	}
 
+	imagesChanged, err := video.SignImages(vs.Storages[0], vs.MinURLLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	previewsChanged, err := video.SignPreviews(vs.Storages[0], vs.MinURLLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the URL caches are written back, so a concurrent reprocess or
+	// subtitle upload is not overwritten with this copy of the video.
+	if imagesChanged || previewsChanged {
+		_, err := vs.Database.UpdateVideo(ctx, videoID, func(current *Video) error {
+			current.adoptImageURLs(video.Images)
+			current.adoptPreviewURLs(video.Previews)
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("Error saving video: %v", err)
+		}
+	}
+
 	return &video, nil
 }
 
-func (vs *VideoService) CreateVideo(ctx context.Context, inputFilePath string) (*Video, error) {
-	metadata, err := GetMetadata(inputFilePath)
+// CreateVideo probes an upload and processes it in the background, branded
+// with the named overlay profile or the default one when overlay is empty.
+func (vs *VideoService) CreateVideo(ctx context.Context, inputFilePath string, overlay string) (*Video, error) {
+	if overlay == "" {
+		overlay = vs.Overlays.Default
+	}
+
+	if _, ok := vs.Overlays.Profiles[overlay]; overlay != "" && !ok {
+		return nil, errors.New(string(ErrOverlayNotFound))
+	}
+
+	metadata, err := vs.Prober.Probe(ctx, inputFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +130,7 @@ func (vs *VideoService) CreateVideo(ctx context.Context, inputFilePath string) (
 		ID:            videoID,
 		VideoMetadata: metadata,
 		Status:        VideoStatusPending,
+		Overlay:       overlay,
 	}
 
 	err = vs.Database.SaveVideo(ctx, video)
@@ -56,36 +138,544 @@ func (vs *VideoService) CreateVideo(ctx context.Context, inputFilePath string) (
 		return nil, err
 	}
 
-	go func() {
-		processedVideo, err := ProcessVideo(inputFilePath, videoID, vs.Storages)
+	go vs.processUpload(video, inputFilePath)
 
+	return &video, nil
+}
+
+// processUpload archives and processes the source of a pending video, then
+// saves it as complete, or with the error status on failure.
+func (vs *VideoService) processUpload(video Video, inputFilePath string) {
+	// The original is archived before processing, which removes it. A
+	// failed upload only costs the ability to reprocess.
+	if vs.Archive != nil {
+		source, err := archiveSource(vs.Archive, vs.ArchivePrefix, video.ID, inputFilePath)
 		if err != nil {
-			log.Printf("Error processing video: %v", err)
+			log.Printf("Error archiving source: %v", err)
+		} else {
+			video.Source = source
+		}
+	}
+
+	request, err := vs.processRequest(video, inputFilePath, vs.Profiles)
+	if err != nil {
+		log.Printf("Error processing video: %v", err)
+		vs.markFailed(video)
+		return
+	}
 
-			video.Status = VideoStatusError
-			err = vs.Database.SaveVideo(context.Background(), video)
+	processedVideo, err := ProcessVideo(context.Background(), vs.Transcoder, request, vs.Storages)
 
-			if err != nil {
-				log.Printf("Error saving video: %v", err)
-			}
+	if err != nil {
+		log.Printf("Error processing video: %v", err)
+		vs.markFailed(video)
+		return
+	}
+
+	// Keys are saved first so a complete video never references a key
+	// that cannot be delivered.
+	if err := vs.saveKeys(video.ID, processedVideo); err != nil {
+		vs.markFailed(video)
+		return
+	}
+
+	video.Status = VideoStatusComplete
+	video.applyProcessedVideo(processedVideo)
+	err = vs.Database.SaveVideo(context.Background(), video)
+
+	if err != nil {
+		log.Printf("Error saving video: %v", err)
+	}
+}
+
+// CreateClip creates a video from a range of another video's archived
+// original. The clip is trimmed and then processed in the background like an
+// upload, with its own archived source, and references its parent.
+func (vs *VideoService) CreateClip(ctx context.Context, parentID string, clip ClipRange) (*Video, error) {
+	parent, err := vs.Database.GetVideo(ctx, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateClipRange(clip, parent.VideoMetadata.Duration); err != nil {
+		return nil, err
+	}
+
+	if parent.Source == nil || vs.Archive == nil {
+		return nil, errors.New(string(ErrSourceNotArchived))
+	}
+
+	metadata := parent.VideoMetadata
+	metadata.Duration = clip.Duration()
+
+	video := Video{
+		ID:            uuid.New().String(),
+		VideoMetadata: metadata,
+		Status:        VideoStatusPending,
+		ParentID:      parent.ID,
+		Clip:          &clip,
+		Overlay:       parent.Overlay,
+	}
+
+	if err := vs.Database.SaveVideo(ctx, video); err != nil {
+		return nil, err
+	}
+
+	go vs.processClip(parent, video)
+
+	return &video, nil
+}
+
+func (vs *VideoService) processClip(parent Video, video Video) {
+	dir, err := os.MkdirTemp("", "clip-"+video.ID+"-")
+	if err != nil {
+		log.Printf("Error creating clip: dir error clip creating: %v", err)
+		vs.markFailed(video)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	inputFilePath, err := vs.trimClip(parent, &video, dir)
+	if err != nil {
+		log.Printf("Error creating clip: %v", err)
+		vs.markFailed(video)
+		return
+	}
+
+	vs.processUpload(video, inputFilePath)
+}
+
+// trimClip cuts the clip out of the parent's original into dir and probes the
+// result. The clip keeps the parent's name for downloads.
+func (vs *VideoService) trimClip(parent Video, video *Video, dir string) (string, error) {
+	sourceFilePath, err := restoreSource(vs.Archive, *parent.Source, dir)
+	if err != nil {
+		return "", err
+	}
+
+	clipFilePath, err := trimSource(context.Background(), vs.Transcoder, sourceFilePath, *video.Clip, dir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(sourceFilePath); err != nil {
+		log.Printf("Error cleaning up source file: %v", err)
+	}
 
-			return
+	metadata, err := vs.Prober.Probe(context.Background(), clipFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	metadata.Name = parent.VideoMetadata.Name
+	video.VideoMetadata = metadata
+
+	return clipFilePath, nil
+}
+
+// CreateConcat creates a video joining the archived originals of the
+// requested videos in order. The parts are normalized and joined, then the
+// result is processed in the background like an upload. The new video lists
+// its parts.
+func (vs *VideoService) CreateConcat(ctx context.Context, request ConcatRequest) (*Video, error) {
+	if len(request.VideoIDs) < 2 || len(request.VideoIDs) > maxConcatParts {
+		return nil, errors.New(string(ErrConcatInvalid))
+	}
+
+	parts := make([]Video, 0, len(request.VideoIDs))
+
+	for _, videoID := range request.VideoIDs {
+		part, err := vs.Database.GetVideo(ctx, videoID)
+		if err != nil {
+			return nil, err
 		}
 
-		video.Status = VideoStatusComplete
-		video.Resolutions = processedVideo.Resolutions
-		err = vs.Database.SaveVideo(context.Background(), video)
+		if part.Source == nil || vs.Archive == nil {
+			return nil, errors.New(string(ErrSourceNotArchived))
+		}
+
+		parts = append(parts, part)
+	}
+
+	if err := ValidateConcatRequest(request, parts); err != nil {
+		return nil, err
+	}
+
+	width, height, frameRate := concatOutput(parts)
+
+	video := Video{
+		ID: uuid.New().String(),
+		VideoMetadata: VideoMetadata{
+			Width:     width,
+			Height:    height,
+			FrameRate: frameRate,
+			Duration:  ConcatDuration(parts, request.Crossfade),
+		},
+		Status:    VideoStatusPending,
+		Parts:     request.VideoIDs,
+		Crossfade: request.Crossfade,
+		Overlay:   vs.Overlays.Default,
+	}
+
+	if err := vs.Database.SaveVideo(ctx, video); err != nil {
+		return nil, err
+	}
+
+	go vs.processConcat(parts, video)
+
+	return &video, nil
+}
+
+func (vs *VideoService) processConcat(parts []Video, video Video) {
+	dir, err := os.MkdirTemp("", "concat-"+video.ID+"-")
+	if err != nil {
+		log.Printf("Error concatenating videos: dir error concat creating: %v", err)
+		vs.markFailed(video)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	inputFilePath, err := vs.concatParts(parts, &video, dir)
+	if err != nil {
+		log.Printf("Error concatenating videos: %v", err)
+		vs.markFailed(video)
+		return
+	}
+
+	vs.processUpload(video, inputFilePath)
+}
+
+// concatParts restores every part's original into its own directory, as they
+// share the same archived file name, joins them into dir and probes the
+// result.
+func (vs *VideoService) concatParts(parts []Video, video *Video, dir string) (string, error) {
+	inputFilePaths := make([]string, 0, len(parts))
+
+	for i, part := range parts {
+		partDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(partDir, os.ModePerm); err != nil {
+			return "", fmt.Errorf("dir error part creating: %v", err)
+		}
+
+		inputFilePath, err := restoreSource(vs.Archive, *part.Source, partDir)
+		if err != nil {
+			return "", err
+		}
+
+		inputFilePaths = append(inputFilePaths, inputFilePath)
+	}
+
+	concatFilePath, err := concatSources(context.Background(), vs.Transcoder, parts, inputFilePaths, video.Crossfade, dir)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := vs.Prober.Probe(context.Background(), concatFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	video.VideoMetadata = metadata
+
+	return concatFilePath, nil
+}
+
+// markFailed saves a video that could not be processed with the error status.
+func (vs *VideoService) markFailed(video Video) {
+	video.Status = VideoStatusError
+
+	if err := vs.Database.SaveVideo(context.Background(), video); err != nil {
+		log.Printf("Error saving video: %v", err)
+	}
+}
+
+// processRequest describes the processing of a video with the service
+// settings and the video's overlay profile.
+func (vs *VideoService) processRequest(video Video, inputFilePath string, profiles []EncodingProfile) (ProcessRequest, error) {
+	request := ProcessRequest{
+		InputFilePath: inputFilePath,
+		VideoID:       video.ID,
+		Metadata:      video.VideoMetadata,
+		Profiles:      profiles,
+		Thumbnails:    vs.Thumbnails,
+		Sprites:       vs.Sprites,
+		Previews:      vs.Previews,
+		Downloads:     vs.Downloads,
+		Encryption:    vs.Encryption,
+		Loudness:      vs.Loudness,
+	}
+
+	if video.Overlay != "" {
+		overlay, ok := vs.Overlays.Profiles[video.Overlay]
+		if !ok {
+			return request, fmt.Errorf("overlay profile %q not found", video.Overlay)
+		}
+
+		request.Overlay = &overlay
+	}
+
+	return request, nil
+}
+
+func (vs *VideoService) saveKeys(videoID string, processedVideo *VideoUploadResponse) error {
+	if len(processedVideo.Keys) == 0 {
+		return nil
+	}
+
+	if err := vs.Database.SaveKeys(context.Background(), videoID, processedVideo.Keys); err != nil {
+		log.Printf("Error saving keys: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// ReprocessVideo transcodes the archived original again with the named
+// profile set, or the default profiles when name is empty. The video keeps
+// serving its current renditions while reprocessing and switches to the new
+// ones once they are stored; on failure the previous renditions are kept.
+func (vs *VideoService) ReprocessVideo(ctx context.Context, videoID string, profileSet string) (*Video, error) {
+	profiles, err := vs.profileSet(profileSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousStatus VideoStatus
+
+	// Checked and marked in one update so two requests cannot both start
+	// reprocessing the video.
+	video, err := vs.Database.UpdateVideo(ctx, videoID, func(current *Video) error {
+		if current.Status == VideoStatusPending || current.Status == VideoStatusReprocessing {
+			return errors.New(string(ErrVideoProcessing))
+		}
+
+		if current.Source == nil || vs.Archive == nil {
+			return errors.New(string(ErrSourceNotArchived))
+		}
+
+		previousStatus = current.Status
+		current.Status = VideoStatusReprocessing
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func(video Video) {
+		processedVideo, err := vs.reprocess(video, profiles)
+		if err != nil {
+			log.Printf("Error reprocessing video: %v", err)
+		}
+
+		// Updated in place so changes made while reprocessing, such as
+		// uploaded subtitles or cached URLs, are not lost.
+		_, err = vs.Database.UpdateVideo(context.Background(), video.ID, func(current *Video) error {
+			if processedVideo == nil {
+				current.Status = previousStatus
+				return nil
+			}
+
+			current.Status = VideoStatusComplete
+			current.applyProcessedVideo(processedVideo)
+			return nil
+		})
 
 		if err != nil {
 			log.Printf("Error saving video: %v", err)
 		}
-	}()
+	}(video)
 
 	return &video, nil
 }
 
-func (vs *VideoService) GetVideoURL(ctx context.Context, videoID, resolution string) (string, error) {
-	if !IsValidResolution(resolution) {
+func (vs *VideoService) reprocess(video Video, profiles []EncodingProfile) (*VideoUploadResponse, error) {
+	return vs.processArchived(video, func(inputFilePath string) (*VideoUploadResponse, error) {
+		request, err := vs.processRequest(video, inputFilePath, profiles)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Prefix = GenerationPrefix(video.ID)
+
+		return ProcessVideo(context.Background(), vs.Transcoder, request, vs.Storages)
+	})
+}
+
+// processArchived restores the archived original of a video, runs process on
+// it and saves the keys of the result.
+func (vs *VideoService) processArchived(video Video, process func(inputFilePath string) (*VideoUploadResponse, error)) (*VideoUploadResponse, error) {
+	dir, err := os.MkdirTemp("", "restore-"+video.ID+"-")
+	if err != nil {
+		return nil, fmt.Errorf("dir error restore creating: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	inputFilePath, err := restoreSource(vs.Archive, *video.Source, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	processedVideo, err := process(inputFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vs.saveKeys(video.ID, processedVideo); err != nil {
+		return nil, err
+	}
+
+	return processedVideo, nil
+}
+
+// BackfillVideo transcodes the renditions of the named profile set (the
+// default profiles when empty) that a video lacks, matched by profile name,
+// from its archived original. The video is marked reprocessing meanwhile, so
+// neither a reprocessing run nor another backfill can start on it, and the
+// renditions are appended in the update restoring its status and returned.
+func (vs *VideoService) BackfillVideo(ctx context.Context, videoID string, profileSet string) ([]Resolution, error) {
+	profiles, err := vs.profileSet(profileSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousStatus VideoStatus
+	var missing []EncodingProfile
+
+	// Checked and marked in one update, like ReprocessVideo, so a reprocessing
+	// run cannot switch the video to another generation under the backfill.
+	video, err := vs.Database.UpdateVideo(ctx, videoID, func(current *Video) error {
+		if current.Status == VideoStatusPending || current.Status == VideoStatusReprocessing {
+			return errors.New(string(ErrVideoProcessing))
+		}
+
+		if !current.VideoIsReady() {
+			return errors.New(string(ErrVideoNotReady))
+		}
+
+		missing = current.MissingProfiles(profiles)
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if current.Source == nil || vs.Archive == nil {
+			return errors.New(string(ErrSourceNotArchived))
+		}
+
+		// The video's audio and subtitles are aligned with its packaging.
+		if missing[0].Packaging != ladderPackaging(current.Resolutions) {
+			return errors.New(string(ErrPackagingMismatch))
+		}
+
+		previousStatus = current.Status
+		current.Status = VideoStatusReprocessing
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) == 0 {
+		return []Resolution{}, nil
+	}
+
+	processedVideo, processErr := vs.processArchived(video, func(inputFilePath string) (*VideoUploadResponse, error) {
+		request, err := vs.processRequest(video, inputFilePath, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Prefix = GenerationPrefix(video.ID)
+
+		return ProcessRenditions(ctx, vs.Transcoder, request, vs.Storages)
+	})
+
+	generation := segmentPrefix(video.ID, video.Resolutions[0])
+	added := make([]Resolution, 0)
+	superseded := false
+
+	// The status is restored even when ctx is done, so the video is never
+	// left marked reprocessing.
+	_, err = vs.Database.UpdateVideo(context.Background(), videoID, func(current *Video) error {
+		current.Status = previousStatus
+		added = added[:0]
+
+		if processErr != nil {
+			return nil
+		}
+
+		// Renditions of another generation are not mixed into the ladder.
+		superseded = len(current.Resolutions) == 0 || segmentPrefix(current.ID, current.Resolutions[0]) != generation
+		if superseded {
+			return nil
+		}
+
+		for _, resolution := range processedVideo.Resolutions {
+			if current.GetResolution(resolution.Resolution) == nil {
+				current.Resolutions = append(current.Resolutions, resolution)
+				added = append(added, resolution)
+			}
+		}
+
+		return nil
+	})
+	if processErr != nil {
+		return nil, processErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if superseded {
+		return nil, errors.New(string(ErrVideoProcessing))
+	}
+
+	return added, nil
+}
+
+// profileSet returns the named profile set, or the default profiles when name
+// is empty.
+func (vs *VideoService) profileSet(name string) ([]EncodingProfile, error) {
+	if name == "" {
+		return vs.Profiles, nil
+	}
+
+	profiles, ok := vs.ProfileSets[name]
+	if !ok {
+		return nil, errors.New(string(ErrProfileSetNotFound))
+	}
+
+	return profiles, nil
+}
+
+// IsKnownResolution reports whether resolution names a profile of the default
+// ladder or of any profile set a video may have been reprocessed with.
+func (vs *VideoService) IsKnownResolution(resolution string) bool {
+	if IsValidResolution(vs.Profiles, resolution) {
+		return true
+	}
+
+	for _, profiles := range vs.ProfileSets {
+		if IsValidResolution(profiles, resolution) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetVideoURL authorizes the caller and returns the proxy URL of the master
+// playlist, or of a master playlist restricted to a single resolution,
+// carrying a new playback token. Playlists are rendered per request and never stored.
+func (vs *VideoService) GetVideoURL(ctx context.Context, videoID, resolution string, apiKey string) (string, error) {
+	if err := vs.Playback.Authorize(apiKey); err != nil {
+		return "", err
+	}
+
+	if resolution != "" && !vs.IsKnownResolution(resolution) {
 		return "", errors.New(string(ErrResolutionInvalid))
 	}
 
@@ -98,27 +688,297 @@ func (vs *VideoService) GetVideoURL(ctx context.Context, videoID, resolution str
 		return "", errors.New(string(ErrVideoNotReady))
 	}
 
-	currentUrl := video.GetResolutionURL(resolution)
-	if currentUrl != "" && !video.IsExpired(resolution) {
-		return currentUrl, nil
+	name := masterPlaylistName
+	if resolution != "" {
+		if video.GetResolution(resolution) == nil {
+			return "", errors.New(string(ErrResolutionNotFound))
+		}
+
+		name = variantPlaylistPrefix + resolution
+	}
+
+	return vs.Playback.Issue(videoID, ProxyPlaylistPath(videoID, name)).Url, nil
+}
+
+func (vs *VideoService) VerifyVideo(ctx context.Context, videoID string) (*VerificationReport, error) {
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !video.VideoIsReady() {
+		return nil, errors.New(string(ErrVideoNotReady))
+	}
+
+	report := &VerificationReport{
+		VideoID: videoID,
+	}
+
+	for _, storage := range vs.Storages {
+		for _, resolution := range video.Resolutions {
+			report.Objects = append(report.Objects, VerifyObjects(storage, resolution.Checksums)...)
+		}
+
+		for _, audio := range video.AudioRenditions {
+			report.Objects = append(report.Objects, VerifyObjects(storage, audio.Checksums)...)
+		}
+
+		for _, subtitles := range video.Subtitles {
+			report.Objects = append(report.Objects, VerifyObjects(storage, subtitles.Checksums)...)
+		}
+
+		for _, image := range video.Images {
+			report.Objects = append(report.Objects, VerifyObjects(storage, map[string]string{image.Path: image.Checksum})...)
+		}
+
+		for _, preview := range video.Previews {
+			report.Objects = append(report.Objects, VerifyObjects(storage, map[string]string{preview.Path: preview.Checksum})...)
+		}
+
+		for _, download := range video.Downloads {
+			report.Objects = append(report.Objects, VerifyObjects(storage, map[string]string{download.Path: download.Checksum})...)
+		}
+
+		if video.Sprites != nil {
+			report.Objects = append(report.Objects, VerifyObjects(storage, video.Sprites.Checksums)...)
+		}
+	}
+
+	if video.Source != nil && vs.Archive != nil {
+		report.Objects = append(report.Objects, VerifyObjects(vs.Archive, map[string]string{video.Source.Path: video.Source.Checksum})...)
+	}
+
+	return report, nil
+}
+
+// GetDashURL authorizes the caller and returns the proxy URL of the DASH
+// manifest, carrying a new playback token.
+func (vs *VideoService) GetDashURL(ctx context.Context, videoID string, apiKey string) (string, error) {
+	if err := vs.Playback.Authorize(apiKey); err != nil {
+		return "", err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return "", err
+	}
+
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
+
+	if len(DashResolutions(video)) == 0 {
+		return "", errors.New(string(ErrDashNotAvailable))
 	}
 
-	currentResolution := video.GetResolution(resolution)
-	if currentResolution == nil {
-		return "", errors.New(string(ErrResolutionNotFound))
+	return vs.Playback.Issue(videoID, ProxyDashPath(videoID)).Url, nil
+}
+
+// GetDashManifest renders the DASH manifest for a viewer holding a playback
+// token, with segment URLs signed for this request.
+func (vs *VideoService) GetDashManifest(ctx context.Context, videoID string, token string) (string, error) {
+	if err := vs.Playback.Verify(videoID, token); err != nil {
+		return "", err
 	}
 
-	manifest, err := GenerateSegmentedManifestSigned(ctx, videoID, *currentResolution, vs.Storages[0])
+	video, err := vs.Database.GetVideo(ctx, videoID)
 	if err != nil {
 		return "", err
 	}
 
-	video.AssignNewURL(resolution, manifest)
-	err = vs.Database.SaveVideo(context.Background(), video)
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
 
+	if len(DashResolutions(video)) == 0 {
+		return "", errors.New(string(ErrDashNotAvailable))
+	}
+
+	return signedDashManifest(video, vs.Storages[0])
+}
+
+func (vs *VideoService) AddSubtitles(ctx context.Context, videoID string, content []byte, language string, title string) (*SubtitleTrack, error) {
+	video, err := vs.Database.GetVideo(ctx, videoID)
 	if err != nil {
-		log.Printf("Error saving video: %v", err)
+		return nil, err
+	}
+
+	// Processing saves the video when it finishes and would drop the track.
+	if !video.VideoIsReady() {
+		return nil, errors.New(string(ErrVideoNotReady))
+	}
+
+	cues, err := ParseSubtitles(content)
+	if err != nil {
+		log.Printf("Error parsing subtitles: %v", err)
+		return nil, errors.New(string(ErrSubtitlesInvalid))
+	}
+
+	// Each upload gets its own prefix, as the track name is only settled
+	// when the track is added to the stored video.
+	track, err := storeSubtitles(vs.Storages, GenerationPrefix(video.ID), nextSubtitleName(video), cues, video.VideoMetadata.Duration, subtitleStartPTS(video.Resolutions))
+	if err != nil {
+		return nil, err
+	}
+
+	track.Language = mediaLanguage(language)
+	track.Title = title
+	track.Source = SubtitleSourceUpload
+
+	_, err = vs.Database.UpdateVideo(ctx, videoID, func(current *Video) error {
+		if !current.VideoIsReady() {
+			return errors.New(string(ErrVideoNotReady))
+		}
+
+		track.Name = nextSubtitleName(*current)
+		current.Subtitles = append(current.Subtitles, *track)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+// GetSpritesURL authorizes the caller and returns the proxy URL of the
+// sprite thumbnail track, carrying a new playback token.
+func (vs *VideoService) GetSpritesURL(ctx context.Context, videoID string, apiKey string) (string, error) {
+	if err := vs.Playback.Authorize(apiKey); err != nil {
+		return "", err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return "", err
+	}
+
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
+
+	if video.Sprites == nil {
+		return "", errors.New(string(ErrSpritesNotAvailable))
+	}
+
+	return vs.Playback.Issue(videoID, ProxySpritesPath(videoID)).Url, nil
+}
+
+// GetSpriteVTT renders the sprite thumbnail track for a viewer holding a
+// playback token, with sheet URLs signed for this request.
+func (vs *VideoService) GetSpriteVTT(ctx context.Context, videoID string, token string) (string, error) {
+	if err := vs.Playback.Verify(videoID, token); err != nil {
+		return "", err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return "", err
+	}
+
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
+
+	return SignedSpriteVTT(video, vs.Storages[0])
+}
+
+// GetKey returns a content key to a player holding a token issued with the
+// key URI of a signed playlist.
+func (vs *VideoService) GetKey(ctx context.Context, videoID string, keyID string, token string) ([]byte, error) {
+	if vs.Keys == nil {
+		return nil, errors.New(string(ErrKeyNotFound))
+	}
+
+	if err := vs.Keys.Signer.Verify(KeyTokenSubject(videoID, keyID), token); err != nil {
+		return nil, err
+	}
+
+	key, err := vs.Database.GetKey(ctx, videoID, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.Key, nil
+}
+
+// CreatePlaybackToken issues a token for the playlist proxy of a ready video
+// to a caller presenting the playback API key.
+func (vs *VideoService) CreatePlaybackToken(ctx context.Context, videoID string, apiKey string) (*PlaybackToken, error) {
+	if err := vs.Playback.Authorize(apiKey); err != nil {
+		return nil, err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !video.VideoIsReady() {
+		return nil, errors.New(string(ErrVideoNotReady))
+	}
+
+	token := vs.Playback.Issue(videoID, ProxyPlaylistPath(videoID, masterPlaylistName))
+
+	return &token, nil
+}
+
+// GetPlaylist renders the master playlist ("master") or a media playlist for
+// a viewer holding a playback token. Nothing is written to storage.
+func (vs *VideoService) GetPlaylist(ctx context.Context, videoID string, name string, token string) (string, error) {
+	resolution, variant := strings.CutPrefix(name, variantPlaylistPrefix)
+	master := name == masterPlaylistName || variant
+
+	verify := vs.Playback.VerifyMedia
+	if master {
+		verify = vs.Playback.Verify
+	}
+
+	if err := verify(videoID, token); err != nil {
+		return "", err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return "", err
+	}
+
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
+
+	if name == masterPlaylistName {
+		return ProxyMasterPlaylist(&video, vs.Playback.IssueSession(videoID))
+	}
+
+	if variant {
+		return ProxyVariantPlaylist(&video, resolution, vs.Playback.IssueSession(videoID))
+	}
+
+	return ProxyMediaPlaylist(&video, name, vs.Storages[0], vs.Keys)
+}
+
+// GetDownloadURL authorizes the caller and signs the MP4 download in the
+// given resolution, or the largest one when resolution is empty. URLs are
+// signed per request as they carry the attachment file name.
+func (vs *VideoService) GetDownloadURL(ctx context.Context, videoID string, resolution string, apiKey string) (string, error) {
+	if err := vs.Playback.Authorize(apiKey); err != nil {
+		return "", err
+	}
+
+	video, err := vs.Database.GetVideo(ctx, videoID)
+	if err != nil {
+		return "", err
+	}
+
+	if !video.VideoIsReady() {
+		return "", errors.New(string(ErrVideoNotReady))
+	}
+
+	download := video.GetDownload(resolution)
+	if download == nil {
+		return "", errors.New(string(ErrDownloadNotFound))
 	}
 
-	return manifest, nil
+	return SignedDownloadURL(vs.Storages[0], video, *download)
 }
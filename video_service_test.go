@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readyVideo(id string) Video {
+	return Video{
+		ID:     id,
+		Status: VideoStatusComplete,
+		VideoMetadata: VideoMetadata{
+			Width:  1920,
+			Height: 1080,
+			Name:   "sample.mp4",
+		},
+		Resolutions: []Resolution{
+			{
+				Resolution:    "360p",
+				TotalSegments: 2,
+			},
+		},
+	}
+}
+
+func TestCreateVideoMetadataError(t *testing.T) {
+	db := NewMemoryDatabase()
+	service := newTestService(NewMemoryFileStorage(), db)
+
+	_, err := service.CreateVideo(context.Background(), filepath.Join(t.TempDir(), "missing.mp4"), "")
+	if err == nil {
+		t.Fatal("expected metadata error for missing input")
+	}
+
+	if calls := db.Calls("SaveVideo"); calls != 0 {
+		t.Fatalf("expected no video to be saved, got %d saves", calls)
+	}
+}
+
+func TestCreateVideoProcessesInBackground(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	db := NewMemoryDatabase()
+	service := newTestService(storage, db)
+
+	video, err := service.CreateVideo(context.Background(), writeInput(t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if video.Status != VideoStatusPending || video.VideoMetadata.Name != "input.mp4" {
+		t.Fatalf("unexpected video: %+v", video)
+	}
+
+	processed := waitForStatus(t, db, video.ID)
+	if processed.Status != VideoStatusComplete || len(processed.Resolutions) != 4 {
+		t.Fatalf("unexpected processed video: %+v", processed)
+	}
+
+	if _, ok := storage.Object(video.ID + "/video_360p_000.ts"); !ok {
+		t.Fatalf("expected segments to be uploaded, got %v", storage.Paths())
+	}
+}
+
+func TestCreateVideoProcessingFailure(t *testing.T) {
+	db := NewMemoryDatabase()
+	service := newTestService(NewMemoryFileStorage(), db)
+	service.Transcoder.(*ScriptedTranscoder).Failures["720p"] = errors.New("encoder crashed")
+
+	video, err := service.CreateVideo(context.Background(), writeInput(t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if processed := waitForStatus(t, db, video.ID); processed.Status != VideoStatusError {
+		t.Fatalf("expected error status, got %s", processed.Status)
+	}
+}
+
+func TestGetVideoURLInvalidResolution(t *testing.T) {
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase())
+
+	_, err := service.GetVideoURL(context.Background(), "any", "999p", testAPIKey)
+	if err == nil || err.Error() != string(ErrResolutionInvalid) {
+		t.Fatalf("expected %s, got %v", ErrResolutionInvalid, err)
+	}
+}
+
+func TestGetVideoURLNotFound(t *testing.T) {
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase())
+
+	_, err := service.GetVideoURL(context.Background(), "missing", "360p", testAPIKey)
+	if err == nil || err.Error() != string(ErrVideoNotFound) {
+		t.Fatalf("expected %s, got %v", ErrVideoNotFound, err)
+	}
+}
+
+func TestGetVideoURLNotReady(t *testing.T) {
+	video := readyVideo("video-1")
+	video.Status = VideoStatusPending
+
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase(video))
+
+	_, err := service.GetVideoURL(context.Background(), video.ID, "360p", testAPIKey)
+	if err == nil || err.Error() != string(ErrVideoNotReady) {
+		t.Fatalf("expected %s, got %v", ErrVideoNotReady, err)
+	}
+}
+
+func TestGetVideoURLResolutionNotFound(t *testing.T) {
+	video := readyVideo("video-1")
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase(video))
+
+	_, err := service.GetVideoURL(context.Background(), video.ID, "1080p", testAPIKey)
+	if err == nil || err.Error() != string(ErrResolutionNotFound) {
+		t.Fatalf("expected %s, got %v", ErrResolutionNotFound, err)
+	}
+}
+
+func TestGetVideoURLUnauthorized(t *testing.T) {
+	db := NewMemoryDatabase(readyVideo("video-1"))
+	service := newTestService(NewMemoryFileStorage(), db)
+
+	for _, apiKey := range []string{"", "wrong"} {
+		_, err := service.GetVideoURL(context.Background(), "video-1", "360p", apiKey)
+		if err == nil || err.Error() != string(ErrUnauthorized) {
+			t.Fatalf("expected %s, got %v", ErrUnauthorized, err)
+		}
+	}
+
+	if calls := db.Calls("GetVideo"); calls != 0 {
+		t.Fatalf("expected the video not to be looked up, got %d calls", calls)
+	}
+}
+
+func TestGetVideoURLIssuesProxyURL(t *testing.T) {
+	video := readyVideo("video-1")
+	storage := NewMemoryFileStorage()
+	db := NewMemoryDatabase(video)
+	service := newTestService(storage, db)
+
+	for resolution, playlist := range map[string]string{"": "master", "360p": "master_360p"} {
+		url, err := service.GetVideoURL(context.Background(), video.ID, resolution, testAPIKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		prefix := "https://api.example.com/video/video-1/hls/" + playlist + ".m3u8?token="
+		if !strings.HasPrefix(url, prefix) {
+			t.Fatalf("expected proxy URL %s..., got %s", prefix, url)
+		}
+	}
+
+	if len(storage.Paths()) != 0 || db.Calls("SaveVideo") != 0 || db.Calls("UpdateVideo") != 0 {
+		t.Fatalf("expected nothing written, got %v", storage.Paths())
+	}
+}
+
+func TestGetVideoURLLatency(t *testing.T) {
+	video := readyVideo("video-1")
+	db := NewMemoryDatabase(video)
+	db.SetLatency(20 * time.Millisecond)
+
+	service := newTestService(NewMemoryFileStorage(), db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := service.GetVideoURL(ctx, video.ID, "360p", testAPIKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected database latency to apply, took %s", elapsed)
+	}
+}
+
+func TestVerifyVideo(t *testing.T) {
+	video := readyVideo("video-1")
+	storage := NewMemoryFileStorage()
+
+	segment := []byte("segment")
+	storage.Store("video-1/video_360p_000.ts", segment)
+	storage.Store("video-1/video_360p_001.ts", []byte("corrupted"))
+
+	video.Resolutions[0].Checksums = map[string]string{
+		"video-1/video_360p_000.ts": Checksum(segment),
+		"video-1/video_360p_001.ts": Checksum([]byte("segment-1")),
+		"video-1/video_360p_002.ts": Checksum([]byte("segment-2")),
+	}
+
+	service := newTestService(storage, NewMemoryDatabase(video))
+
+	report, err := service.VerifyVideo(context.Background(), video.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if report.Valid() {
+		t.Fatal("expected report to be invalid")
+	}
+
+	failures := report.Failures()
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 failures, got %d", len(failures))
+	}
+
+	if failures[0].Path != "video-1/video_360p_001.ts" || failures[0].Actual != Checksum([]byte("corrupted")) {
+		t.Fatalf("unexpected mismatch: %+v", failures[0])
+	}
+
+	if failures[1].Path != "video-1/video_360p_002.ts" || failures[1].Error == "" {
+		t.Fatalf("expected missing object error: %+v", failures[1])
+	}
+}
+
+// proxyPlaylist renders a playlist through the proxy with a fresh token.
+func proxyPlaylist(t *testing.T, service *VideoService, videoID string, name string) string {
+	t.Helper()
+
+	playlist, err := service.GetPlaylist(context.Background(), videoID, name, service.Playback.Issue(videoID, ProxyPlaylistPath(videoID, name)).Token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return playlist
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	service := newTestService(storage, NewMemoryDatabase(readyVideo("video-1")))
+
+	master := proxyPlaylist(t, service, "video-1", masterPlaylistName)
+	if !strings.Contains(master, "#EXT-X-STREAM-INF:BANDWIDTH=800000\n360p.m3u8?token=") {
+		t.Fatalf("unexpected master playlist:\n%s", master)
+	}
+
+	if len(storage.Paths()) != 0 {
+		t.Fatalf("expected nothing written to storage, got %v", storage.Paths())
+	}
+}
+
+func TestMasterPlaylistWithAudioRenditions(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	video := cmafVideo(t, storage)
+
+	for _, name := range []string{"audio_0", "audio_1"} {
+		playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MAP:URI=\"init_%s.mp4\"\n#EXTINF:10.000000,\n%s_000.m4s\n#EXT-X-ENDLIST\n", name, name)
+		if err := storage.Store(PlaylistName(video.ID, name), []byte(playlist)); err != nil {
+			t.Fatal(err)
+		}
+
+		video.AudioRenditions = append(video.AudioRenditions, AudioRendition{
+			Name:             name,
+			Channels:         2,
+			Playlist:         PlaylistName(video.ID, name),
+			InitSegment:      fmt.Sprintf("%s/init_%s.mp4", video.ID, name),
+			Codecs:           "mp4a.40.2",
+			Bandwidth:        130000,
+			AverageBandwidth: 128000,
+		})
+	}
+
+	video.AudioRenditions[0].Language = "en"
+	video.AudioRenditions[0].Default = true
+	video.AudioRenditions[1].Title = "Commentary"
+	video.AudioRenditions[1].Default = true
+	video.Resolutions[1].Codecs = "avc1.64001f"
+
+	service := newTestService(storage, NewMemoryDatabase(video))
+
+	master := proxyPlaylist(t, service, video.ID, masterPlaylistName)
+
+	for _, expected := range []string{
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="en",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio_0.m3u8?token=`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="Commentary",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2",URI="audio_1.m3u8?token=`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=930000,AUDIO="audio"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=2630000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="audio"`,
+	} {
+		if !strings.Contains(master, expected) {
+			t.Fatalf("expected %s in master playlist:\n%s", expected, master)
+		}
+	}
+
+	variant := proxyPlaylist(t, service, video.ID, variantPlaylistPrefix+"720p")
+	if strings.Count(variant, "#EXT-X-STREAM-INF") != 1 || !strings.Contains(variant, `720p.m3u8?token=`) {
+		t.Fatalf("expected only the 720p variant:\n%s", variant)
+	}
+
+	if !strings.Contains(variant, `URI="audio_0.m3u8?token=`) {
+		t.Fatalf("expected the audio group in the variant playlist:\n%s", variant)
+	}
+}
+
+func TestAddSubtitles(t *testing.T) {
+	video := readyVideo("video-1")
+	video.VideoMetadata.Duration = 20
+	video.Subtitles = []SubtitleTrack{{Name: "subtitles_1"}}
+
+	storage := NewMemoryFileStorage()
+	db := NewMemoryDatabase(video)
+	service := newTestService(storage, db)
+
+	track, err := service.AddSubtitles(context.Background(), video.ID, []byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), "eng", "English CC")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if track.Name != "subtitles_2" || track.Language != "en" || track.Source != SubtitleSourceUpload || track.TotalSegments != 2 {
+		t.Fatalf("unexpected track: %+v", track)
+	}
+
+	master := proxyPlaylist(t, service, video.ID, masterPlaylistName)
+	expected := `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English CC",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="subtitles_2.m3u8?token=`
+	if !strings.Contains(master, expected) || !strings.Contains(master, `SUBTITLES="subs"`) {
+		t.Fatalf("expected subtitles in master playlist:\n%s", master)
+	}
+}
+
+func TestAddSubtitlesConcurrent(t *testing.T) {
+	db := NewMemoryDatabase(readyVideo("video-1"))
+	db.SetLatency(5 * time.Millisecond)
+
+	service := newTestService(NewMemoryFileStorage(), db)
+	valid := []byte("WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := service.AddSubtitles(context.Background(), "video-1", valid, "en", ""); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	video, _ := db.GetVideo(context.Background(), "video-1")
+
+	names := make(map[string]bool)
+	playlists := make(map[string]bool)
+	for _, track := range video.Subtitles {
+		names[track.Name] = true
+		playlists[track.Playlist] = true
+	}
+
+	if len(video.Subtitles) != 4 || len(names) != 4 || len(playlists) != 4 {
+		t.Fatalf("expected 4 distinct tracks, got %+v", video.Subtitles)
+	}
+}
+
+func TestAddSubtitlesErrors(t *testing.T) {
+	pending := readyVideo("pending")
+	pending.Status = VideoStatusPending
+
+	service := newTestService(NewMemoryFileStorage(), NewMemoryDatabase(readyVideo("video-1"), pending))
+	valid := []byte("WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n")
+
+	if _, err := service.AddSubtitles(context.Background(), "pending", valid, "", ""); err == nil || err.Error() != string(ErrVideoNotReady) {
+		t.Fatalf("expected not ready error, got %v", err)
+	}
+
+	if _, err := service.AddSubtitles(context.Background(), "video-1", []byte("not subtitles"), "", ""); err == nil || err.Error() != string(ErrSubtitlesInvalid) {
+		t.Fatalf("expected invalid subtitles error, got %v", err)
+	}
+}
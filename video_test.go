@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeInput(t *testing.T) string {
+	t.Helper()
+
+	inputFilePath := filepath.Join(t.TempDir(), "input.mp4")
+	if err := os.WriteFile(inputFilePath, []byte("source"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return inputFilePath
+}
+
+var landscape = VideoMetadata{
+	Width:  1920,
+	Height: 1080,
+}
+
+func TestProcessVideoLadder(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.Segments["1080p"] = 3
+
+	storage := NewMemoryFileStorage()
+	inputFilePath := writeInput(t)
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{InputFilePath: inputFilePath, VideoID: "video-1", Metadata: landscape}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	jobs := transcoder.TranscodedJobs()
+	expected := []string{"360p", "480p", "720p", "1080p"}
+
+	if len(jobs) != len(expected) || len(response.Resolutions) != len(expected) {
+		t.Fatalf("expected %d renditions, got %d jobs and %d resolutions", len(expected), len(jobs), len(response.Resolutions))
+	}
+
+	for i, res := range expected {
+		if jobs[i].Resolution != res || jobs[i].Height != ResolutionHeight(res) || jobs[i].VideoEncoder != "libx264" {
+			t.Fatalf("unexpected job for %s: %+v", res, jobs[i])
+		}
+
+		if response.Resolutions[i].Resolution != res {
+			t.Fatalf("expected resolution %s, got %s", res, response.Resolutions[i].Resolution)
+		}
+	}
+
+	last := response.Resolutions[3]
+	if last.TotalSegments != 3 {
+		t.Fatalf("expected 3 segments for 1080p, got %d", last.TotalSegments)
+	}
+
+	for _, path := range []string{
+		"video-1/video_1080p_000.ts",
+		"video-1/video_1080p_002.ts",
+		"video-1/playlist_1080p.m3u8",
+	} {
+		content, ok := storage.Object(path)
+		if !ok {
+			t.Fatalf("expected %s to be uploaded, got %v", path, storage.Paths())
+		}
+
+		if last.Checksums[path] != Checksum(content) {
+			t.Fatalf("checksum mismatch for %s", path)
+		}
+	}
+
+	if _, err := os.Stat(inputFilePath); !os.IsNotExist(err) {
+		t.Fatal("expected input file to be removed")
+	}
+
+	if _, err := os.Stat(filepath.Dir(jobs[0].SegmentPattern)); !os.IsNotExist(err) {
+		t.Fatal("expected output directory to be removed")
+	}
+}
+
+func TestProcessVideoTranscodeFailure(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.Failures["480p"] = errors.New("encoder crashed")
+
+	storage := NewMemoryFileStorage()
+	inputFilePath := writeInput(t)
+
+	_, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{InputFilePath: inputFilePath, VideoID: "video-1", Metadata: landscape}, []FileStorage{storage})
+	if err == nil || !strings.Contains(err.Error(), "encoder crashed") {
+		t.Fatalf("expected transcode error, got %v", err)
+	}
+
+	if jobs := transcoder.TranscodedJobs(); len(jobs) != 2 {
+		t.Fatalf("expected processing to stop after the failing rendition, got %d jobs", len(jobs))
+	}
+
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "video-1")); !os.IsNotExist(err) {
+		t.Fatal("expected output directory to be removed after failure")
+	}
+}
+
+func TestProcessVideoUploadFailure(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	storage.FailNth("Store", 2, errors.New("bucket unavailable"))
+
+	_, err := ProcessVideo(context.Background(), NewScriptedTranscoder(), ProcessRequest{InputFilePath: writeInput(t), VideoID: "video-1", Metadata: landscape}, []FileStorage{storage})
+	if err == nil || !strings.Contains(err.Error(), "bucket unavailable") {
+		t.Fatalf("expected upload error, got %v", err)
+	}
+}
+
+func TestProcessVideoWithoutH264(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.AvailableEncoders = []string{"aac", "libvpx-vp9"}
+
+	_, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{InputFilePath: writeInput(t), VideoID: "video-1", Metadata: landscape}, []FileStorage{NewMemoryFileStorage()})
+	if err == nil {
+		t.Fatal("expected missing encoder error")
+	}
+
+	if calls := transcoder.Calls("Transcode"); calls != 0 {
+		t.Fatalf("expected no transcode, got %d", calls)
+	}
+}
+
+func TestVideoMetadataLegacyDuration(t *testing.T) {
+	tests := map[string]float64{
+		`{"Width": 1080, "Duration": "234.000000"}`: 234,
+		`{"Width": 1080, "Duration": 12.5}`:         12.5,
+		`{"Width": 1080, "Duration": ""}`:           0,
+		`{"Width": 1080}`:                           0,
+	}
+
+	for data, expected := range tests {
+		var metadata VideoMetadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			t.Fatalf("unexpected error for %s: %v", data, err)
+		}
+
+		if metadata.Width != 1080 || metadata.Duration != expected {
+			t.Fatalf("expected duration %v for %s, got %+v", expected, data, metadata)
+		}
+	}
+}
+
+func TestProcessVideoPortraitSizes(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	portrait := VideoMetadata{Width: 1080, Height: 1920}
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{InputFilePath: writeInput(t), VideoID: "video-1", Metadata: portrait}, []FileStorage{NewMemoryFileStorage()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	last := response.Resolutions[len(response.Resolutions)-1]
+	if last.Resolution != "1080p" || last.Width != 1080 || last.Height != 1920 {
+		t.Fatalf("expected 1080x1920 for portrait 1080p, got %+v", last)
+	}
+
+	if job := transcoder.TranscodedJobs()[0]; job.Width != 360 || job.Height != 640 {
+		t.Fatalf("expected 360x640 job for portrait 360p, got %dx%d", job.Width, job.Height)
+	}
+}
+
+func TestRenditionSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		metadata  VideoMetadata
+		shortEdge int
+		width     int
+		height    int
+	}{
+		{"landscape", VideoMetadata{Width: 1920, Height: 1080}, 720, 1280, 720},
+		{"portrait", VideoMetadata{Width: 1080, Height: 1920}, 1080, 1080, 1920},
+		{"square", VideoMetadata{Width: 1000, Height: 1000}, 480, 480, 480},
+		{"rotated phone footage", VideoMetadata{Width: 1920, Height: 1080, Rotation: 90}, 720, 720, 1280},
+		{"upside down", VideoMetadata{Width: 1920, Height: 1080, Rotation: 180}, 360, 640, 360},
+		{"anamorphic dvd", VideoMetadata{Width: 720, Height: 480, SampleAspect: "32:27"}, 480, 854, 480},
+		{"unknown sample aspect", VideoMetadata{Width: 1280, Height: 720, SampleAspect: "0:1"}, 360, 640, 360},
+		{"odd result rounded to even", VideoMetadata{Width: 1000, Height: 750}, 360, 480, 360},
+		{"unknown dimensions", VideoMetadata{}, 480, 0, 480},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height := RenditionSize(test.metadata, test.shortEdge)
+			if width != test.width || height != test.height {
+				t.Fatalf("expected %dx%d, got %dx%d", test.width, test.height, width, height)
+			}
+		})
+	}
+}
+
+func TestProcessVideoCMAF(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	profiles := []EncodingProfile{{Name: "720p", Resolution: "720p", Packaging: PackagingCMAF}}
+
+	response, err := ProcessVideo(context.Background(), NewScriptedTranscoder(), ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      landscape,
+		Profiles:      profiles,
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resolution := response.Resolutions[0]
+	if resolution.Packaging != PackagingCMAF || resolution.InitSegment != "video-1/init_720p.mp4" || resolution.TotalSegments != 2 {
+		t.Fatalf("unexpected resolution: %+v", resolution)
+	}
+
+	for _, path := range []string{"video-1/init_720p.mp4", "video-1/video_720p_000.m4s", "video-1/video_720p_001.m4s", "video-1/playlist_720p.m3u8"} {
+		if _, ok := storage.Object(path); !ok {
+			t.Fatalf("expected %s to be uploaded, got %v", path, storage.Paths())
+		}
+
+		if resolution.Checksums[path] == "" {
+			t.Fatalf("expected checksum for %s", path)
+		}
+	}
+
+	manifest, err := signedMediaPlaylist("video-1", resolution, storage, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(manifest, "#EXT-X-VERSION:7\n") || !strings.Contains(manifest, `#EXT-X-MAP:URI="https://memory.test/video-1/init_720p.mp4`) {
+		t.Fatalf("unexpected manifest:\n%s", manifest)
+	}
+}
+
+func TestProcessVideoSingleFile(t *testing.T) {
+	storage := NewMemoryFileStorage()
+	profiles := []EncodingProfile{{Name: "720p", Resolution: "720p", Packaging: PackagingCMAF, SingleFile: true}}
+
+	response, err := ProcessVideo(context.Background(), NewScriptedTranscoder(), ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      landscape,
+		Profiles:      profiles,
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resolution := response.Resolutions[0]
+	if resolution.InitSegment != "video-1/video_720p.m4s" || resolution.TotalSegments != 2 || resolution.Bandwidth == 0 {
+		t.Fatalf("unexpected resolution: %+v", resolution)
+	}
+
+	if _, ok := storage.Object("video-1/video_720p.m4s"); !ok || len(resolution.Checksums) != 2 {
+		t.Fatalf("expected one media object per rendition, got %v", resolution.Checksums)
+	}
+
+	manifest, err := signedMediaPlaylist("video-1", resolution, storage, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if storage.Calls("SignedURL") != 1 || !strings.Contains(manifest, `BYTERANGE="9@0"`) || strings.Count(manifest, "#EXT-X-BYTERANGE:") != 2 {
+		t.Fatalf("expected a single signed URL with byte ranges, got %d calls:\n%s", storage.Calls("SignedURL"), manifest)
+	}
+
+	_, err = ProcessVideo(context.Background(), NewScriptedTranscoder(), ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-2",
+		Metadata:      landscape,
+		Profiles:      profiles,
+		Encryption:    EncryptionSettings{Enabled: true},
+	}, []FileStorage{NewMemoryFileStorage()})
+	if err == nil {
+		t.Fatal("expected single file packaging to reject encryption")
+	}
+}
+
+func TestProcessVideoSeparateAudio(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	storage := NewMemoryFileStorage()
+
+	metadata := landscape
+	metadata.AudioTracks = []AudioTrack{
+		{Index: 0, Channels: 2, Language: "en", Default: true},
+		{Index: 1, Channels: 6, Language: "pt", Title: "Dublado"},
+	}
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "720p", Resolution: "720p", Packaging: PackagingTS}},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	jobs := transcoder.TranscodedJobs()
+	if len(jobs) != 3 || !jobs[0].NoAudio || !jobs[1].AudioOnly || jobs[2].AudioStream != 1 || jobs[2].AudioBitrate != 384000 {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+
+	if len(response.AudioRenditions) != 2 {
+		t.Fatalf("expected 2 audio renditions, got %+v", response.AudioRenditions)
+	}
+
+	audio := response.AudioRenditions[1]
+	if audio.Name != "audio_1" || audio.Language != "pt" || audio.Title != "Dublado" || audio.Default || audio.InitSegment != "" {
+		t.Fatalf("unexpected audio rendition: %+v", audio)
+	}
+
+	// Audio of a TS ladder is muxed by the same MPEG-TS muxer as the
+	// variants, so both start 1.4 s into the timeline.
+	startPTS := audio.rendition().Packaging.StartPTS()
+	if startPTS != mpegtsStartPTS || startPTS != response.Resolutions[0].Packaging.StartPTS() || !strings.Contains(strings.Join(jobs[1].ffmpegArgs(), " "), "-hls_segment_type mpegts") {
+		t.Fatalf("expected audio to start at the TS ladder's %d, got %d", mpegtsStartPTS, startPTS)
+	}
+
+	for _, path := range []string{"video-1/audio_1_000.ts", "video-1/playlist_audio_1.m3u8"} {
+		if audio.Checksums[path] == "" {
+			t.Fatalf("expected %s to be uploaded with a checksum, got %v", path, storage.Paths())
+		}
+	}
+}
+
+func TestProcessVideoSeparateAudioCMAF(t *testing.T) {
+	metadata := landscape
+	metadata.AudioTracks = []AudioTrack{{Index: 0, Channels: 2}}
+
+	response, err := ProcessVideo(context.Background(), NewScriptedTranscoder(), ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "720p", Resolution: "720p", Packaging: PackagingCMAF, Codec: CodecH264}},
+	}, []FileStorage{NewMemoryFileStorage()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	audio := response.AudioRenditions[0]
+	if audio.Packaging != PackagingCMAF || audio.InitSegment != "video-1/init_audio_0.mp4" || audio.rendition().Packaging.StartPTS() != 0 {
+		t.Fatalf("expected CMAF audio starting at 0, got %+v", audio)
+	}
+}
+
+func TestProcessVideoEmbeddedSubtitles(t *testing.T) {
+	transcoder := NewScriptedTranscoder()
+	transcoder.Subtitles[0] = "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nOlá\n"
+	storage := NewMemoryFileStorage()
+
+	metadata := landscape
+	metadata.Duration = 12
+	metadata.SubtitleTracks = []SubtitleStream{
+		{Index: 0, Codec: "subrip", Language: "pt", Forced: true},
+		{Index: 1, Codec: "hdmv_pgs_subtitle", Language: "en"},
+		{Index: 2, Codec: "ass", Language: "es"},
+	}
+
+	response, err := ProcessVideo(context.Background(), transcoder, ProcessRequest{
+		InputFilePath: writeInput(t),
+		VideoID:       "video-1",
+		Metadata:      metadata,
+		Profiles:      []EncodingProfile{{Name: "360p", Resolution: "360p", Packaging: PackagingTS}},
+	}, []FileStorage{storage})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Bitmap subtitles are skipped and the unscripted stream fails extraction.
+	if calls := transcoder.Calls("ExtractSubtitles"); calls != 2 {
+		t.Fatalf("expected 2 extractions, got %d", calls)
+	}
+
+	if len(response.Subtitles) != 1 {
+		t.Fatalf("expected 1 subtitle track, got %+v", response.Subtitles)
+	}
+
+	track := response.Subtitles[0]
+	if track.Name != "subtitles_0" || track.Language != "pt" || !track.Forced || track.Source != SubtitleSourceEmbedded || track.TotalSegments != 2 {
+		t.Fatalf("unexpected subtitle track: %+v", track)
+	}
+
+	for _, path := range []string{"video-1/subtitles_0_000.vtt", "video-1/subtitles_0_001.vtt", "video-1/playlist_subtitles_0.m3u8"} {
+		if track.Checksums[path] == "" {
+			t.Fatalf("expected %s to be uploaded, got %v", path, storage.Paths())
+		}
+	}
+}